@@ -1,8 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 
 	"github.com/jukuly/ss_machmos/server/internal/api"
@@ -10,6 +14,7 @@ import (
 	"github.com/jukuly/ss_machmos/server/internal/model"
 	"github.com/jukuly/ss_machmos/server/internal/out"
 	"github.com/jukuly/ss_machmos/server/internal/server"
+	"github.com/jukuly/ss_machmos/server/internal/simulator"
 )
 
 func serve() {
@@ -32,13 +37,14 @@ func serve() {
 		return
 	}
 	model.LoadSensorHistory()
+	model.LoadBatteryHistory()
 	err = model.LoadSettings(gateway, model.GATEWAY_FILE)
 	if err != nil {
 		out.Logger.Println("Error loading Gateway settings. Run 'ssmachmos config --id <gateway-id>' and 'ssmachmos config --password <gateway-password>' to set the Gateway settings.")
 	}
 
 	out.Logger.Println("Starting bluetooth advertisement...")
-	err = server.Init(gateway)
+	err = server.Init(gateway, server.NewBluetoothTransport())
 	if err != nil {
 		out.Logger.Println("Error:", err)
 	} else {
@@ -57,6 +63,112 @@ func serve() {
 	api.Start()
 }
 
+// Run the gateway on a fake transport, fed by virtual sensors
+func simulate(options []string, args []string) {
+	config := simulator.DefaultConfig()
+	configDir, dataDir := "", ""
+	for i, option := range options {
+		if i >= len(args) {
+			fmt.Printf("Missing value for option %s\n", option)
+			return
+		}
+		var err error
+		switch option {
+		case "--sensors":
+			config.Sensors, err = strconv.Atoi(args[i])
+		case "--model":
+			config.Models = strings.Split(args[i], ",")
+		case "--loss":
+			config.Loss, err = strconv.ParseFloat(args[i], 64)
+		case "--drop":
+			config.Drop, err = strconv.ParseFloat(args[i], 64)
+		case "--duplicate":
+			config.Duplicate, err = strconv.ParseFloat(args[i], 64)
+		case "--mtu":
+			config.MTU, err = strconv.Atoi(args[i])
+		case "--interval":
+			config.WakeUpInterval, err = strconv.Atoi(args[i])
+		case "--cycles":
+			config.Cycles, err = strconv.Atoi(args[i])
+		case "--config":
+			configDir = args[i]
+		case "--data":
+			dataDir = args[i]
+		default:
+			fmt.Printf("Option %s does not exist for command simulate\n", option)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Invalid value %s for option %s\n", args[i], option)
+			return
+		}
+	}
+
+	// The simulated gateway takes over the socket, don't fight a real one
+	conn, err := cli.OpenConnection()
+	if err == nil {
+		out.Logger.Println("Server already runnning, stop it before simulating.")
+		conn.Close()
+		return
+	}
+
+	// Virtual sensors are paired and their captures saved like real ones, keep
+	// them away from the real gateway unless asked to use its directories
+	scratch, err := os.MkdirTemp("", "ssmachmos-simulate-")
+	if err != nil {
+		out.Logger.Println("Error:", err)
+		return
+	}
+	out.Logger.Println("Simulation files are in", scratch)
+	if dataDir == "" {
+		dataDir = path.Join(scratch, "data")
+	}
+	server.DataRoot = dataDir
+
+	var gateway *model.Gateway = &model.Gateway{}
+	if configDir == "" {
+		model.ConfigDir = path.Join(scratch, "config")
+		// Synthetic captures go nowhere until a sink is configured
+		gateway.Sinks = []model.SinkConfig{{Name: "dryrun", Type: "dryrun", Enabled: true, Options: map[string]string{}}}
+		err = model.SetGatewayId(gateway, "simulator")
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return
+		}
+	} else {
+		out.Logger.Println("Using the sensors and settings in", configDir+", uploads go to its sinks")
+		model.ConfigDir = configDir
+		err = model.LoadSettings(gateway, model.GATEWAY_FILE)
+		if err != nil {
+			out.Logger.Println("Error loading Gateway settings, uploads will fail:", err)
+		}
+	}
+	err = model.LoadSensors()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		out.Logger.Println(err.Error())
+		return
+	}
+	model.LoadSensorHistory()
+	model.LoadBatteryHistory()
+
+	transport := server.NewFakeTransport()
+	err = server.Init(gateway, transport)
+	if err == nil {
+		err = server.StartAdvertising()
+	}
+	if err != nil {
+		out.Logger.Println("Error:", err)
+		return
+	}
+	go api.Start()
+
+	out.Logger.Println("Simulating", config.Sensors, "sensors...")
+	err = simulator.Run(transport, config)
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
+}
+
 func main() {
 	// the user must provide at least one argument (the command)
 	as := os.Args[1:]
@@ -113,6 +225,11 @@ func main() {
 		return
 	}
 
+	if as[0] == "simulate" {
+		simulate(options, args)
+		return
+	}
+
 	if as[0] == "help" {
 		cli.Help(args)
 		return
@@ -137,7 +254,13 @@ func main() {
 	case "pair":
 		cli.Pair(args, conn)
 	case "forget":
-		cli.Forget(args, conn)
+		cli.Forget(options, args, conn)
+	case "requeue":
+		cli.Requeue(args, conn)
+	case "query":
+		cli.Query(options, args, conn)
+	case "export":
+		cli.Export(options, args, conn)
 	case "config":
 		cli.Config(options, args, conn)
 	case "stop":
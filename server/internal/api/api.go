@@ -54,12 +54,88 @@ func handleCommand(command string, conn *net.Conn) string {
 		}
 		return "OK:COLLECT:"
 	case "LIST-PENDING-UPLOADS":
-		res, err := pendingUploads()
+		res, err := pendingUploads(parts[1:])
 		if err != nil {
 			out.Logger.Println("Error:", err)
 			return "ERR:LIST-PENDING-UPLOADS:" + err.Error()
 		}
 		return "OK:LIST-PENDING-UPLOADS:" + res
+	case "GET-UPLOAD":
+		if len(parts) < 2 {
+			return "ERR:GET-UPLOAD:not enough arguments"
+		}
+		res, err := upload(parts[1])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:GET-UPLOAD:" + err.Error()
+		}
+		return "OK:GET-UPLOAD:" + res
+	case "LIST-REJECTED-UPLOADS":
+		res, err := rejectedUploads(parts[1:])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:LIST-REJECTED-UPLOADS:" + err.Error()
+		}
+		return "OK:LIST-REJECTED-UPLOADS:" + res
+	case "GET-REJECTED-UPLOAD":
+		if len(parts) < 2 {
+			return "ERR:GET-REJECTED-UPLOAD:not enough arguments"
+		}
+		res, err := rejectedUpload(parts[1])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:GET-REJECTED-UPLOAD:" + err.Error()
+		}
+		return "OK:GET-REJECTED-UPLOAD:" + res
+	case "REQUEUE-REJECTED-UPLOAD":
+		if len(parts) < 2 {
+			return "ERR:REQUEUE-REJECTED-UPLOAD:not enough arguments"
+		}
+		// <id> or all
+		count, err := server.RequeueRejectedUploads(parts[1])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:REQUEUE-REJECTED-UPLOAD:" + err.Error()
+		}
+		return "OK:REQUEUE-REJECTED-UPLOAD:" + strconv.Itoa(count)
+	case "DELETE-REJECTED-UPLOAD":
+		if len(parts) < 2 {
+			return "ERR:DELETE-REJECTED-UPLOAD:not enough arguments"
+		}
+		count, err := server.DeleteRejectedUploads(parts[1])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:DELETE-REJECTED-UPLOAD:" + err.Error()
+		}
+		return "OK:DELETE-REJECTED-UPLOAD:" + strconv.Itoa(count)
+	case "TRANSFER-STATS":
+		res, err := transferStats()
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:TRANSFER-STATS:" + err.Error()
+		}
+		return "OK:TRANSFER-STATS:" + res
+	case "QUERY":
+		res, err := queryMeasurements(parts[1:])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:QUERY:" + err.Error()
+		}
+		return "OK:QUERY:" + res
+	case "EXPORT":
+		res, err := export(parts[1:])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:EXPORT:" + err.Error()
+		}
+		return "OK:EXPORT:" + res
+	case "STORAGE-STATUS":
+		res, err := storageStatus()
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:STORAGE-STATUS:" + err.Error()
+		}
+		return "OK:STORAGE-STATUS:" + res
 	case "VIEW":
 		if len(parts) < 2 {
 			return "ERR:not enough arguments"
@@ -151,6 +227,107 @@ func handleCommand(command string, conn *net.Conn) string {
 			return "ERR:SET-GATEWAY-PASSWORD:" + err.Error()
 		}
 		return "OK:SET-GATEWAY-PASSWORD:"
+	case "SET-GATEWAY-PARTIAL-POLICY":
+		if len(parts) < 3 {
+			return "ERR:SET-GATEWAY-PARTIAL-POLICY:not enough arguments"
+		}
+		err := model.SetGatewayPartialPolicy(server.Gateway, parts[1], parts[2])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:SET-GATEWAY-PARTIAL-POLICY:" + err.Error()
+		}
+		return "OK:SET-GATEWAY-PARTIAL-POLICY:"
+	case "SET-GATEWAY-COMPRESSION":
+		if len(parts) < 2 {
+			return "ERR:SET-GATEWAY-COMPRESSION:not enough arguments"
+		}
+		err := model.SetGatewayCompression(server.Gateway, parts[1])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:SET-GATEWAY-COMPRESSION:" + err.Error()
+		}
+		return "OK:SET-GATEWAY-COMPRESSION:"
+	case "SET-GATEWAY-BATCH-SIZE":
+		if len(parts) < 2 {
+			return "ERR:SET-GATEWAY-BATCH-SIZE:not enough arguments"
+		}
+		err := model.SetGatewayBatchSize(server.Gateway, parts[1])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:SET-GATEWAY-BATCH-SIZE:" + err.Error()
+		}
+		return "OK:SET-GATEWAY-BATCH-SIZE:"
+	case "SET-GATEWAY-HTTP-CLIENT":
+		if len(parts) < 2 {
+			return "ERR:SET-GATEWAY-HTTP-CLIENT:not enough arguments"
+		}
+		// Paths may contain spaces, no value restores the default
+		err := model.SetGatewayHTTPClientSetting(server.Gateway, parts[1], strings.Join(parts[2:], " "))
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:SET-GATEWAY-HTTP-CLIENT:" + err.Error()
+		}
+		return "OK:SET-GATEWAY-HTTP-CLIENT:"
+	case "SET-GATEWAY-RETENTION":
+		if len(parts) < 4 {
+			return "ERR:SET-GATEWAY-RETENTION:not enough arguments"
+		}
+		err := model.SetGatewayRetention(server.Gateway, parts[1], parts[2], parts[3])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:SET-GATEWAY-RETENTION:" + err.Error()
+		}
+		// Takes effect now rather than on the next round of the janitor
+		go server.PruneStorage()
+		return "OK:SET-GATEWAY-RETENTION:"
+	case "SET-GATEWAY-DISK-RESERVE":
+		if len(parts) < 2 {
+			return "ERR:SET-GATEWAY-DISK-RESERVE:not enough arguments"
+		}
+		err := model.SetGatewayDiskReserve(server.Gateway, parts[1])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:SET-GATEWAY-DISK-RESERVE:" + err.Error()
+		}
+		return "OK:SET-GATEWAY-DISK-RESERVE:"
+	case "LIST-SINKS":
+		res, err := listSinks()
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:LIST-SINKS:" + err.Error()
+		}
+		return "OK:LIST-SINKS:" + res
+	case "ADD-SINK":
+		if len(parts) < 3 {
+			return "ERR:ADD-SINK:not enough arguments"
+		}
+		err := addSink(parts[1], parts[2])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:ADD-SINK:" + err.Error()
+		}
+		return "OK:ADD-SINK:"
+	case "REMOVE-SINK":
+		if len(parts) < 2 {
+			return "ERR:REMOVE-SINK:not enough arguments"
+		}
+		err := removeSink(parts[1])
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:REMOVE-SINK:" + err.Error()
+		}
+		return "OK:REMOVE-SINK:"
+	case "SET-SINK-OPTION":
+		if len(parts) < 3 {
+			return "ERR:SET-SINK-OPTION:not enough arguments"
+		}
+		// The value may contain spaces, no value removes the option
+		err := setSinkOption(parts[1], parts[2], strings.Join(parts[3:], " "))
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			return "ERR:SET-SINK-OPTION:" + err.Error()
+		}
+		return "OK:SET-SINK-OPTION:"
 	case "TEST-GATEWAY":
 		err := model.TestGateway(server.Gateway)
 		if err != nil {
@@ -3,6 +3,9 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jukuly/ss_machmos/server/internal/model"
 	"github.com/jukuly/ss_machmos/server/internal/server"
@@ -45,24 +48,267 @@ func deviceCollect(address string) error {
 	return nil
 }
 
-// List of all measurements pending upload
-func pendingUploads() (string, error) {
-	pending := server.PendingUploads()
+// Filters of LIST-PENDING-UPLOADS and LIST-REJECTED-UPLOADS, as <key>=<value>:
+// sensor=<mac-address>, type=<data-type>, sink=<name>, offset=<n> and limit=<n>
+func uploadFilter(filters []string) (server.PendingFilter, error) {
+	filter := server.PendingFilter{}
+	for _, f := range filters {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok {
+			return filter, errors.New("invalid filter " + f + " (must be <key>=<value>)")
+		}
+		var err error
+		switch key {
+		case "sensor":
+			filter.Sensor = value
+		case "type":
+			filter.DataType = value
+		case "sink":
+			filter.Sink = value
+		case "offset":
+			filter.Offset, err = strconv.Atoi(value)
+		case "limit":
+			filter.Limit, err = strconv.Atoi(value)
+		default:
+			return filter, errors.New("filter " + key + " doesn't exist")
+		}
+		if err != nil || filter.Offset < 0 || filter.Limit < 0 {
+			return filter, errors.New("invalid value for filter " + key + " (must be a positive integer)")
+		}
+	}
+	return filter, nil
+}
+
+func pendingUploads(filters []string) (string, error) {
+	filter, err := uploadFilter(filters)
+	if err != nil {
+		return "", err
+	}
+	pending, count := server.PendingUploads(filter)
 	// anonymous struct yay
 	res, err := json.Marshal(struct {
-		Count   int                      `json:"count"`
-		Pending []server.UnsentDataError `json:"pending"`
+		Count   int                    `json:"count"` // Matching the filters, not only this page
+		Offset  int                    `json:"offset"`
+		Pending []server.PendingUpload `json:"pending"`
 	}{
-		Count:   len(pending),
+		Count:   count,
+		Offset:  filter.Offset,
 		Pending: pending,
 	})
 	return string(res), err
 }
 
+func rejectedUploads(filters []string) (string, error) {
+	filter, err := uploadFilter(filters)
+	if err != nil {
+		return "", err
+	}
+	rejected, count := server.RejectedUploads(filter)
+	res, err := json.Marshal(struct {
+		Count    int                     `json:"count"`
+		Offset   int                     `json:"offset"`
+		Rejected []server.RejectedUpload `json:"rejected"`
+	}{
+		Count:    count,
+		Offset:   filter.Offset,
+		Rejected: rejected,
+	})
+	return string(res), err
+}
+
+// Where the measurements with this id are in the upload pipeline
+func upload(id string) (string, error) {
+	state, err := server.UploadById(id)
+	if err != nil {
+		return "", err
+	}
+	res, err := json.Marshal(state)
+	return string(res), err
+}
+
+// A rejected upload and the path of its copy
+func rejectedUpload(id string) (string, error) {
+	entry, path, err := server.RejectedUploadById(id)
+	if err != nil {
+		return "", err
+	}
+	res, err := json.Marshal(struct {
+		server.RejectedUpload
+		Path string `json:"path"`
+	}{
+		RejectedUpload: entry,
+		Path:           path,
+	})
+	return string(res), err
+}
+
+// Configuration and status of every sink
+func listSinks() (string, error) {
+	res, err := json.Marshal(server.SinkInfos())
+	return string(res), err
+}
+
+func addSink(name string, sinkType string) error {
+	if err := server.CheckSinkType(sinkType); err != nil {
+		return err
+	}
+	if err := model.AddGatewaySink(server.Gateway, name, sinkType); err != nil {
+		return err
+	}
+	return server.ReloadSinks()
+}
+
+func removeSink(name string) error {
+	if err := model.RemoveGatewaySink(server.Gateway, name); err != nil {
+		return err
+	}
+	return server.ReloadSinks()
+}
+
+// The option is saved even if the sink then fails to build, the error says why
+func setSinkOption(name string, option string, value string) error {
+	if err := model.SetGatewaySinkOption(server.Gateway, name, option, value); err != nil {
+		return err
+	}
+	if err := server.CheckSink(name); err != nil {
+		server.ReloadSinks()
+		return err
+	}
+	return server.ReloadSinks()
+}
+
+// Upload counters of every sensor, keyed by MAC address
+func transferStats() (string, error) {
+	res, err := json.Marshal(server.TransferStatistics())
+	return string(res), err
+}
+
+// An instant of QUERY: RFC 3339, a local date and time (2006-01-02 or
+// 2006-01-02T15:04:05), or a duration before now like 7d, 12h or 30m
+func parseQueryTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{time.DateOnly, "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err == nil && n >= 0 {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, errors.New("invalid time " + value + " (must be like 2006-01-02, 2006-01-02T15:04:05, RFC 3339 or 7d, 12h, 30m ago)")
+}
+
+// Stored measurements matching the filters, newest first
+func queryMeasurements(filters []string) (string, error) {
+	query := server.MeasurementQuery{}
+	for _, f := range filters {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok {
+			return "", errors.New("invalid filter " + f + " (must be <key>=<value>)")
+		}
+		var err error
+		switch key {
+		case "sensor":
+			query.Sensor = value
+		case "type":
+			query.DataType = value
+		case "from":
+			query.From, err = parseQueryTime(value)
+		case "to":
+			query.To, err = parseQueryTime(value)
+		case "limit":
+			query.Limit, err = strconv.Atoi(value)
+			if err != nil || query.Limit < 0 {
+				err = errors.New("invalid value for filter limit (must be a positive integer)")
+			}
+		case "samples":
+			query.Samples, err = strconv.ParseBool(value)
+			if err != nil {
+				err = errors.New("invalid value for filter samples (must be true or false)")
+			}
+		default:
+			return "", errors.New("filter " + key + " doesn't exist")
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	results, err := server.QueryMeasurements(query)
+	if err != nil {
+		return "", err
+	}
+	res, err := json.Marshal(results)
+	return string(res), err
+}
+
+// Write the captures matching the options to dir=, which comes last as it
+// may hold spaces
+func export(options []string) (string, error) {
+	request := server.ExportRequest{}
+	for i, o := range options {
+		key, value, ok := strings.Cut(o, "=")
+		if !ok {
+			return "", errors.New("invalid option " + o + " (must be <key>=<value>)")
+		}
+		var err error
+		switch key {
+		case "format":
+			request.Format = value
+		case "source":
+			request.Source = value
+		case "sensor":
+			request.Sensor = value
+		case "type":
+			request.DataType = value
+		case "from":
+			request.From, err = parseQueryTime(value)
+		case "to":
+			request.To, err = parseQueryTime(value)
+		case "dir":
+			request.Dir = strings.Join(append([]string{value}, options[i+1:]...), " ")
+		default:
+			return "", errors.New("option " + key + " doesn't exist")
+		}
+		if err != nil {
+			return "", err
+		}
+		if key == "dir" {
+			break
+		}
+	}
+	manifest, err := server.Export(request)
+	if err != nil {
+		return "", err
+	}
+	res, err := json.Marshal(manifest)
+	return string(res), err
+}
+
+// Usage and retention of every data directory
+func storageStatus() (string, error) {
+	res, err := json.Marshal(server.StorageUsage())
+	return string(res), err
+}
+
 func view(mac string) (string, error) {
 	for _, sensor := range model.Sensors {
 		if sensor.IsMacEqual(mac) {
-			jsonStr, err := json.Marshal(sensor)
+			// Same fields as LIST, plus the battery readings
+			jsonStr, err := json.Marshal(struct {
+				model.Sensor
+				BatteryHistory []model.BatteryReading `json:"battery_history"`
+			}{
+				Sensor:         sensor,
+				BatteryHistory: model.BatteryHistory(sensor.Mac),
+			})
 			return string(jsonStr), err
 		}
 	}
@@ -82,7 +328,7 @@ func forget(mac string) error {
 }
 
 func getGateway() (string, error) {
-	jsonStr, err := json.Marshal(*server.Gateway)
+	jsonStr, err := json.Marshal(model.GatewaySettings(server.Gateway))
 	return string(jsonStr), err
 }
 
@@ -13,7 +13,10 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jukuly/ss_machmos/server/internal/model"
 	"github.com/jukuly/ss_machmos/server/internal/out"
@@ -105,6 +108,17 @@ func Help(args []string) {
 			"|         | --no-console | None                            | Start the server without the       |\n" +
 			"|         |              |                                 | live stream of logs                |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n" +
+			"| simulate| --sensors    | <count>                         | Run the server against virtual     |\n" +
+			"|         | --model      | <model>[,<model>...]            |   sensors instead of bluetooth     |\n" +
+			"|         | --loss       | <probability>                   |   Type \"help simulate\"             |\n" +
+			"|         | --drop       | <probability>                   |   for more information             |\n" +
+			"|         | --duplicate  | <probability>                   |                                    |\n" +
+			"|         | --mtu        | <bytes>                         |                                    |\n" +
+			"|         | --interval   | <seconds>                       |                                    |\n" +
+			"|         | --cycles     | <count>                         |                                    |\n" +
+			"|         | --config     | <dir>                           |                                    |\n" +
+			"|         | --data       | <dir>                           |                                    |\n" +
+			"+---------+--------------+---------------------------------+------------------------------------+\n" +
 			"| logs    | None         | None                            | View the live stream of logs       |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n" +
 			"| stop    | None         | None                            | Stop the server                    |\n" +
@@ -113,20 +127,59 @@ func Help(args []string) {
 			"+---------+--------------+---------------------------------+------------------------------------+\n" +
 			"| view    | --sensor     | <mac-address>                   | View a specific sensors' settings  |\n" +
 			"|         | --gateway    | None                            | View the Gateway settings          |\n" +
+			"|         | --transfers  | None                            | View upload counters per sensor    |\n" +
+			"|         | --pending    | None                            | View uploads not accepted yet      |\n" +
+			"|         | --sinks      | None                            | View upload destinations           |\n" +
+			"|         | --rejected   | [<id>]                          | View uploads refused for good      |\n" +
+			"|         | --upload     | <measurement-id>                | View where a capture's upload is   |\n" +
+			"|         | --storage    | None                            | View disk usage and retention      |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n" +
 			"| pair    | None         | None                            | Enter pairing mode                 |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n" +
 			"| forget  | None         | <mac-address>                   | Forget a sensor                    |\n" +
+			"|         | --rejected   | <id> | all                      | Delete a rejected upload           |\n" +
+			"+---------+--------------+---------------------------------+------------------------------------+\n" +
+			"| requeue | None         | <id> | all                      | Upload a rejected upload again     |\n" +
+			"+---------+--------------+---------------------------------+------------------------------------+\n" +
+			"| query   | --sensor     | <mac-address>                   | View stored measurements, newest   |\n" +
+			"|         | --type       | <data-type>                     |   first. Type \"help query\"         |\n" +
+			"|         | --from       | <time>                          |   for more information             |\n" +
+			"|         | --to         | <time>                          |                                    |\n" +
+			"|         | --limit      | <count>                         |                                    |\n" +
+			"|         | --samples    | None                            |                                    |\n" +
+			"+---------+--------------+---------------------------------+------------------------------------+\n" +
+			"| export  | --format     | csv | wav | npy                 | Write captures to files for        |\n" +
+			"|         | --source     | measurements | debug            |   analysis tools. Type             |\n" +
+			"|         | --sensor     | <mac-address>                   |   \"help export\" for more           |\n" +
+			"|         | --type       | <data-type>                     |   information                      |\n" +
+			"|         | --from       | <time>                          |                                    |\n" +
+			"|         | --to         | <time>                          |                                    |\n" +
+			"|         | --out        | <dir>                           |                                    |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n" +
 			"| config  | --id         | <gateway-id>                    | Set the Gateway Id                 |\n" +
 			"|         | --password   | <gateway-password>              | Set the Gateway Password           |\n" +
 			"|         | --http       | <http-endpoint>                 | Set the HTTP Endpoint where the    |\n" +
 			"|         |              | default                         |   data will be sent                |\n" +
 			"|         |              |                                 |   default is openphm.org           |\n" +
+			"|         | --partial    | <data-type> <policy>            | What to do with uploads that time  |\n" +
+			"|         |              |                                 |   out: discard, archive or upload  |\n" +
+			"|         | --compress   | none | gzip | zstd             | Compress HTTP uploads              |\n" +
+			"|         | --batch      | <KiB>                           | Send several captures per HTTP     |\n" +
+			"|         |              |                                 |   upload, 0 for one each           |\n" +
+			"|         | --client     | <setting> [<value>]             | Set up the HTTP client of uploads  |\n" +
+			"|         |              |                                 |   Type \"help config\"               |\n" +
+			"|         |              |                                 |   for more information             |\n" +
 			"|         |              |                                 |                                    |\n" +
+			"|         | --retention  | <dir> <setting> <value>         | Limit archived and debug data      |\n" +
+			"|         |              |                                 |   Type \"help config\"               |\n" +
+			"|         |              |                                 |   for more information             |\n" +
+			"|         | --reserve    | <MiB>                           | Free disk kept for unsent data     |\n" +
 			"|         | --sensor     | <mac-address> <setting> <value> | Set a setting of a sensor          |\n" +
 			"|         |              |                                 |   Type \"help config\"               |\n" +
 			"|         |              |                                 |   for more information             |\n" +
+			"|         | --sink       | <name> <action>                 | Manage upload destinations         |\n" +
+			"|         |              |                                 |   Type \"help config\"               |\n" +
+			"|         |              |                                 |   for more information             |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n")
 		return
 	}
@@ -148,6 +201,26 @@ func Help(args []string) {
 			"|         |              |                                 | live stream of logs                |\n" +
 			"+---------+--------------+---------------------------------+------------------------------------+\n")
 
+	case "simulate":
+		fmt.Print("+---------+------------+---------------------------------+------------------------------------+\n" +
+			"| simulate| --sensors  | <count>                         | Number of virtual sensors (1)      |\n" +
+			"|         | --model    | <model>[,<model>...]            | Board models, assigned in turn     |\n" +
+			"|         |            |                                 |   (machmo,machmomini)              |\n" +
+			"|         | --loss     | <probability>                   | Chance of losing each chunk (0)    |\n" +
+			"|         | --drop     | <probability>                   | Chance of a transfer stopping      |\n" +
+			"|         |            |                                 |   midway (0)                       |\n" +
+			"|         | --duplicate| <probability>                   | Chance of writing a chunk twice (0)|\n" +
+			"|         | --mtu      | <bytes>                         | Bytes per BLE write (244)          |\n" +
+			"|         | --interval | <seconds>                       | Wake up interval to configure on   |\n" +
+			"|         |            |                                 |   every virtual sensor             |\n" +
+			"|         | --cycles   | <count>                         | Wake ups per sensor, 0 is forever  |\n" +
+			"|         | --config   | <dir>                           | Use the sensors, settings and      |\n" +
+			"|         |            |                                 |   sinks in <dir>, a scratch copy   |\n" +
+			"|         |            |                                 |   with a dryrun sink by default    |\n" +
+			"|         | --data     | <dir>                           | Keep captures in <dir>, a scratch  |\n" +
+			"|         |            |                                 |   directory by default             |\n" +
+			"+---------+------------+---------------------------------+------------------------------------+\n")
+
 	case "logs":
 		fmt.Print("+---------+------------+---------------------------------+------------------------------------+\n" +
 			"| logs    | None       | None                            | View the live stream of logs       |\n" +
@@ -167,6 +240,25 @@ func Help(args []string) {
 		fmt.Print("+---------+------------+---------------------------------+------------------------------------+\n" +
 			"| view    | --sensor   | <mac-address>                   | View a specific sensors' settings  |\n" +
 			"|         | --gateway  | None                            | View the Gateway settings          |\n" +
+			"|         | --transfers| None                            | View upload counters per sensor    |\n" +
+			"|         | --pending  | None                            | View uploads not accepted yet,     |\n" +
+			"|         |            |                                 |   oldest first                     |\n" +
+			"|         |   --sensor | <mac-address>                   | Only uploads of this sensor        |\n" +
+			"|         |   --type   | <data-type>                     | Only uploads of this data type     |\n" +
+			"|         |   --sink   | <name>                          | Only uploads this sink lacks       |\n" +
+			"|         |   --offset | <count>                         | Skip the first uploads             |\n" +
+			"|         |   --limit  | <count>                         | Show at most this many uploads     |\n" +
+			"|         | --sinks    | None                            | View upload destinations and how   |\n" +
+			"|         |            |                                 |   their deliveries went            |\n" +
+			"|         | --rejected | None                            | View uploads a sink refused for    |\n" +
+			"|         |            |                                 |   good (4xx), latest first. Takes  |\n" +
+			"|         |            |                                 |   the options of --pending, --sink |\n" +
+			"|         |            |                                 |   being the sink that refused them |\n" +
+			"|         |            | <id>                            | View one with the whole response   |\n" +
+			"|         | --upload   | <measurement-id>                | View whether a capture is still    |\n" +
+			"|         |            |                                 |   pending, archived or rejected    |\n" +
+			"|         | --storage  | None                            | View the disk usage of every data  |\n" +
+			"|         |            |                                 |   directory and what is pruned     |\n" +
 			"+---------+------------+---------------------------------+------------------------------------+\n")
 
 	case "pair":
@@ -177,6 +269,57 @@ func Help(args []string) {
 	case "forget":
 		fmt.Print("+---------+------------+---------------------------------+------------------------------------+\n" +
 			"| forget  | None       | <mac-address>                   | Forget a sensor                    |\n" +
+			"|         | --rejected | <id> | all                      | Delete a rejected upload and its   |\n" +
+			"|         |            |                                 |   copy, or every one               |\n" +
+			"+---------+------------+---------------------------------+------------------------------------+\n")
+
+	case "requeue":
+		fmt.Print("+---------+------------+---------------------------------+------------------------------------+\n" +
+			"| requeue | None       | <id> | all                      | Deliver a rejected upload to its   |\n" +
+			"|         |            |                                 |   sink again once the destination  |\n" +
+			"|         |            |                                 |   is fixed, or every one           |\n" +
+			"+---------+------------+---------------------------------+------------------------------------+\n")
+
+	case "query":
+		fmt.Print("+---------+------------+---------------------------------+------------------------------------+\n" +
+			"| query   | None       | None                            | View the measurements decoded      |\n" +
+			"|         |            |                                 |   lately, newest first, 100 unless |\n" +
+			"|         |            |                                 |   --limit says otherwise           |\n" +
+			"|         | --sensor   | <mac-address>                   | Only measurements of this sensor   |\n" +
+			"|         | --type     | <data-type>                     | Only this data type                |\n" +
+			"|         | --from     | <time>                          | Only captured at or after <time>   |\n" +
+			"|         | --to       | <time>                          | Only captured at or before <time>  |\n" +
+			"|         |            | <time> is 2006-01-02,           |                                    |\n" +
+			"|         |            | 2006-01-02T15:04:05, RFC 3339   |                                    |\n" +
+			"|         |            | or a duration ago: 7d, 12h, 30m |                                    |\n" +
+			"|         | --limit    | <count>                         | Show at most this many             |\n" +
+			"|         | --samples  | None                            | Also print raw_data, read from     |\n" +
+			"|         |            |                                 |   the file if it wasn't pruned     |\n" +
+			"+---------+------------+---------------------------------+------------------------------------+\n")
+
+	case "export":
+		fmt.Print("+---------+------------+---------------------------------+------------------------------------+\n" +
+			"| export  | None       | None                            | Write the captures stored on the   |\n" +
+			"|         |            |                                 |   gateway to <dir>, with a         |\n" +
+			"|         |            |                                 |   manifest.json describing sensors |\n" +
+			"|         |            |                                 |   and calibration of each one      |\n" +
+			"|         | --format   | csv                             | A time column and one per axis     |\n" +
+			"|         |            | wav                             | 24 bit audio at its sample rate    |\n" +
+			"|         |            | npy                             | NumPy float64 array, one column    |\n" +
+			"|         |            |                                 |   per axis                         |\n" +
+			"|         |            |                                 | Single readings, like temperature, |\n" +
+			"|         |            |                                 |   go in one file per sensor        |\n" +
+			"|         | --source   | measurements                    | Pending and archived captures      |\n" +
+			"|         |            |                                 |   (default)                        |\n" +
+			"|         |            | debug                           | Decode the raw debug captures      |\n" +
+			"|         |            |                                 |   again                            |\n" +
+			"|         | --sensor   | <mac-address>                   | Only captures of this sensor       |\n" +
+			"|         | --type     | <data-type>                     | Only this data type                |\n" +
+			"|         | --from     | <time>                          | Only captured at or after <time>   |\n" +
+			"|         | --to       | <time>                          | Only captured at or before <time>  |\n" +
+			"|         |            | <time> is as for \"help query\"   |                                    |\n" +
+			"|         | --out      | <dir>                           | Where to write, export_<time> in   |\n" +
+			"|         |            |                                 |   the current directory by default |\n" +
 			"+---------+------------+---------------------------------+------------------------------------+\n")
 
 	case "config":
@@ -185,6 +328,37 @@ func Help(args []string) {
 			"|         | --password | <gateway-password>              | Set the Gateway Password           |\n" +
 			"|         | --http     | <http-endpoint>                 | Set the HTTP Endpoint where the    |\n" +
 			"|         |            |                                 | 	data will be sent                |\n" +
+			"|         | --partial  | <data-type> <policy>            | What to do with uploads that time  |\n" +
+			"|         |            |                                 |   out: discard (default), archive  |\n" +
+			"|         |            |                                 |   or upload flagged as partial     |\n" +
+			"|         |            |                                 |                                    |\n" +
+			"|         | --compress | none | gzip | zstd             | Compress HTTP uploads (none by     |\n" +
+			"|         |            |                                 |   default), testing the Gateway    |\n" +
+			"|         |            |                                 |   checks the endpoint accepts it   |\n" +
+			"|         | --batch    | <KiB>                           | Send the captures waiting in the   |\n" +
+			"|         |            |                                 |   queue together, up to <KiB> of   |\n" +
+			"|         |            |                                 |   measurements per HTTP upload,    |\n" +
+			"|         |            |                                 |   0 for one each (default)         |\n" +
+			"|         |            |                                 |                                    |\n" +
+			"|         | --client   | <setting> [<value>]             | Set up the HTTP client of every    |\n" +
+			"|         |            |                                 |   upload, no value restores the    |\n" +
+			"|         |            |                                 |   default                          |\n" +
+			"|         |            | <setting> can be \"timeout\" and  |                                    |\n" +
+			"|         |            | \"connect_timeout\" (seconds,     |   120 and 10 by default            |\n" +
+			"|         |            | 0 for the default), \"proxy\"     |   HTTP(S)_PROXY by default         |\n" +
+			"|         |            | (URL or none), \"ca\", \"cert\"     |   Trusted on top of the system CAs |\n" +
+			"|         |            | and \"key\" (PEM files) or        |                                    |\n" +
+			"|         |            | \"tls_min_version\" (1.0 to 1.3)  |                                    |\n" +
+			"|         |            |                                 |                                    |\n" +
+			"|         | --retention| <dir> <setting> <value>         | Prune old files of a directory,    |\n" +
+			"|         |            |                                 |   oldest first, 0 for no limit     |\n" +
+			"|         |            | <dir> can be \"debug\", \"sent\" or |   7 days, 512 MiB and 256 MiB free |\n" +
+			"|         |            | \"rejected\", <setting> \"max_age\" |   for debug, 256 MiB free for sent |\n" +
+			"|         |            | (days), \"max_size\" (MiB) or     |   and 128 MiB free for rejected by |\n" +
+			"|         |            | \"min_free\" (MiB of free disk)   |   default. unsent is never pruned  |\n" +
+			"|         | --reserve  | <MiB>                           | Below this much free disk, only    |\n" +
+			"|         |            |                                 |   unsent data is written, 64 MiB   |\n" +
+			"|         |            |                                 |   by default                       |\n" +
 			"|         |            |                                 |                                    |\n" +
 			"|         | --sensor   | <mac-address> <setting> <value> | Set a setting of a sensor          |\n" +
 			"|         |            | <setting> can be \"name\",        |                                    |\n" +
@@ -192,6 +366,51 @@ func Help(args []string) {
 			"|         |            | the measurement type and the    |                                    |\n" +
 			"|         |            | setting separated by an \"_\"     |                                    |\n" +
 			"|         |            | eg.: \"audio_wake_up_interval\"|                                    |\n" +
+			"|         |            | \"vibration_range\" is 2, 4, 8 or|                                    |\n" +
+			"|         |            | 16 g if the board supports it   |                                    |\n" +
+			"|         |            | \"max_transmission_size\" caps    |                                    |\n" +
+			"|         |            | uploads in bytes, 0 for the     |                                    |\n" +
+			"|         |            | collection capacity             |                                    |\n" +
+			"|         |            | \"calibration_<x|y|z>_gain\",     |                                    |\n" +
+			"|         |            | \"calibration_<x|y|z>_offset\" (g)|                                    |\n" +
+			"|         |            | \"calibration_rtd_type\" (pt100,  |                                    |\n" +
+			"|         |            | pt500, pt1000),                 |                                    |\n" +
+			"|         |            | \"calibration_rtd_reference\"     |                                    |\n" +
+			"|         |            | (ohms) and                      |                                    |\n" +
+			"|         |            | \"calibration_mic_sensitivity\"   |                                    |\n" +
+			"|         |            | (dBFS at 94 dB SPL) are applied |                                    |\n" +
+			"|         |            | when decoding                   |                                    |\n" +
+			"|         |            |                                 |                                    |\n" +
+			"|         | --sink     | <name> add <type>               | Add a disabled upload destination, |\n" +
+			"|         |            |                                 |   <type> is \"openphm\", \"mqtt\",     |\n" +
+			"|         |            |                                 |   \"influx\", \"s3\" or \"dryrun\"       |\n" +
+			"|         |            | <name> remove                   | Remove an upload destination       |\n" +
+			"|         |            | <name> enabled true | false     | Start or stop uploading to it      |\n" +
+			"|         |            | <name> <option> [<value>]       | Set an option of the destination,  |\n" +
+			"|         |            |                                 |   no value removes it              |\n" +
+			"|         |            | openphm options are \"url\",      |   Measurements are archived once   |\n" +
+			"|         |            | \"id\" and \"password\", they       |   every enabled destination has    |\n" +
+			"|         |            | default to the Gateway settings |   them                             |\n" +
+			"|         |            | mqtt options are \"broker\"       |                                    |\n" +
+			"|         |            | (required, tcp:// or ssl://),   |                                    |\n" +
+			"|         |            | \"topic\" and \"status_topic\"      |                                    |\n" +
+			"|         |            | (with {gateway}, {sensor} and   |                                    |\n" +
+			"|         |            | {type}), \"qos\",                 |                                    |\n" +
+			"|         |            | \"retain_status\", \"client_id\",   |                                    |\n" +
+			"|         |            | \"username\", \"password\",         |                                    |\n" +
+			"|         |            | \"tls_ca\", \"tls_cert\",           |                                    |\n" +
+			"|         |            | \"tls_key\" and \"tls_insecure\"    |                                    |\n" +
+			"|         |            | influx options are \"url\",       |                                    |\n" +
+			"|         |            | \"org\", \"bucket\" and \"token\"     |                                    |\n" +
+			"|         |            | (InfluxDB v2) or \"file\", and    |                                    |\n" +
+			"|         |            | \"waveforms\" (false by default)  |                                    |\n" +
+			"|         |            | s3 options are \"endpoint\",      |                                    |\n" +
+			"|         |            | \"bucket\" (both required),       |                                    |\n" +
+			"|         |            | \"region\", \"access_key\",         |                                    |\n" +
+			"|         |            | \"secret_key\", \"prefix\",         |                                    |\n" +
+			"|         |            | \"types\" (vibration,audio by     |                                    |\n" +
+			"|         |            | default), \"part_size\" (MiB)     |                                    |\n" +
+			"|         |            | and \"path_style\"                |                                    |\n" +
 			"+---------+------------+---------------------------------+------------------------------------+\n")
 
 	default:
@@ -235,7 +454,13 @@ func List(conn net.Conn) {
 func View(options []string, args []string, conn net.Conn) {
 	if len(options) == 0 {
 		fmt.Print("\nUsage: view --sensor <mac-address>\n" +
-			"              --gateway\n")
+			"              --gateway\n" +
+			"              --transfers\n" +
+			"              --pending [--sensor <mac-address>] [--type <data-type>] [--sink <name>] [--offset <count>] [--limit <count>]\n" +
+			"              --sinks\n" +
+			"              --rejected [<id>] [--sensor <mac-address>] [--type <data-type>] [--sink <name>] [--offset <count>] [--limit <count>]\n" +
+			"              --upload <measurement-id>\n" +
+			"              --storage\n")
 		return
 	}
 	switch options[0] {
@@ -257,6 +482,89 @@ func View(options []string, args []string, conn net.Conn) {
 			return
 		}
 		waitFor("OK:GET-GATEWAY", "ERR:GET-GATEWAY")
+	case "--transfers":
+		err := sendCommand("TRANSFER-STATS", conn)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor("OK:TRANSFER-STATS", "ERR:TRANSFER-STATS")
+	case "--storage":
+		err := sendCommand("STORAGE-STATUS", conn)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor("OK:STORAGE-STATUS", "ERR:STORAGE-STATUS")
+	case "--pending":
+		command := "LIST-PENDING-UPLOADS"
+		for i, option := range options[1:] {
+			if i >= len(args) {
+				fmt.Printf("Missing value for option %s\n", option)
+				return
+			}
+			switch option {
+			case "--sensor", "--type", "--sink", "--offset", "--limit":
+				command += " " + option[2:] + "=" + args[i]
+			default:
+				fmt.Printf("Option %s does not exist for view --pending\n", option)
+				return
+			}
+		}
+		err := sendCommand(command, conn)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor("OK:LIST-PENDING-UPLOADS", "ERR:LIST-PENDING-UPLOADS")
+	case "--sinks":
+		err := sendCommand("LIST-SINKS", conn)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor("OK:LIST-SINKS", "ERR:LIST-SINKS")
+	case "--upload":
+		if len(args) == 0 {
+			fmt.Println("Usage: view --upload <measurement-id>")
+			return
+		}
+		err := sendCommand("GET-UPLOAD "+args[0], conn)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor("OK:GET-UPLOAD", "ERR:GET-UPLOAD")
+	case "--rejected":
+		if len(options) == 1 && len(args) == 1 {
+			err := sendCommand("GET-REJECTED-UPLOAD "+args[0], conn)
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			waitFor("OK:GET-REJECTED-UPLOAD", "ERR:GET-REJECTED-UPLOAD")
+			return
+		}
+		command := "LIST-REJECTED-UPLOADS"
+		for i, option := range options[1:] {
+			if i >= len(args) {
+				fmt.Printf("Missing value for option %s\n", option)
+				return
+			}
+			switch option {
+			case "--sensor", "--type", "--sink", "--offset", "--limit":
+				command += " " + option[2:] + "=" + args[i]
+			default:
+				fmt.Printf("Option %s does not exist for view --rejected\n", option)
+				return
+			}
+		}
+		err := sendCommand(command, conn)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor("OK:LIST-REJECTED-UPLOADS", "ERR:LIST-REJECTED-UPLOADS")
 	default:
 		fmt.Printf("Option %s does not exist for command view\n", options[0])
 	}
@@ -310,9 +618,23 @@ func Pair(args []string, conn net.Conn) {
 	}
 }
 
-func Forget(args []string, conn net.Conn) {
+func Forget(options []string, args []string, conn net.Conn) {
 	if len(args) == 0 {
-		fmt.Println("Usage: forget <mac-address>")
+		fmt.Println("Usage: forget <mac-address>\n" +
+			"       forget --rejected <id> | all")
+		return
+	}
+	if len(options) > 0 {
+		if options[0] != "--rejected" {
+			fmt.Printf("Option %s does not exist for command forget\n", options[0])
+			return
+		}
+		err := sendCommand("DELETE-REJECTED-UPLOAD "+args[0], conn)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor("OK:DELETE-REJECTED-UPLOAD", "ERR:DELETE-REJECTED-UPLOAD")
 		return
 	}
 	err := sendCommand("FORGET "+args[0], conn)
@@ -323,12 +645,103 @@ func Forget(args []string, conn net.Conn) {
 	waitFor("OK:FORGET", "ERR:FORGET")
 }
 
+func Query(options []string, args []string, conn net.Conn) {
+	command := "QUERY"
+	i := 0
+	for _, option := range options {
+		switch option {
+		case "--samples":
+			command += " samples=true"
+			continue
+		case "--sensor", "--type", "--from", "--to", "--limit":
+		default:
+			fmt.Printf("Option %s does not exist for command query\n", option)
+			return
+		}
+		if i >= len(args) {
+			fmt.Printf("Missing value for option %s\n", option)
+			return
+		}
+		command += " " + option[2:] + "=" + args[i]
+		i++
+	}
+	err := sendCommand(command, conn)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	waitFor("OK:QUERY", "ERR:QUERY")
+}
+
+// Write captures to files on this machine, the server writes them so --out is
+// made absolute here
+func Export(options []string, args []string, conn net.Conn) {
+	command := "EXPORT"
+	dir := "export_" + time.Now().Format("20060102-150405")
+	i := 0
+	for _, option := range options {
+		switch option {
+		case "--format", "--source", "--sensor", "--type", "--from", "--to", "--out":
+		default:
+			fmt.Printf("Option %s does not exist for command export\n", option)
+			return
+		}
+		if i >= len(args) {
+			fmt.Printf("Missing value for option %s\n", option)
+			return
+		}
+		if option == "--out" {
+			dir = args[i]
+		} else {
+			command += " " + option[2:] + "=" + args[i]
+		}
+		i++
+	}
+	if !strings.Contains(command, " format=") {
+		fmt.Println("Usage: export --format csv | wav | npy [--source measurements | debug] [--sensor <mac-address>] [--type <data-type>] [--from <time>] [--to <time>] [--out <dir>]")
+		return
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	// Last, it may hold spaces
+	command += " dir=" + dir
+	err = sendCommand(command, conn)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	waitFor("OK:EXPORT", "ERR:EXPORT")
+}
+
+func Requeue(args []string, conn net.Conn) {
+	if len(args) == 0 {
+		fmt.Println("Usage: requeue <id> | all")
+		return
+	}
+	err := sendCommand("REQUEUE-REJECTED-UPLOAD "+args[0], conn)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	waitFor("OK:REQUEUE-REJECTED-UPLOAD", "ERR:REQUEUE-REJECTED-UPLOAD")
+}
+
 func Config(options []string, args []string, conn net.Conn) {
 	if len(options) == 0 {
 		fmt.Print("\nUsage: config --id <gateway-id>\n" +
 			"              --password <gateway-password>\n" +
 			"              --http <http-endpoint> | default\n" +
-			"              --sensor <mac-address> <setting> <value>\n")
+			"              --partial <data-type> discard | archive | upload\n" +
+			"              --compress none | gzip | zstd\n" +
+			"              --batch <KiB>\n" +
+			"              --client <setting> [<value>]\n" +
+			"              --retention <dir> <setting> <value>\n" +
+			"              --reserve <MiB>\n" +
+			"              --sensor <mac-address> <setting> <value>\n" +
+			"              --sink <name> add <type> | remove | enabled true | enabled false | <option> [<value>]\n")
 		return
 	}
 	switch options[0] {
@@ -365,6 +778,72 @@ func Config(options []string, args []string, conn net.Conn) {
 			return
 		}
 		waitFor("OK:SET-GATEWAY-HTTP-ENDPOINT", "ERR:SET-GATEWAY-HTTP-ENDPOINT")
+	case "--partial":
+		if len(args) < 2 {
+			fmt.Println("Usage: config --partial <data-type> discard | archive | upload")
+			return
+		}
+		err := sendCommand("SET-GATEWAY-PARTIAL-POLICY "+args[0]+" "+args[1], conn)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor("OK:SET-GATEWAY-PARTIAL-POLICY", "ERR:SET-GATEWAY-PARTIAL-POLICY")
+	case "--compress":
+		if len(args) == 0 {
+			fmt.Println("Usage: config --compress none | gzip | zstd")
+			return
+		}
+		err := sendCommand("SET-GATEWAY-COMPRESSION "+args[0], conn)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor("OK:SET-GATEWAY-COMPRESSION", "ERR:SET-GATEWAY-COMPRESSION")
+	case "--batch":
+		if len(args) == 0 {
+			fmt.Println("Usage: config --batch <KiB>")
+			return
+		}
+		err := sendCommand("SET-GATEWAY-BATCH-SIZE "+args[0], conn)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor("OK:SET-GATEWAY-BATCH-SIZE", "ERR:SET-GATEWAY-BATCH-SIZE")
+	case "--client":
+		if len(args) == 0 {
+			fmt.Println("Usage: config --client <setting> [<value>]")
+			return
+		}
+		err := sendCommand("SET-GATEWAY-HTTP-CLIENT "+strings.Join(args, " "), conn)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor("OK:SET-GATEWAY-HTTP-CLIENT", "ERR:SET-GATEWAY-HTTP-CLIENT")
+	case "--retention":
+		if len(args) < 3 {
+			fmt.Println("Usage: config --retention <dir> <setting> <value>")
+			return
+		}
+		err := sendCommand("SET-GATEWAY-RETENTION "+args[0]+" "+args[1]+" "+args[2], conn)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor("OK:SET-GATEWAY-RETENTION", "ERR:SET-GATEWAY-RETENTION")
+	case "--reserve":
+		if len(args) == 0 {
+			fmt.Println("Usage: config --reserve <MiB>")
+			return
+		}
+		err := sendCommand("SET-GATEWAY-DISK-RESERVE "+args[0], conn)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor("OK:SET-GATEWAY-DISK-RESERVE", "ERR:SET-GATEWAY-DISK-RESERVE")
 	case "--sensor":
 		if len(args) < 3 {
 			fmt.Println("Usage: config --sensor <mac-address> <setting> <value>")
@@ -376,6 +855,30 @@ func Config(options []string, args []string, conn net.Conn) {
 			return
 		}
 		waitFor("OK:SET-SENSOR-SETTINGS", "ERR:SET-SENSOR-SETTINGS")
+	case "--sink":
+		if len(args) < 2 {
+			fmt.Println("Usage: config --sink <name> add <type> | remove | enabled true | enabled false | <option> [<value>]")
+			return
+		}
+		var command, verb string
+		switch args[1] {
+		case "add":
+			if len(args) < 3 {
+				fmt.Println("Usage: config --sink <name> add <type>")
+				return
+			}
+			command, verb = "ADD-SINK "+args[0]+" "+args[2], "ADD-SINK"
+		case "remove":
+			command, verb = "REMOVE-SINK "+args[0], "REMOVE-SINK"
+		default:
+			command, verb = "SET-SINK-OPTION "+strings.Join(args, " "), "SET-SINK-OPTION"
+		}
+		err := sendCommand(command, conn)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		waitFor("OK:"+verb, "ERR:"+verb)
 	default:
 		fmt.Printf("Option %s does not exist for command config\n", options[0])
 	}
@@ -440,7 +943,89 @@ func parseResponse(res string) string {
 			if err != nil {
 				return "Error: " + err.Error()
 			}
-			return "Gateway ID: " + gateway.Id + "\nHTTP Endpoint: " + gateway.HTTPEndpoint
+			str := "Gateway ID: " + gateway.Id + "\nHTTP Endpoint: " + gateway.HTTPEndpoint
+			for dataType, policy := range gateway.PartialPolicies {
+				str += "\nPartial " + dataType + " uploads: " + string(policy)
+			}
+			compression := gateway.Compression
+			if compression == "" {
+				compression = "none"
+			}
+			str += "\nCompression: " + compression
+			if gateway.BatchSize > 0 {
+				str += "\nBatch size: " + strconv.Itoa(gateway.BatchSize) + " KiB"
+			} else {
+				str += "\nBatch size: one capture per upload"
+			}
+			client := gateway.HTTPClientConfig
+			timeout, connectTimeout := client.Timeout, client.ConnectTimeout
+			if timeout == 0 {
+				timeout = model.DEFAULT_HTTP_TIMEOUT
+			}
+			if connectTimeout == 0 {
+				connectTimeout = model.DEFAULT_HTTP_CONNECT_TIMEOUT
+			}
+			str += "\nHTTP timeout: " + strconv.Itoa(timeout) + "s, " + strconv.Itoa(connectTimeout) + "s to connect"
+			settings := [][2]string{{"proxy", client.Proxy}, {"CA", client.CA}, {"client certificate", client.Cert},
+				{"client key", client.Key}, {"TLS minimum version", client.TLSMinVersion}}
+			for _, setting := range settings {
+				if setting[1] != "" {
+					str += "\nHTTP " + setting[0] + ": " + setting[1]
+				}
+			}
+			return str
+		case "LIST-PENDING-UPLOADS":
+			str, err := pendingUploadsJSONToString([]byte(parts[2]))
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			return str
+		case "LIST-SINKS":
+			str, err := sinksJSONToString([]byte(parts[2]))
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			return str
+		case "STORAGE-STATUS":
+			str, err := storageJSONToString([]byte(parts[2]))
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			return str
+		case "GET-UPLOAD":
+			str, err := uploadJSONToString([]byte(parts[2]))
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			return str
+		case "LIST-REJECTED-UPLOADS":
+			str, err := rejectedUploadsJSONToString([]byte(parts[2]))
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			return str
+		case "GET-REJECTED-UPLOAD":
+			str, err := rejectedUploadJSONToString([]byte(parts[2]))
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			return str
+		case "QUERY":
+			str, err := queryJSONToString([]byte(parts[2]))
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			return str
+		case "EXPORT":
+			str, err := exportJSONToString([]byte(parts[2]))
+			if err != nil {
+				return "Error: " + err.Error()
+			}
+			return str
+		case "REQUEUE-REJECTED-UPLOAD":
+			return parts[2] + " rejected upload(s) queued again"
+		case "DELETE-REJECTED-UPLOAD":
+			return parts[2] + " rejected upload(s) deleted"
 		default:
 			return res // return entire thing if incomprehensible
 		}
@@ -2,16 +2,413 @@ package cli
 
 import (
 	"encoding/json"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/jukuly/ss_machmos/server/internal/model"
 )
 
 func sensorJSONToString(jsonStr []byte) (string, error) {
-	s := model.Sensor{}
+	s := struct {
+		model.Sensor
+		BatteryHistory []model.BatteryReading `json:"battery_history"`
+	}{}
 	err := json.Unmarshal(jsonStr, &s)
 	if err != nil {
 		return "", err
 	}
 
-	return s.ToString(), nil
+	str := s.ToString()
+	if len(s.BatteryHistory) > 0 {
+		last := s.BatteryHistory[len(s.BatteryHistory)-1]
+		str += "Last Battery Report: " + strconv.Itoa(last.Voltage) + " mV at " + last.Time.Local().Format(time.RFC3339) +
+			" (" + strconv.Itoa(len(s.BatteryHistory)) + " reports kept)\n"
+	}
+	return str, nil
+}
+
+type pendingUploadJSON struct {
+	Id          string    `json:"id"`
+	File        string    `json:"file"`
+	Sensor      string    `json:"sensor"`
+	DataType    string    `json:"data_type"`
+	CaptureTime time.Time `json:"capture_time"`
+	Size        int64     `json:"size"`
+	Sinks       map[string]struct {
+		Delivered bool      `json:"delivered"`
+		Rejected  bool      `json:"rejected"`
+		Attempts  int       `json:"attempts"`
+		LastError string    `json:"last_error"`
+		AuthError bool      `json:"auth_error"`
+		NextRetry time.Time `json:"next_retry"`
+	} `json:"sinks"`
+}
+
+func (upload pendingUploadJSON) sinksString() string {
+	if len(upload.Sinks) == 0 {
+		return "\tNot attempted yet\n"
+	}
+	str := ""
+	for name, sink := range upload.Sinks {
+		if sink.Delivered {
+			str += "\t" + name + ": Delivered\n"
+			continue
+		}
+		if sink.Rejected {
+			str += "\t" + name + ": Rejected, see view --rejected\n"
+			continue
+		}
+		if sink.AuthError {
+			str += "\t" + name + ": Credentials refused, retrying until they are fixed\n"
+		}
+		str += "\t" + name + ": Attempts: " + strconv.Itoa(sink.Attempts) + ", next retry " + sink.NextRetry.Local().Format(time.DateTime) + "\n" +
+			"\t\tLast Error: " + sink.LastError + "\n"
+	}
+	return str
+}
+
+func pendingUploadsJSONToString(jsonStr []byte) (string, error) {
+	p := struct {
+		Count   int                 `json:"count"`
+		Offset  int                 `json:"offset"`
+		Pending []pendingUploadJSON `json:"pending"`
+	}{}
+	err := json.Unmarshal(jsonStr, &p)
+	if err != nil {
+		return "", err
+	}
+	if p.Count == 0 {
+		return "No pending uploads", nil
+	}
+	if len(p.Pending) == 0 {
+		return "Only " + strconv.Itoa(p.Count) + " pending uploads", nil
+	}
+
+	str := "Pending uploads " + strconv.Itoa(p.Offset+1) + " to " + strconv.Itoa(p.Offset+len(p.Pending)) +
+		" of " + strconv.Itoa(p.Count) + "\n"
+	for _, upload := range p.Pending {
+		id := upload.Id
+		if id == "" {
+			id = upload.File
+		}
+		str += "\n" + id + " " + upload.Sensor + " " + upload.DataType + " captured " + upload.CaptureTime.Local().Format(time.DateTime) +
+			" (" + strconv.FormatInt(upload.Size, 10) + " bytes)\n" + upload.sinksString()
+	}
+	return str, nil
+}
+
+func uploadJSONToString(jsonStr []byte) (string, error) {
+	u := struct {
+		Id       string               `json:"id"`
+		State    string               `json:"state"`
+		Path     string               `json:"path"`
+		Pending  *pendingUploadJSON   `json:"pending"`
+		Rejected []rejectedUploadJSON `json:"rejected"`
+	}{}
+	err := json.Unmarshal(jsonStr, &u)
+	if err != nil {
+		return "", err
+	}
+	str := "Measurement " + u.Id + ": " + u.State + "\n" +
+		"File: " + u.Path + "\n"
+	if u.Pending != nil {
+		str += u.Pending.Sensor + " " + u.Pending.DataType + " captured " + u.Pending.CaptureTime.Local().Format(time.DateTime) +
+			" (" + strconv.FormatInt(u.Pending.Size, 10) + " bytes)\n" + u.Pending.sinksString()
+	}
+	for _, rejected := range u.Rejected {
+		str += "Rejected " + rejected.summary()
+	}
+	return str, nil
+}
+
+func sinksJSONToString(jsonStr []byte) (string, error) {
+	sinks := []struct {
+		model.SinkConfig
+		Status struct {
+			Active      bool      `json:"active"`
+			Delivered   int       `json:"delivered"`
+			Failed      int       `json:"failed"`
+			Rejected    int       `json:"rejected"`
+			LastSuccess time.Time `json:"last_success"`
+			LastError   string    `json:"last_error"`
+		} `json:"status"`
+	}{}
+	err := json.Unmarshal(jsonStr, &sinks)
+	if err != nil {
+		return "", err
+	}
+	if len(sinks) == 0 {
+		return "No sinks, measurements are archived without being uploaded", nil
+	}
+
+	str := ""
+	for _, sink := range sinks {
+		state := "Disabled"
+		if sink.Enabled && sink.Status.Active {
+			state = "Enabled"
+		} else if sink.Enabled {
+			state = "Enabled, not running"
+		}
+		str += sink.Name + " (" + sink.Type + "): " + state + "\n"
+		options := []string{}
+		for option := range sink.Options {
+			options = append(options, option)
+		}
+		slices.Sort(options)
+		for _, option := range options {
+			value := sink.Options[option]
+			if slices.Contains([]string{"password", "token", "secret_key"}, option) {
+				value = "********"
+			}
+			str += "\t" + option + ": " + value + "\n"
+		}
+		str += "\tDelivered: " + strconv.Itoa(sink.Status.Delivered) + ", Failed: " + strconv.Itoa(sink.Status.Failed) +
+			", Rejected: " + strconv.Itoa(sink.Status.Rejected) + "\n"
+		if !sink.Status.LastSuccess.IsZero() {
+			str += "\tLast Success: " + sink.Status.LastSuccess.Local().Format(time.DateTime) + "\n"
+		}
+		if sink.Status.LastError != "" {
+			str += "\tLast Error: " + sink.Status.LastError + "\n"
+		}
+	}
+	return str, nil
+}
+
+type rejectedUploadJSON struct {
+	Id          string    `json:"id"`
+	File        string    `json:"file"`
+	Sink        string    `json:"sink"`
+	Sensor      string    `json:"sensor"`
+	DataType    string    `json:"data_type"`
+	CaptureTime time.Time `json:"capture_time"`
+	Size        int64     `json:"size"`
+	Attempts    int       `json:"attempts"`
+	RejectedAt  time.Time `json:"rejected_at"`
+	StatusCode  int       `json:"status_code"`
+	Response    string    `json:"response"`
+}
+
+func (r rejectedUploadJSON) summary() string {
+	status := "error"
+	if r.StatusCode != 0 {
+		status = "HTTP " + strconv.Itoa(r.StatusCode)
+	}
+	return r.Id + " " + r.Sensor + " " + r.DataType + " captured " + r.CaptureTime.Local().Format(time.DateTime) +
+		" (" + strconv.FormatInt(r.Size, 10) + " bytes)\n" +
+		"\t" + r.Sink + ": " + status + " on " + r.RejectedAt.Local().Format(time.DateTime) +
+		" after " + strconv.Itoa(r.Attempts) + " attempts\n"
+}
+
+func rejectedUploadsJSONToString(jsonStr []byte) (string, error) {
+	r := struct {
+		Count    int                  `json:"count"`
+		Offset   int                  `json:"offset"`
+		Rejected []rejectedUploadJSON `json:"rejected"`
+	}{}
+	err := json.Unmarshal(jsonStr, &r)
+	if err != nil {
+		return "", err
+	}
+	if r.Count == 0 {
+		return "No rejected uploads", nil
+	}
+	if len(r.Rejected) == 0 {
+		return "Only " + strconv.Itoa(r.Count) + " rejected uploads", nil
+	}
+
+	str := "Rejected uploads " + strconv.Itoa(r.Offset+1) + " to " + strconv.Itoa(r.Offset+len(r.Rejected)) +
+		" of " + strconv.Itoa(r.Count) + "\n"
+	for _, upload := range r.Rejected {
+		response := upload.Response
+		if len(response) > 80 {
+			response = response[:80] + "..."
+		}
+		str += "\n" + upload.summary() + "\t\tResponse: " + response + "\n"
+	}
+	return str, nil
+}
+
+func rejectedUploadJSONToString(jsonStr []byte) (string, error) {
+	r := struct {
+		rejectedUploadJSON
+		Path string `json:"path"`
+	}{}
+	err := json.Unmarshal(jsonStr, &r)
+	if err != nil {
+		return "", err
+	}
+	return r.summary() + "\tFile: " + r.Path + "\n" +
+		"\tResponse:\n" + r.Response + "\n", nil
+}
+
+func mibString(bytes int64) string {
+	return strconv.FormatFloat(float64(bytes)/(1<<20), 'f', 1, 64) + " MiB"
+}
+
+func storageJSONToString(jsonStr []byte) (string, error) {
+	s := struct {
+		Dirs []struct {
+			Name        string                 `json:"name"`
+			Path        string                 `json:"path"`
+			Files       int                    `json:"files"`
+			Bytes       int64                  `json:"bytes"`
+			Oldest      time.Time              `json:"oldest"`
+			FreeBytes   int64                  `json:"free_bytes"`
+			Policy      *model.RetentionPolicy `json:"policy"`
+			Pruned      int                    `json:"pruned"`
+			PrunedBytes int64                  `json:"pruned_bytes"`
+		} `json:"dirs"`
+		ReserveBytes int64     `json:"reserve_bytes"`
+		Refusing     bool      `json:"refusing"`
+		LastPrune    time.Time `json:"last_prune"`
+	}{}
+	err := json.Unmarshal(jsonStr, &s)
+	if err != nil {
+		return "", err
+	}
+
+	str := "Disk Reserve: " + mibString(s.ReserveBytes)
+	if s.Refusing {
+		str += ", reached, only unsent data is written"
+	}
+	str += "\n"
+	if !s.LastPrune.IsZero() {
+		str += "Last Pruned: " + s.LastPrune.Local().Format(time.DateTime) + "\n"
+	}
+	limit := func(value int, unit string) string {
+		if value == 0 {
+			return "none"
+		}
+		return strconv.Itoa(value) + " " + unit
+	}
+	for _, dir := range s.Dirs {
+		str += "\n" + dir.Name + ": " + strconv.Itoa(dir.Files) + " files, " + mibString(dir.Bytes) +
+			", " + mibString(dir.FreeBytes) + " free on its disk\n" +
+			"\tPath: " + dir.Path + "\n"
+		if !dir.Oldest.IsZero() {
+			str += "\tOldest: " + dir.Oldest.Local().Format(time.DateTime) + "\n"
+		}
+		if dir.Policy == nil {
+			str += "\tNever pruned\n"
+			continue
+		}
+		str += "\tMax Age: " + limit(dir.Policy.MaxAge, "days") + ", Max Size: " + limit(dir.Policy.MaxSize, "MiB") +
+			", Min Free: " + limit(dir.Policy.MinFree, "MiB") + "\n" +
+			"\tPruned: " + strconv.Itoa(dir.Pruned) + " files, " + mibString(dir.PrunedBytes) + " since startup\n"
+	}
+	return str, nil
+}
+
+func queryJSONToString(jsonStr []byte) (string, error) {
+	results := []struct {
+		Id                string             `json:"id"`
+		Sensor            string             `json:"sensor"`
+		DataType          string             `json:"data_type"`
+		Time              time.Time          `json:"time"`
+		Axis              string             `json:"axis"`
+		SamplingFrequency float64            `json:"sampling_frequency"`
+		Samples           int                `json:"samples"`
+		Path              string             `json:"path"`
+		Scalars           map[string]float64 `json:"scalars"`
+		RawData           []float64          `json:"raw_data"`
+	}{}
+	err := json.Unmarshal(jsonStr, &results)
+	if err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return "No measurements", nil
+	}
+
+	str := strconv.Itoa(len(results)) + " measurements, newest first\n"
+	for _, m := range results {
+		dataType := m.DataType
+		if m.Axis != "" {
+			dataType += " " + m.Axis
+		}
+		str += "\n" + m.Time.Local().Format("2006-01-02 15:04:05.000") + " " + m.Sensor + " " + dataType
+		if m.SamplingFrequency > 0 {
+			str += " (" + strconv.Itoa(m.Samples) + " samples at " + strconv.FormatFloat(m.SamplingFrequency, 'f', -1, 64) + " Hz)"
+		}
+		str += "\n"
+		if m.Id != "" {
+			str += "\tId: " + m.Id + "\n"
+		}
+		keys := []string{}
+		for key := range m.Scalars {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for i, key := range keys {
+			if i == 0 {
+				str += "\t"
+			} else {
+				str += ", "
+			}
+			str += key + ": " + strconv.FormatFloat(m.Scalars[key], 'g', 6, 64)
+		}
+		if len(keys) > 0 {
+			str += "\n"
+		}
+		if m.Path == "" {
+			str += "\tFile: pruned\n"
+		} else {
+			str += "\tFile: " + m.Path + "\n"
+		}
+		for i, sample := range m.RawData {
+			at := 0.0
+			if m.SamplingFrequency > 0 {
+				at = float64(i) / m.SamplingFrequency
+			}
+			str += "\t\t" + strconv.FormatFloat(at, 'f', 6, 64) + "\t" + strconv.FormatFloat(sample, 'g', -1, 64) + "\n"
+		}
+	}
+	return str, nil
+}
+
+func exportJSONToString(jsonStr []byte) (string, error) {
+	manifest := struct {
+		Format   string   `json:"format"`
+		Dir      string   `json:"dir"`
+		Files    []string `json:"files"`
+		Captures []struct {
+			DataType string `json:"measurement_type"`
+		} `json:"captures"`
+		Skipped []struct {
+			Source string `json:"source"`
+			Reason string `json:"reason"`
+		} `json:"skipped"`
+	}{}
+	err := json.Unmarshal(jsonStr, &manifest)
+	if err != nil {
+		return "", err
+	}
+
+	types := map[string]int{}
+	for _, capture := range manifest.Captures {
+		types[capture.DataType]++
+	}
+	keys := []string{}
+	for key := range types {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	str := "Exported " + strconv.Itoa(len(manifest.Captures)) + " captures to " + manifest.Dir + "\n"
+	for _, key := range keys {
+		str += "\t" + key + ": " + strconv.Itoa(types[key]) + "\n"
+	}
+	str += "\t" + strconv.Itoa(len(manifest.Files)) + " " + manifest.Format + " files, described in manifest.json\n"
+	if len(manifest.Skipped) > 0 {
+		str += "Skipped " + strconv.Itoa(len(manifest.Skipped)) + ":\n"
+		for i, skipped := range manifest.Skipped {
+			if i == 10 {
+				str += "\t... see manifest.json for the rest\n"
+				break
+			}
+			str += "\t" + skipped.Source + ": " + skipped.Reason + "\n"
+		}
+	}
+	return str, nil
 }
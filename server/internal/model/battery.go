@@ -0,0 +1,117 @@
+package model
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+)
+
+const BATTERY_HISTORY_FILE = "battery_history.json"
+
+// Readings kept per sensor, oldest are dropped first
+const BATTERY_HISTORY_LENGTH = 500
+
+type BatteryReading struct {
+	Time    time.Time `json:"time"`
+	Voltage int       `json:"voltage"` // Millivolts, -1 if unknown
+	Level   int       `json:"level"`   // Percent, -1 if unknown
+}
+
+// Battery readings of every sensor by MAC address, oldest first
+var batteryHistory map[string][]BatteryReading = map[string][]BatteryReading{}
+
+// Sensors report on their own goroutines while the API reads the history
+var batteryMutex sync.Mutex
+
+// Copy of the battery readings of a sensor, oldest first
+func BatteryHistory(mac [6]byte) []BatteryReading {
+	batteryMutex.Lock()
+	defer batteryMutex.Unlock()
+	return slices.Clone(batteryHistory[MacToString(mac)])
+}
+
+// Discharge curve of each board model, {millivolts, percent} by increasing voltage
+var BATTERY_CURVES = map[string][][2]int{
+	// Single Li-ion cell
+	"machmo": {{3000, 0}, {3500, 10}, {3700, 50}, {3900, 80}, {4200, 100}},
+	// CR2032 coin cell
+	"machmomini": {{2000, 0}, {2600, 10}, {2850, 50}, {2950, 80}, {3000, 100}},
+}
+
+// Battery percentage of a board model at a voltage, -1 if the model is unknown
+func BatteryLevelFromVoltage(sensorModel string, millivolts int) int {
+	curve, ok := BATTERY_CURVES[sensorModel]
+	if !ok || millivolts < 0 {
+		return -1
+	}
+	if millivolts <= curve[0][0] {
+		return curve[0][1]
+	}
+	for i := 1; i < len(curve); i++ {
+		if millivolts <= curve[i][0] {
+			low, high := curve[i-1], curve[i]
+			return low[1] + (millivolts-low[0])*(high[1]-low[1])/(high[0]-low[0])
+		}
+	}
+	return curve[len(curve)-1][1]
+}
+
+// Keep BatteryLevel current and remember the reading
+func (s *Sensor) RecordBattery(millivolts int, level int) error {
+	if level < 0 {
+		level = BatteryLevelFromVoltage(s.Model, millivolts)
+	}
+	s.BatteryLevel = level
+
+	batteryMutex.Lock()
+	defer batteryMutex.Unlock()
+	mac := MacToString(s.Mac)
+	history := append(batteryHistory[mac], BatteryReading{
+		Time:    time.Now().UTC(), // Always UTC
+		Voltage: millivolts,
+		Level:   level,
+	})
+	if len(history) > BATTERY_HISTORY_LENGTH {
+		history = history[len(history)-BATTERY_HISTORY_LENGTH:]
+	}
+	batteryHistory[mac] = history
+
+	if err := saveBatteryHistory(); err != nil {
+		return err
+	}
+	return saveSensors()
+}
+
+func LoadBatteryHistory() error {
+	confDir, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+
+	batteryMutex.Lock()
+	defer batteryMutex.Unlock()
+	jsonStr, err := os.ReadFile(path.Join(confDir, BATTERY_HISTORY_FILE))
+	if err != nil {
+		batteryHistory = make(map[string][]BatteryReading)
+		return err
+	}
+
+	return json.Unmarshal(jsonStr, &batteryHistory)
+}
+
+// Caller holds batteryMutex
+func saveBatteryHistory() error {
+	confDir, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+
+	jsonStr, err := json.MarshalIndent(batteryHistory, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(confDir, BATTERY_HISTORY_FILE), jsonStr, 0777)
+}
@@ -0,0 +1,127 @@
+package model
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Nominal resistance at 0 degrees of each supported RTD
+var RTD_TYPES = map[string]float64{
+	"pt100":  100,
+	"pt500":  500,
+	"pt1000": 1000,
+}
+
+const DEFAULT_RTD_TYPE = "pt1000"
+
+// Reference resistor of the MachMo RTD front end, in ohms
+const DEFAULT_RTD_REFERENCE = 1500.0
+
+// Corrections measured on an installed unit. Zero values mean nominal parts.
+type Calibration struct {
+	Gain           [3]float64 `json:"gain"`            // Vibration x, y, z multiplier, 0 for 1
+	Offset         [3]float64 `json:"offset"`          // Vibration x, y, z in g, added after the gain
+	RTDType        string     `json:"rtd_type"`        // Key of RTD_TYPES, empty for DEFAULT_RTD_TYPE
+	RTDReference   float64    `json:"rtd_reference"`   // Ohms, 0 for DEFAULT_RTD_REFERENCE
+	MicSensitivity float64    `json:"mic_sensitivity"` // dBFS at 94 dB SPL, 0 to upload raw samples
+}
+
+var AXES = [3]string{"x", "y", "z"}
+
+// Multiplier of a vibration axis, 1 if not calibrated
+func (c Calibration) AxisGain(axis int) float64 {
+	if c.Gain[axis] == 0 {
+		return 1
+	}
+	return c.Gain[axis]
+}
+
+// Resistance of the RTD at 0 degrees, in ohms
+func (c Calibration) RTDNominal() float64 {
+	if r, ok := RTD_TYPES[c.RTDType]; ok {
+		return r
+	}
+	return RTD_TYPES[DEFAULT_RTD_TYPE]
+}
+
+func (c Calibration) RTDReferenceResistor() float64 {
+	if c.RTDReference == 0 {
+		return DEFAULT_RTD_REFERENCE
+	}
+	return c.RTDReference
+}
+
+// Set one value from its setting name without the "calibration_" prefix:
+// <axis>_gain, <axis>_offset, rtd_type, rtd_reference or mic_sensitivity
+func (c *Calibration) set(name string, value string) error {
+	switch name {
+	case "rtd_type":
+		value = strings.ToLower(value)
+		if _, ok := RTD_TYPES[value]; !ok {
+			return errors.New("invalid value for calibration_rtd_type setting (must be pt100, pt500 or pt1000)")
+		}
+		c.RTDType = value
+		return nil
+	case "rtd_reference":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f <= 0 {
+			return errors.New("invalid value for calibration_rtd_reference setting (must be a number of ohms greater than 0)")
+		}
+		c.RTDReference = f
+		return nil
+	case "mic_sensitivity":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f > 0 {
+			return errors.New("invalid value for calibration_mic_sensitivity setting (must be a number of dBFS, 0 or less)")
+		}
+		c.MicSensitivity = f
+		return nil
+	}
+
+	parts := strings.SplitN(name, "_", 2)
+	axis := -1
+	for i, a := range AXES {
+		if a == parts[0] {
+			axis = i
+		}
+	}
+	if axis == -1 || len(parts) < 2 {
+		return errors.New("calibration setting " + name + " doesn't exist")
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return errors.New("invalid value for calibration_" + name + " setting (must be a number)")
+	}
+	switch parts[1] {
+	case "gain":
+		if f <= 0 {
+			return errors.New("invalid value for calibration_" + name + " setting (must be greater than 0)")
+		}
+		c.Gain[axis] = f
+	case "offset":
+		c.Offset[axis] = f
+	default:
+		return errors.New("calibration setting " + name + " doesn't exist")
+	}
+	return nil
+}
+
+func (c Calibration) ToString() string {
+	str := "Calibration:\n"
+	for i, axis := range AXES {
+		str += "\tVibration " + axis + ": gain " + strconv.FormatFloat(c.AxisGain(i), 'g', -1, 64) +
+			", offset " + strconv.FormatFloat(c.Offset[i], 'g', -1, 64) + " g\n"
+	}
+	rtdType := c.RTDType
+	if rtdType == "" {
+		rtdType = DEFAULT_RTD_TYPE
+	}
+	str += "\tRTD: " + rtdType + ", reference " + strconv.FormatFloat(c.RTDReferenceResistor(), 'g', -1, 64) + " ohms\n"
+	if c.MicSensitivity != 0 {
+		str += "\tMicrophone Sensitivity: " + strconv.FormatFloat(c.MicSensitivity, 'g', -1, 64) + " dBFS\n"
+	} else {
+		str += "\tMicrophone Sensitivity: Not set\n"
+	}
+	return str
+}
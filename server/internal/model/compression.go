@@ -0,0 +1,97 @@
+package model
+
+/*
+ * Compressed HTTP uploads, measurements are mostly float literals and shrink
+ * several times over
+ */
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Values of Gateway.Compression, as set with "config --compression"
+var COMPRESSIONS = []string{"none", "gzip", "zstd"}
+
+// data encoded as compression, which is also its Content-Encoding
+func Compress(data []byte, compression string) ([]byte, error) {
+	var buffer bytes.Buffer
+	var writer io.WriteCloser
+	switch compression {
+	case "gzip":
+		writer = gzip.NewWriter(&buffer)
+	case "zstd":
+		var err error
+		writer, err = zstd.NewWriter(&buffer)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("invalid compression " + compression)
+	}
+	_, err := writer.Write(data)
+	if err = errors.Join(err, writer.Close()); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Response of an HTTP endpoint that didn't take an upload
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+// Bytes of an error response kept in HTTPError, a misbehaving endpoint could
+// send anything
+const HTTP_ERROR_BODY_LIMIT = 64 << 10
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("HTTP Status %d - %s", e.StatusCode, e.Body)
+}
+
+// Post body as json, compressed unless compression is empty. Returns the HTTP
+// status, anything but 200 is also an HTTPError. Measurements with an id are
+// sent with an Idempotency-Key, so the endpoint can tell a retry from a new
+// upload when a response got lost.
+func PostRequestBody(client *http.Client, endpoint string, body RequestBody, compression string) (int, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	if compression != "" {
+		data, err = Compress(data, compression)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if compression != "" {
+		req.Header.Set("Content-Encoding", compression)
+	}
+	if key := IdempotencyKey(body.Measurements); key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, HTTP_ERROR_BODY_LIMIT))
+		return resp.StatusCode, &HTTPError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	return resp.StatusCode, nil
+}
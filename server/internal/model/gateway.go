@@ -1,27 +1,67 @@
 package model
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"io"
-	"net/http"
+	"maps"
 	"os"
 	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 const GATEWAY_FILE = "gateway.json"
 
+// What to do with the bytes of a transfer that timed out before completing
+type PartialPolicy string
+
+const (
+	PartialPolicyDiscard PartialPolicy = "discard" // Drop them, the default
+	PartialPolicyArchive PartialPolicy = "archive" // Decode and keep on disk only
+	PartialPolicyUpload  PartialPolicy = "upload"  // Decode and upload flagged as partial
+)
+
 type Gateway struct {
-	Id               string    `json:"id"`
-	Password         string    `json:"password"`
-	DataCharUUID     [4]uint32 `json:"data_char_uuid"`
-	SettingsCharUUID [4]uint32 `json:"settings_char_uuid"`
-	HTTPEndpoint     string    `json:"http_endpoint"`
-	AuthError        bool      `json:"-"` // memory only flag for error reporting, special tag to omit from json
+	Id               string                     `json:"id"`
+	Password         string                     `json:"password"`
+	DataCharUUID     [4]uint32                  `json:"data_char_uuid"`
+	SettingsCharUUID [4]uint32                  `json:"settings_char_uuid"`
+	HTTPEndpoint     string                     `json:"http_endpoint"`
+	PartialPolicies  map[string]PartialPolicy   `json:"partial_policies"` // By data type, missing means discard
+	Sinks            []SinkConfig               `json:"sinks"`            // nil for DEFAULT_SINKS
+	Compression      string                     `json:"compression"`      // Content-Encoding of HTTP uploads, empty for none
+	BatchSize        int                        `json:"batch_size"`       // KiB of measurements per HTTP upload, 0 for one capture each
+	HTTPClientConfig HTTPClientConfig           `json:"http_client"`      // See HTTPClient
+	Retention        map[string]RetentionPolicy `json:"retention"`        // By directory, missing for DEFAULT_RETENTION
+	DiskReserve      int                        `json:"disk_reserve"`     // MiB, 0 for DEFAULT_DISK_RESERVE
+	AuthError        bool                       `json:"-"`                // memory only flag for error reporting, special tag to omit from json
+}
+
+// The API changes settings while the workers, the watchdog and the janitor
+// read them. Maps and slices of a Gateway are never written in place, setters
+// swap in changed copies under the lock.
+var settingsMutex sync.RWMutex
+
+// Copy of the settings, safe to read or marshal while they change
+func GatewaySettings(gateway *Gateway) Gateway {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return *gateway
+}
+
+// A destination for measurements, see server/sink.go for the types
+type SinkConfig struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Enabled bool              `json:"enabled"`
+	Options map[string]string `json:"options"` // Meaning depends on Type
 }
 
+// Before any sink is configured, measurements go to OpenPHM at HTTPEndpoint
+var DEFAULT_SINKS = []SinkConfig{{Name: "openphm", Type: "openphm", Enabled: true, Options: map[string]string{}}}
+
 type RequestBody struct {
 	GatewayId       string                   `json:"gateway_id"`
 	GatewayPassword string                   `json:"gateway_password"`
@@ -29,17 +69,12 @@ type RequestBody struct {
 }
 
 func LoadSettings(gateway *Gateway, fileName string) error {
-	configPath, err := os.UserConfigDir()
-	if err != nil {
-		return err
-	}
-
-	err = os.MkdirAll(path.Join(configPath, "ss_machmos"), 0777)
+	confDir, err := GetConfigDir()
 	if err != nil {
 		return err
 	}
 
-	jsonStr, err := os.ReadFile(path.Join(configPath, "ss_machmos", fileName))
+	jsonStr, err := os.ReadFile(path.Join(confDir, fileName))
 	if err != nil {
 		gateway = &Gateway{}
 		return err
@@ -53,36 +88,187 @@ func LoadSettings(gateway *Gateway, fileName string) error {
 }
 
 func SetGatewayHTTPEndpoint(gateway *Gateway, endpoint string) error {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
 	gateway.HTTPEndpoint = endpoint
-	return saveSettings(gateway, GATEWAY_FILE)
+	return writeSettings(*gateway, GATEWAY_FILE)
 }
 
 func SetGatewayId(gateway *Gateway, id string) error {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
 	gateway.Id = id
-	return saveSettings(gateway, GATEWAY_FILE)
+	return writeSettings(*gateway, GATEWAY_FILE)
 }
 
 func SetGatewayPassword(gateway *Gateway, password string) error {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
 	gateway.Password = password
-	return saveSettings(gateway, GATEWAY_FILE)
+	return writeSettings(*gateway, GATEWAY_FILE)
 }
 
-func TestGateway(gateway *Gateway) error {
-	data, _ := json.Marshal(RequestBody{
-		GatewayId:       gateway.Id,
-		GatewayPassword: gateway.Password,
+// Policy for truncated transfers of a data type
+func (gateway *Gateway) PartialPolicyFor(dataType string) PartialPolicy {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	if policy, ok := gateway.PartialPolicies[dataType]; ok {
+		return policy
+	}
+	return PartialPolicyDiscard
+}
+
+func SetGatewayPartialPolicy(gateway *Gateway, dataType string, policy string) error {
+	if _, ok := DATA_SIZE[dataType]; !ok {
+		return errors.New("invalid data type " + dataType)
+	}
+	switch PartialPolicy(policy) {
+	case PartialPolicyDiscard, PartialPolicyArchive, PartialPolicyUpload:
+	default:
+		return errors.New("invalid partial policy " + policy + " (must be discard, archive or upload)")
+	}
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	policies := maps.Clone(gateway.PartialPolicies)
+	if policies == nil {
+		policies = map[string]PartialPolicy{}
+	}
+	policies[dataType] = PartialPolicy(policy)
+	gateway.PartialPolicies = policies
+	return writeSettings(*gateway, GATEWAY_FILE)
+}
+
+func SetGatewayCompression(gateway *Gateway, compression string) error {
+	if !slices.Contains(COMPRESSIONS, compression) {
+		return errors.New("invalid compression " + compression + " (must be none, gzip or zstd)")
+	}
+	if compression == "none" {
+		compression = ""
+	}
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	gateway.Compression = compression
+	return writeSettings(*gateway, GATEWAY_FILE)
+}
+
+// size in KiB, 0 turns batching off
+func SetGatewayBatchSize(gateway *Gateway, size string) error {
+	kib, err := strconv.Atoi(size)
+	if err != nil || kib < 0 {
+		return errors.New("invalid batch size " + size + " (must be a number of KiB, 0 for no batching)")
+	}
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	gateway.BatchSize = kib
+	return writeSettings(*gateway, GATEWAY_FILE)
+}
+
+func (gateway *Gateway) SinkConfigs() []SinkConfig {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return gateway.sinkConfigs()
+}
+
+// Caller holds settingsMutex
+func (gateway *Gateway) sinkConfigs() []SinkConfig {
+	if gateway.Sinks == nil {
+		return DEFAULT_SINKS
+	}
+	return gateway.Sinks
+}
+
+func (gateway *Gateway) SinkConfig(name string) (SinkConfig, bool) {
+	for _, sink := range gateway.SinkConfigs() {
+		if sink.Name == name {
+			return sink, true
+		}
+	}
+	return SinkConfig{}, false
+}
+
+// Add a disabled sink, enable it once its options are set
+func AddGatewaySink(gateway *Gateway, name string, sinkType string) error {
+	if name == "" || strings.ContainsAny(name, " :") {
+		return errors.New("invalid sink name " + name + " (no spaces or colons)")
+	}
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	if slices.ContainsFunc(gateway.sinkConfigs(), func(s SinkConfig) bool { return s.Name == name }) {
+		return errors.New("sink " + name + " already exists")
+	}
+	gateway.Sinks = append(slices.Clone(gateway.sinkConfigs()), SinkConfig{
+		Name:    name,
+		Type:    sinkType,
+		Enabled: false,
+		Options: map[string]string{},
 	})
-	resp, err := http.Post(gateway.HTTPEndpoint, "application/json", bytes.NewBuffer(data))
+	return writeSettings(*gateway, GATEWAY_FILE)
+}
+
+func RemoveGatewaySink(gateway *Gateway, name string) error {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	sinks := slices.Clone(gateway.sinkConfigs())
+	i := slices.IndexFunc(sinks, func(s SinkConfig) bool { return s.Name == name })
+	if i == -1 {
+		return errors.New("sink " + name + " doesn't exist")
+	}
+	gateway.Sinks = slices.Delete(sinks, i, i+1)
+	return writeSettings(*gateway, GATEWAY_FILE)
+}
 
-	if err == nil && resp.StatusCode == http.StatusOK {
-		return nil
+// Set "enabled" to true or false, or an option of the sink. An empty value
+// removes the option.
+func SetGatewaySinkOption(gateway *Gateway, name string, option string, value string) error {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	sinks := slices.Clone(gateway.sinkConfigs())
+	i := slices.IndexFunc(sinks, func(s SinkConfig) bool { return s.Name == name })
+	if i == -1 {
+		return errors.New("sink " + name + " doesn't exist")
+	}
+	sink := sinks[i]
+	sink.Options = maps.Clone(sink.Options)
+	if sink.Options == nil {
+		sink.Options = map[string]string{}
 	}
+	if option == "enabled" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("invalid value for enabled (must be true or false)")
+		}
+		sink.Enabled = enabled
+	} else if value == "" {
+		delete(sink.Options, option)
+	} else {
+		sink.Options[option] = value
+	}
+	sinks[i] = sink
+	gateway.Sinks = sinks
+	return writeSettings(*gateway, GATEWAY_FILE)
+}
+
+// Post to the Gateway's endpoint, then, if compression is on, check the
+// endpoint also accepts compressed bodies
+func TestGateway(gateway *Gateway) error {
+	client, err := gateway.HTTPClient()
 	if err != nil {
 		return err
 	}
-	bytes, _ := io.ReadAll(resp.Body)
-	defer resp.Body.Close()
-	return errors.New(fmt.Sprintf("HTTP Status %d - %s", resp.StatusCode, string(bytes)))
+	settings := GatewaySettings(gateway)
+	body := RequestBody{
+		GatewayId:       settings.Id,
+		GatewayPassword: settings.Password,
+	}
+	_, err = PostRequestBody(client, settings.HTTPEndpoint, body, "")
+	if err != nil || settings.Compression == "" {
+		return err
+	}
+	_, err = PostRequestBody(client, settings.HTTPEndpoint, body, settings.Compression)
+	if err != nil {
+		return errors.New("the HTTP Endpoint doesn't accept " + settings.Compression + " bodies, set the compression to none: " + err.Error())
+	}
+	return nil
 }
 
 func GetDataCharUUID(gateway *Gateway) ([4]uint32, error) {
@@ -125,20 +311,19 @@ func saveSettings(gateway *Gateway, fileName string) error {
 	if gateway == nil {
 		return errors.New("gateway is nil")
 	}
+	return writeSettings(GatewaySettings(gateway), fileName)
+}
 
+// Caller holds settingsMutex or passes a copy
+func writeSettings(gateway Gateway, fileName string) error {
 	jsonStr, err := json.MarshalIndent(gateway, "", "\t")
 	if err != nil {
 		return err
 	}
-	configPath, err := os.UserConfigDir()
-	if err != nil {
-		return err
-	}
-
-	err = os.MkdirAll(path.Join(configPath, "ss_machmos"), 0777)
+	confDir, err := GetConfigDir()
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(path.Join(configPath, "ss_machmos", fileName), jsonStr, 0777)
+	return os.WriteFile(path.Join(confDir, fileName), jsonStr, 0777)
 }
@@ -0,0 +1,188 @@
+package model
+
+/*
+ * The HTTP client every upload goes through, built from the Gateway settings
+ * so plants behind a proxy, with their own CA or requiring client
+ * certificates can be reached
+ */
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Seconds, used when the setting is 0
+const DEFAULT_HTTP_TIMEOUT = 120
+
+const DEFAULT_HTTP_CONNECT_TIMEOUT = 10
+
+// Settings of HTTPClientConfig, as set with "config --client"
+var HTTP_CLIENT_SETTINGS = []string{"timeout", "connect_timeout", "proxy", "ca", "cert", "key", "tls_min_version"}
+
+var TLS_VERSIONS = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Zero values keep the defaults
+type HTTPClientConfig struct {
+	Timeout        int    `json:"timeout"`         // Seconds for a whole request, response included
+	ConnectTimeout int    `json:"connect_timeout"` // Seconds to open the connection
+	Proxy          string `json:"proxy"`           // Proxy URL, "none" to go direct, empty for HTTP(S)_PROXY
+	CA             string `json:"ca"`              // PEM bundle trusted on top of the system roots
+	Cert           string `json:"cert"`            // PEM client certificate, with Key
+	Key            string `json:"key"`             //
+	TLSMinVersion  string `json:"tls_min_version"` // 1.0 to 1.3
+}
+
+// Last client built and the settings it was built from
+var httpClient *http.Client
+var httpClientConfig HTTPClientConfig
+var httpClientMutex sync.Mutex
+
+// Client for the current settings, rebuilt only when they change
+func (gateway *Gateway) HTTPClient() (*http.Client, error) {
+	config := GatewaySettings(gateway).HTTPClientConfig
+	httpClientMutex.Lock()
+	defer httpClientMutex.Unlock()
+	if httpClient != nil && httpClientConfig == config {
+		return httpClient, nil
+	}
+	client, err := config.build()
+	if err != nil {
+		return nil, err
+	}
+	httpClient = client
+	httpClientConfig = config
+	return client, nil
+}
+
+func (config HTTPClientConfig) build() (*http.Client, error) {
+	timeout := DEFAULT_HTTP_TIMEOUT
+	if config.Timeout > 0 {
+		timeout = config.Timeout
+	}
+	connectTimeout := DEFAULT_HTTP_CONNECT_TIMEOUT
+	if config.ConnectTimeout > 0 {
+		connectTimeout = config.ConnectTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   time.Duration(connectTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	switch config.Proxy {
+	case "":
+		transport.Proxy = http.ProxyFromEnvironment
+	case "none":
+		transport.Proxy = nil
+	default:
+		proxy, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.CA != "" {
+		pem, err := os.ReadFile(config.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs, err = x509.SystemCertPool()
+		if err != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+		}
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + config.CA)
+		}
+	}
+	if config.Cert != "" || config.Key != "" {
+		if config.Cert == "" || config.Key == "" {
+			return nil, errors.New("client settings cert and key go together")
+		}
+		pair, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	if config.TLSMinVersion != "" {
+		tlsConfig.MinVersion = TLS_VERSIONS[config.TLSMinVersion]
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(timeout) * time.Second,
+	}, nil
+}
+
+// Set a setting of the HTTP client, an empty value restores its default.
+// Whether cert and key match is only known once both are set, the first
+// upload or TestGateway reports it.
+func SetGatewayHTTPClientSetting(gateway *Gateway, setting string, value string) error {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	config := gateway.HTTPClientConfig
+	switch setting {
+	case "timeout", "connect_timeout":
+		seconds := 0
+		if value != "" {
+			var err error
+			seconds, err = strconv.Atoi(value)
+			if err != nil || seconds < 0 {
+				return errors.New("invalid value for " + setting + " (must be a number of seconds, 0 for the default)")
+			}
+		}
+		if setting == "timeout" {
+			config.Timeout = seconds
+		} else {
+			config.ConnectTimeout = seconds
+		}
+	case "proxy":
+		if value != "" && value != "none" {
+			proxy, err := url.Parse(value)
+			if err != nil || proxy.Scheme == "" || proxy.Host == "" {
+				return errors.New("invalid value for proxy (must be like http://<host>:<port>, or none)")
+			}
+		}
+		config.Proxy = value
+	case "ca", "cert", "key":
+		if value != "" {
+			if _, err := os.Stat(value); err != nil {
+				return err
+			}
+		}
+		switch setting {
+		case "ca":
+			config.CA = value
+		case "cert":
+			config.Cert = value
+		case "key":
+			config.Key = value
+		}
+	case "tls_min_version":
+		if _, ok := TLS_VERSIONS[value]; value != "" && !ok {
+			return errors.New("invalid value for tls_min_version (must be 1.0, 1.1, 1.2 or 1.3)")
+		}
+		config.TLSMinVersion = value
+	default:
+		return errors.New("invalid client setting " + setting + " (must be one of " + strings.Join(HTTP_CLIENT_SETTINGS, ", ") + ")")
+	}
+	gateway.HTTPClientConfig = config
+	return writeSettings(*gateway, GATEWAY_FILE)
+}
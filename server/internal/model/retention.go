@@ -0,0 +1,106 @@
+package model
+
+/*
+ * How long archived and debug data is kept, so a gateway on a small SD card
+ * doesn't fill it up and stop uploading
+ */
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Directories the janitor prunes, in the order space is taken back from them.
+// unsent_data is never pruned.
+var RETENTION_DIRS = []string{"debug", "sent", "rejected"}
+
+// Settings of RetentionPolicy, as set with "config --retention"
+var RETENTION_SETTINGS = []string{"max_age", "max_size", "min_free"}
+
+// MiB, used when DiskReserve is 0
+const DEFAULT_DISK_RESERVE = 64
+
+// Zero values are no limit
+type RetentionPolicy struct {
+	MaxAge  int `json:"max_age"`  // Days a file is kept
+	MaxSize int `json:"max_size"` // MiB the directory may hold
+	MinFree int `json:"min_free"` // MiB of free disk, oldest files go first to keep it
+}
+
+// Used for a directory until its policy is set
+var DEFAULT_RETENTION = map[string]RetentionPolicy{
+	"debug":    {MaxAge: 7, MaxSize: 512, MinFree: 256},
+	"sent":     {MinFree: 256},
+	"rejected": {MinFree: 128},
+}
+
+func (gateway *Gateway) RetentionFor(dir string) RetentionPolicy {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return gateway.retentionFor(dir)
+}
+
+// Caller holds settingsMutex
+func (gateway *Gateway) retentionFor(dir string) RetentionPolicy {
+	if policy, ok := gateway.Retention[dir]; ok {
+		return policy
+	}
+	return DEFAULT_RETENTION[dir]
+}
+
+// MiB of free disk below which nothing but unsent data is written
+func (gateway *Gateway) DiskReserveMiB() int {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	if gateway.DiskReserve > 0 {
+		return gateway.DiskReserve
+	}
+	return DEFAULT_DISK_RESERVE
+}
+
+// Set a setting of the retention policy of a directory, starting from its
+// default the first time
+func SetGatewayRetention(gateway *Gateway, dir string, setting string, value string) error {
+	if !slices.Contains(RETENTION_DIRS, dir) {
+		return errors.New("invalid retention directory " + dir + " (must be one of " + strings.Join(RETENTION_DIRS, ", ") + ")")
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return errors.New("invalid value for " + setting + " (must be a positive integer, 0 for no limit)")
+	}
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	policy := gateway.retentionFor(dir)
+	switch setting {
+	case "max_age":
+		policy.MaxAge = number
+	case "max_size":
+		policy.MaxSize = number
+	case "min_free":
+		policy.MinFree = number
+	default:
+		return errors.New("invalid retention setting " + setting + " (must be one of " + strings.Join(RETENTION_SETTINGS, ", ") + ")")
+	}
+	retention := maps.Clone(gateway.Retention)
+	if retention == nil {
+		retention = map[string]RetentionPolicy{}
+	}
+	retention[dir] = policy
+	gateway.Retention = retention
+	return writeSettings(*gateway, GATEWAY_FILE)
+}
+
+// size in MiB, 0 restores the default
+func SetGatewayDiskReserve(gateway *Gateway, size string) error {
+	mib, err := strconv.Atoi(size)
+	if err != nil || mib < 0 {
+		return errors.New("invalid disk reserve " + size + " (must be a number of MiB, 0 for the default)")
+	}
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	gateway.DiskReserve = mib
+	return writeSettings(*gateway, GATEWAY_FILE)
+}
@@ -10,6 +10,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jukuly/ss_machmos/server/internal/out"
@@ -33,6 +34,35 @@ var SENSOR_MODELS map[byte]string = map[byte]string{
 	0x2: "machmomini",
 }
 
+// Accelerometer full scale ranges in g supported by each board model
+var VIBRATION_RANGES = map[string][]int{
+	"machmo":     {2, 4, 8, 16},
+	"machmomini": {2, 4, 8},
+}
+
+const DEFAULT_VIBRATION_RANGE = 8
+
+// Ranges supported by a board model. A model missing from VIBRATION_RANGES,
+// like one that wasn't announced, only gets DEFAULT_VIBRATION_RANGE.
+func vibrationRanges(sensorModel string) ([]int, bool) {
+	if ranges, ok := VIBRATION_RANGES[sensorModel]; ok {
+		return ranges, true
+	}
+	return []int{DEFAULT_VIBRATION_RANGE}, false
+}
+
+// Accelerometer LSB in g at each full scale range
+var VIBRATION_SCALE = map[int]float64{
+	2:  .000061,
+	4:  .000122,
+	8:  .000244,
+	16: .000488,
+}
+
+// Type byte of the settings entry carrying the accelerometer range, sent
+// right after the vibration entry. Boards that don't know it skip it.
+const SETTING_VIBRATION_RANGE byte = 0x10
+
 type SensorActivity string
 
 const (
@@ -51,6 +81,7 @@ type settings struct {
 	Active            bool   `json:"active"`
 	SamplingFrequency uint32 `json:"sampling_frequency"`
 	SamplingDuration  uint16 `json:"sampling_duration"`
+	Range             int    `json:"range,omitempty"` // Full scale in g, vibration only, 0 for DEFAULT_VIBRATION_RANGE
 }
 
 type Sensor struct {
@@ -60,16 +91,34 @@ type Sensor struct {
 	Types                   []string            `json:"types"`
 	BatteryLevel            int                 `json:"battery_level"`
 	CollectionCapacity      uint32              `json:"collection_capacity"`
-	WakeUpInterval          int                 `json:"wake_up_interval"` // Time in seconds to sleep for
+	MaxTransmissionSize     uint32              `json:"max_transmission_size"` // Largest upload accepted in bytes, 0 for CollectionCapacity
+	WakeUpInterval          int                 `json:"wake_up_interval"`      // Time in seconds to sleep for
 	WakeUpIntervalMaxOffset int                 `json:"wake_up_interval_max_offset"`
 	DeviceActive            bool                `json:"device_active"`
 	Settings                map[string]settings `json:"settings"`
+	Calibration             Calibration         `json:"calibration"`
 }
 
 func (sensor *Sensor) MacString() string {
 	return MacToString(sensor.Mac)
 }
 
+// Largest upload in bytes the gateway accepts from this sensor
+func (sensor *Sensor) TransmissionLimit() uint32 {
+	if sensor.MaxTransmissionSize == 0 {
+		return sensor.CollectionCapacity
+	}
+	return sensor.MaxTransmissionSize
+}
+
+// Accelerometer full scale range in g
+func (sensor *Sensor) VibrationRange() int {
+	if r := sensor.Settings["vibration"].Range; r != 0 {
+		return r
+	}
+	return DEFAULT_VIBRATION_RANGE
+}
+
 // Returns time for the sensor to sleep in seconds
 func (sensor *Sensor) GetSleepDuration() uint32 {
 	return uint32(sensor.WakeUpInterval)
@@ -89,6 +138,9 @@ func (sensor *Sensor) Verify() error {
 	if totalDataUsed > int(sensor.CollectionCapacity) {
 		errors.Join(err, errors.New(fmt.Sprint("Current requested capacity", totalDataUsed, "exceeds maximum capacity", sensor.CollectionCapacity)))
 	}
+	if sensor.MaxTransmissionSize > sensor.CollectionCapacity {
+		err = errors.Join(err, errors.New(fmt.Sprint("Maximum transmission size ", sensor.MaxTransmissionSize, " of ", MacToString(sensor.Mac), " exceeds collection capacity ", sensor.CollectionCapacity)))
+	}
 
 	return err
 }
@@ -96,7 +148,11 @@ func (sensor *Sensor) Verify() error {
 // List of sensor statuses and uploads
 var SensorHistory map[string]SensorLastSeen = map[string]SensorLastSeen{}
 
+// Sensors and sinks update and read it on their own goroutines
+var historyMutex sync.Mutex
+
 func (s *Sensor) UpdateLastSeen(activity SensorActivity) {
+	historyMutex.Lock()
 	hist, ok := SensorHistory[MacToString(s.Mac)]
 	if !ok {
 		hist = SensorLastSeen{}
@@ -105,10 +161,13 @@ func (s *Sensor) UpdateLastSeen(activity SensorActivity) {
 	hist.LastActivity = activity
 	SensorHistory[MacToString(s.Mac)] = hist
 	saveSensorHistory()
+	historyMutex.Unlock()
 	out.Broadcast("SENSOR-UPDATED")
 }
 
 func (s *Sensor) FetchLastSeen() SensorLastSeen {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
 	return SensorHistory[MacToString(s.Mac)]
 }
 
@@ -129,6 +188,7 @@ func (s *Sensor) ToString() string {
 		str += strconv.Itoa(s.BatteryLevel) + " %\n"
 	}
 	str += "Collection Capacity: " + strconv.Itoa(int(s.CollectionCapacity)) + " bytes\n"
+	str += "Max Transmission Size: " + strconv.Itoa(int(s.TransmissionLimit())) + " bytes\n"
 	str += "Wake Up Interval: " + strconv.Itoa(s.WakeUpInterval) + " +- " + strconv.Itoa(s.WakeUpIntervalMaxOffset) + " seconds\n"
 	// str += "Next Wake Up: " + s.NextWakeUp.Local().Format(time.RFC3339) + "\n"
 	str += "\t\tDevice is Active: " + strconv.FormatBool(s.DeviceActive)
@@ -141,7 +201,11 @@ func (s *Sensor) ToString() string {
 		}
 		str += "\t\tSampling Frequency: " + strconv.Itoa(int(value.SamplingFrequency)) + " Hz\n"
 		str += "\t\tSampling Duration: " + strconv.Itoa(int(value.SamplingDuration)) + " seconds\n"
+		if setting == "vibration" {
+			str += "\t\tRange: +-" + strconv.Itoa(s.VibrationRange()) + " g\n"
+		}
 	}
+	str += s.Calibration.ToString()
 	return str
 }
 
@@ -168,17 +232,12 @@ func MacToString(mac [6]byte) string {
 
 func LoadSensors() error {
 	// Load sensors from home directory, because access to /var/ by non-root can be tricky
-	configPath, err := os.UserConfigDir()
-	if err != nil {
-		return err
-	}
-
-	err = os.MkdirAll(path.Join(configPath, "ss_machmos"), 0777)
+	confDir, err := GetConfigDir()
 	if err != nil {
 		return err
 	}
 
-	jsonStr, err := os.ReadFile(path.Join(configPath, "ss_machmos", SENSORS_FILE))
+	jsonStr, err := os.ReadFile(path.Join(confDir, SENSORS_FILE))
 	if err != nil {
 		//sensors = make([]Sensor, 0)
 		return err
@@ -189,6 +248,22 @@ func LoadSensors() error {
 		return err
 	}
 
+	// Sensors paired before a data type was supported have no settings for it
+	for i := range newSensors {
+		curSensor := &newSensors[i]
+		for _, t := range curSensor.Types {
+			if _, ok := curSensor.Settings[t]; ok {
+				continue
+			}
+			if s, ok := defaultSettings(t); ok {
+				if curSensor.Settings == nil {
+					curSensor.Settings = map[string]settings{}
+				}
+				curSensor.Settings[t] = s
+			}
+		}
+	}
+
 	// Verify loaded configuration for errors
 	for _, curSensor := range newSensors {
 		curErr := curSensor.Verify()
@@ -220,11 +295,11 @@ func RemoveSensor(mac [6]byte) error {
 	return nil
 }
 
-func getDefaultSensor(mac [6]byte, types []string, collectionCapacity uint32 /*, publicKey *rsa.PublicKey*/) Sensor {
+func getDefaultSensor(mac [6]byte, model string, types []string, collectionCapacity uint32 /*, publicKey *rsa.PublicKey*/) Sensor {
 	sensor := Sensor{
 		Mac:                     mac,
 		Name:                    "Sensor " + MacToString(mac),
-		Model:                   "unknown",
+		Model:                   model,
 		Types:                   types,
 		BatteryLevel:            -1,
 		CollectionCapacity:      collectionCapacity,
@@ -236,35 +311,49 @@ func getDefaultSensor(mac [6]byte, types []string, collectionCapacity uint32 /*,
 	}
 
 	for _, t := range types {
-		switch t {
-		case "vibration":
-			sensor.Settings["vibration"] = settings{
-				Active:            true,
-				SamplingFrequency: 8000,
-				SamplingDuration:  1,
-			}
-		case "temperature":
-			sensor.Settings["temperature"] = settings{
-				Active: true,
-			}
-		case "audio":
-			sensor.Settings["audio"] = settings{
-				Active:            true,
-				SamplingFrequency: 22110,
-				SamplingDuration:  1,
-			}
+		if s, ok := defaultSettings(t); ok {
+			sensor.Settings[t] = s
 		}
 	}
 
 	return sensor
 }
 
-func AddSensor(mac [6]byte, types []string, collectionCapacity uint32) error {
+// Settings of a data type right after pairing
+func defaultSettings(dataType string) (settings, bool) {
+	switch dataType {
+	case "vibration":
+		return settings{
+			Active:            true,
+			SamplingFrequency: 8000,
+			SamplingDuration:  1,
+		}, true
+	case "temperature":
+		return settings{
+			Active: true,
+		}, true
+	case "audio":
+		return settings{
+			Active:            true,
+			SamplingFrequency: 22110,
+			SamplingDuration:  1,
+		}, true
+	case "flux":
+		return settings{
+			Active:            true,
+			SamplingFrequency: 2000,
+			SamplingDuration:  1,
+		}, true
+	}
+	return settings{}, false
+}
+
+func AddSensor(mac [6]byte, model string, types []string, collectionCapacity uint32) error {
 	if Sensors == nil {
 		return errors.New("sensors is nil")
 	}
 
-	Sensors = append(Sensors, getDefaultSensor(mac, types, collectionCapacity))
+	Sensors = append(Sensors, getDefaultSensor(mac, model, types, collectionCapacity))
 	err := saveSensors()
 	return err
 }
@@ -294,11 +383,18 @@ func (sensor *Sensor) SettingsBytes() []byte {
 			response = append(response, 0x00, active)
 			response = binary.LittleEndian.AppendUint32(response, settings.SamplingFrequency)
 			response = binary.LittleEndian.AppendUint16(response, settings.SamplingDuration)
+			// 1 + 1 + 6 padding = 8
+			response = append(response, SETTING_VIBRATION_RANGE, byte(sensor.VibrationRange()), 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
 		case "audio":
 			// 1 + 1 + 4 + 2 = 8
 			response = append(response, 0x01, active)
 			response = binary.LittleEndian.AppendUint32(response, settings.SamplingFrequency)
 			response = binary.LittleEndian.AppendUint16(response, settings.SamplingDuration)
+		case "flux":
+			// 1 + 1 + 4 + 2 = 8
+			response = append(response, 0x04, active)
+			response = binary.LittleEndian.AppendUint32(response, settings.SamplingFrequency)
+			response = binary.LittleEndian.AppendUint16(response, settings.SamplingDuration)
 		case "temperature":
 			// 							1	  2       3		4	  5	    6	  7     8
 			response = append(response, 0x02, active, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
@@ -328,7 +424,12 @@ func UpdateSensorSetting(mac [6]byte, setting string, value string) error {
 	}
 
 	if setting == "auto" {
-		*sensor = getDefaultSensor(mac, sensor.Types, sensor.CollectionCapacity /*, &sensor.PublicKey*/)
+		defaults := getDefaultSensor(mac, sensor.Model, sensor.Types, sensor.CollectionCapacity /*, &sensor.PublicKey*/)
+		// Properties of the unit, not settings
+		defaults.Calibration = sensor.Calibration
+		defaults.MaxTransmissionSize = sensor.MaxTransmissionSize
+		defaults.BatteryLevel = sensor.BatteryLevel
+		*sensor = defaults
 		return saveSensors()
 	}
 
@@ -371,13 +472,34 @@ func UpdateSensorSetting(mac [6]byte, setting string, value string) error {
 		return saveSensors()
 	}
 
+	if setting == "max_transmission_size" {
+		intValue, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("invalid value for max_transmission_size setting (must be an integer (bytes))")
+		}
+		// 0 goes back to the collection capacity
+		if intValue < 0 || intValue > int(sensor.CollectionCapacity) {
+			return errors.New("invalid value for max_transmission_size setting (must an integer between 0 and collection capacity " + strconv.Itoa(int(sensor.CollectionCapacity)) + ")")
+		}
+		sensor.MaxTransmissionSize = uint32(intValue)
+		return saveSensors()
+	}
+
+	if name, ok := strings.CutPrefix(setting, "calibration_"); ok {
+		err := sensor.Calibration.set(name, value)
+		if err != nil {
+			return err
+		}
+		return saveSensors()
+	}
+
 	settingParts := strings.Split(setting, "_")
 	if len(settingParts) < 2 {
 		return errors.New("invalid setting format")
 	}
 
 	dataType := settingParts[0]
-	if dataType != "vibration" && dataType != "temperature" && dataType != "audio" {
+	if dataType != "vibration" && dataType != "temperature" && dataType != "audio" && dataType != "flux" {
 		return errors.New("invalid setting data type")
 	}
 	setting = strings.Join(settingParts[1:], "_")
@@ -421,6 +543,25 @@ func UpdateSensorSetting(mac [6]byte, setting string, value string) error {
 		setting := sensor.Settings[dataType]
 		setting.SamplingDuration = uint16(intValue)
 		sensor.Settings[dataType] = setting
+	case "range":
+		if dataType != "vibration" {
+			return errors.New("setting range only exists for vibration")
+		}
+		intValue, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("invalid value for vibration_range setting (must be an integer (g))")
+		}
+		ranges, known := vibrationRanges(sensor.Model)
+		if !slices.Contains(ranges, intValue) {
+			if !known {
+				return fmt.Errorf("invalid value for vibration_range setting (board model %q is unknown, only the default of %d g can be used)", sensor.Model, DEFAULT_VIBRATION_RANGE)
+			}
+			return errors.New("invalid value for vibration_range setting (" + sensor.Model + " supports " + fmt.Sprint(ranges) + " g)")
+		}
+
+		setting := sensor.Settings[dataType]
+		setting.Range = intValue
+		sensor.Settings[dataType] = setting
 	default:
 		return errors.New("setting " + setting + " doesn't exist")
 	}
@@ -478,7 +619,14 @@ func isExceedingCollectionCapacity(sensor *Sensor, setting string, newSettingVal
 	return nil
 }
 
+// Directory of the sensors and settings, replaces ss_machmos in the user
+// config directory when set so the simulator doesn't touch the real gateway's
+var ConfigDir string
+
 func GetConfigDir() (string, error) {
+	if ConfigDir != "" {
+		return ConfigDir, os.MkdirAll(ConfigDir, 0777)
+	}
 	configPath, err := os.UserConfigDir()
 	if err != nil {
 		return "", err
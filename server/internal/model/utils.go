@@ -9,6 +9,8 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/google/uuid"
 )
@@ -60,6 +62,25 @@ func UuidToString(uuid [4]uint32) string {
 	return fmt.Sprintf("%08x-%04x-%04x-%04x-%04x%08x", uuid[3], uuid[2]>>16, uuid[2]&0xffff, uuid[1]>>16, uuid[1]&0xffff, uuid[0])
 }
 
+// Idempotency-Key of an upload: the measurement_id of a single capture, or a
+// UUID derived from every one for a batch, empty if none has an id
+func IdempotencyKey(measurements []map[string]interface{}) string {
+	ids := []string{}
+	for _, measurement := range measurements {
+		if id, ok := measurement["measurement_id"].(string); ok && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return ""
+	case 1:
+		return ids[0]
+	}
+	slices.Sort(ids)
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(strings.Join(ids, ","))).String()
+}
+
 func GenerateUUID() ([4]uint32, error) {
 	u, err := uuid.New().MarshalBinary()
 	if len(u) != 16 || err != nil {
@@ -0,0 +1,52 @@
+package server
+
+/*
+ * Battery reports written by sensors on every wake up
+ */
+
+import (
+	"encoding/binary"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+// Sent as percentage when the sensor leaves the conversion to the gateway
+const BATTERY_LEVEL_UNKNOWN = 0xFF
+
+// voltage in mV (2 bytes) | percentage (1 byte, optional, 0xFF if unknown)
+func handleBatteryData(address string, value []byte) {
+	if len(value) < 2 {
+		out.Logger.Println("Received", len(value), "bytes of battery data from", address, ", expected at least 2")
+		return
+	}
+	mac, err := model.StringToMac(address)
+	if err != nil {
+		out.Logger.Println("Error:", err)
+		return
+	}
+	sensor := sensorExists(mac)
+	if sensor == nil {
+		out.Logger.Println("Device " + address + " tried to send battery data, but it is not paired with this gateway")
+		return
+	}
+
+	millivolts := int(binary.LittleEndian.Uint16(value[0:2]))
+	level := -1
+	if len(value) >= 3 && value[2] != BATTERY_LEVEL_UNKNOWN {
+		level = min(int(value[2]), 100)
+	}
+	if err := sensor.RecordBattery(millivolts, level); err != nil {
+		out.Logger.Println("Error:", err)
+	}
+	out.Logger.Println("Battery of", sensor.Name, "["+address+"] at", millivolts, "mV,", sensor.BatteryLevel, "%")
+	sensor.UpdateLastSeen(model.SensorActivityIdle)
+}
+
+// Last known battery level of a sensor, -1 if unknown
+func batteryLevelOf(mac [6]byte) int {
+	if sensor := sensorExists(mac); sensor != nil {
+		return sensor.BatteryLevel
+	}
+	return -1
+}
@@ -0,0 +1,199 @@
+package server
+
+/*
+ * Raw captures, the bytes exactly as the sensor sent them, kept next to the
+ * decoded measurements for the sinks that store those instead
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+// Layout of the bytes of each data type, for whoever reads a capture later
+var SAMPLE_FORMATS = map[string]string{
+	"vibration":   "int16 little endian, x y z interleaved",
+	"audio":       "int24 big endian",
+	"temperature": "int16 little endian",
+	"flux":        "int16 little endian",
+}
+
+// Sidecar describing a raw capture
+type CaptureMetadata struct {
+	Id                string            `json:"measurement_id"`
+	GatewayId         string            `json:"gateway_id"`
+	SensorId          string            `json:"sensor_id"`
+	SensorName        string            `json:"sensor_name"`
+	SensorModel       string            `json:"sensor_model"`
+	DataType          string            `json:"measurement_type"`
+	Time              time.Time         `json:"time"`
+	SamplingFrequency uint32            `json:"sampling_frequency"`
+	FramingVersion    byte              `json:"framing_version"`
+	Bytes             int               `json:"bytes"`
+	Checksum          uint32            `json:"crc32"`
+	SampleFormat      string            `json:"sample_format"`
+	VibrationRange    int               `json:"range,omitempty"` // g, vibration only
+	Calibration       model.Calibration `json:"calibration"`
+	Partial           bool              `json:"partial"`
+	ExpectedBytes     uint32            `json:"expected_bytes"`
+	Corrupt           string            `json:"corrupt,omitempty"` // Debug captures only, why the data can't be trusted
+}
+
+type Capture struct {
+	Path     string // Raw bytes on disk
+	Metadata CaptureMetadata
+}
+
+// Implemented by sinks that store raw captures rather than decoded measurements
+type CaptureSink interface {
+	Sink
+	SendCapture(capture Capture) error
+}
+
+func rawCaptureDir(dir string) string {
+	dir = path.Join(dir, "/raw/")
+	err := os.MkdirAll(dir, dirPermCode)
+	if err != nil {
+		out.Logger.Panic(err.Error())
+	}
+	return dir
+}
+
+// Raw bytes and sidecar of the measurements in file, in dir
+func capturePaths(dir string, file string) (string, string) {
+	base := path.Join(rawCaptureDir(dir), strings.TrimSuffix(file, ".json"))
+	return base + ".bin", base + ".json"
+}
+
+// Whether an active sink wants raw captures
+func captureSinksActive() bool {
+	for _, name := range activeSinks() {
+		if sink, ok := sinkFor(name); ok {
+			if _, ok := sink.(CaptureSink); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Sidecar of the raw bytes of a transmission
+func captureMetadata(t Transmission) (CaptureMetadata, error) {
+	checksum, err := t.data.Checksum()
+	if err != nil {
+		return CaptureMetadata{}, err
+	}
+	metadata := CaptureMetadata{
+		Id:                t.id,
+		GatewayId:         model.GatewaySettings(Gateway).Id,
+		SensorId:          model.MacToString(t.macAddress),
+		SensorModel:       t.sensorModel,
+		DataType:          t.dataType,
+		Time:              t.timestamp,
+		SamplingFrequency: t.samplingFrequency,
+		FramingVersion:    t.version,
+		Bytes:             t.data.Len(),
+		Checksum:          checksum,
+		SampleFormat:      SAMPLE_FORMATS[t.dataType],
+		Calibration:       t.calibration,
+		Partial:           t.partial,
+		ExpectedBytes:     t.totalLength,
+	}
+	if t.dataType == "vibration" {
+		metadata.VibrationRange = t.vibrationRange
+	}
+	if sensor := sensorExists(t.macAddress); sensor != nil {
+		metadata.SensorName = sensor.Name
+	}
+	return metadata, nil
+}
+
+// Keep the raw bytes of a transmission for the measurements saved in file
+func saveRawCapture(t Transmission, file string) error {
+	metadata, err := captureMetadata(t)
+	if err != nil {
+		return err
+	}
+
+	binPath, metaPath := capturePaths(unsentDataDir(), file)
+	bin, err := os.OpenFile(binPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePermCode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(bin, t.data.Reader())
+	if err = errors.Join(err, bin.Close()); err != nil {
+		return err
+	}
+	jsonStr, err := json.MarshalIndent(metadata, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath, jsonStr, filePermCode)
+}
+
+// Transmission back from a raw capture, to decode it again. Release its data
+// once done.
+func captureTransmission(capture Capture) (Transmission, error) {
+	mac, err := model.StringToMac(capture.Metadata.SensorId)
+	if err != nil {
+		return Transmission{}, err
+	}
+	t := Transmission{
+		id:                capture.Metadata.Id,
+		macAddress:        mac,
+		sensorModel:       capture.Metadata.SensorModel,
+		timestamp:         capture.Metadata.Time,
+		dataType:          capture.Metadata.DataType,
+		samplingFrequency: capture.Metadata.SamplingFrequency,
+		totalLength:       capture.Metadata.ExpectedBytes,
+		data:              &transmissionData{},
+		version:           capture.Metadata.FramingVersion,
+		partial:           capture.Metadata.Partial,
+		calibration:       capture.Metadata.Calibration,
+		vibrationRange:    capture.Metadata.VibrationRange,
+	}
+	bin, err := os.Open(capture.Path)
+	if err != nil {
+		return Transmission{}, err
+	}
+	defer bin.Close()
+	if _, err := io.Copy(t.data, bin); err != nil {
+		t.data.Release()
+		return Transmission{}, err
+	}
+	return t, nil
+}
+
+// Raw capture of the measurements in file, false if none was kept
+func loadRawCapture(file string) (Capture, bool, error) {
+	binPath, metaPath := capturePaths(unsentDataDir(), file)
+	jsonStr, err := os.ReadFile(metaPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return Capture{}, false, nil
+	}
+	if err != nil {
+		return Capture{}, false, err
+	}
+	capture := Capture{Path: binPath}
+	err = json.Unmarshal(jsonStr, &capture.Metadata)
+	return capture, err == nil, err
+}
+
+// Move the raw capture of file along with it, if there is one
+func archiveRawCapture(file string) {
+	fromBin, fromMeta := capturePaths(unsentDataDir(), file)
+	toBin, toMeta := capturePaths(archivedDataDir(), file)
+	for from, to := range map[string]string{fromBin: toBin, fromMeta: toMeta} {
+		if err := os.Rename(from, to); err != nil && !errors.Is(err, os.ErrNotExist) {
+			out.Logger.Println("Error:", err)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package server
+
+/*
+ * Turning the bytes of a completed transmission into measurements. Decoders
+ * are registered per data type, board model and framing version, so a new
+ * board only needs a RegisterDecoder call, not changes to the BLE callbacks.
+ */
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+type Decoder interface {
+	// Measurements ready to be serialized to json and uploaded
+	Decode(t Transmission) ([]map[string]interface{}, error)
+}
+
+// Adapter to use an ordinary function as a Decoder
+type DecoderFunc func(t Transmission) ([]map[string]interface{}, error)
+
+func (f DecoderFunc) Decode(t Transmission) ([]map[string]interface{}, error) {
+	return f(t)
+}
+
+// Matches any board model when registering a decoder
+const ANY_MODEL = "*"
+
+// Matches any framing version when registering a decoder
+const ANY_VERSION = -1
+
+type decoderKey struct {
+	dataType    string
+	sensorModel string
+	version     int
+}
+
+var decoders = map[decoderKey]Decoder{}
+
+// Returned when no registered decoder matches a transmission
+var ErrNoDecoder = errors.New("no decoder registered")
+
+// Use d for every transmission of dataType from sensorModel with the given
+// framing version. ANY_MODEL and ANY_VERSION act as wildcards, the most
+// specific registration wins. Registering the same key again replaces it.
+func RegisterDecoder(dataType string, sensorModel string, version int, d Decoder) {
+	decoders[decoderKey{dataType: dataType, sensorModel: sensorModel, version: version}] = d
+}
+
+func decoderFor(dataType string, sensorModel string, version byte) (Decoder, bool) {
+	for _, key := range []decoderKey{
+		{dataType, sensorModel, int(version)},
+		{dataType, sensorModel, ANY_VERSION},
+		{dataType, ANY_MODEL, int(version)},
+		{dataType, ANY_MODEL, ANY_VERSION},
+	} {
+		if d, ok := decoders[key]; ok {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// Pick the decoder of a transmission and run it
+func decode(t Transmission) ([]map[string]interface{}, error) {
+	d, ok := decoderFor(t.dataType, t.sensorModel, t.version)
+	if !ok {
+		return nil, fmt.Errorf("%w for %s data from board model %s, framing version %d", ErrNoDecoder, t.dataType, t.sensorModel, t.version)
+	}
+	return d.Decode(t)
+}
+
+// Read only view of a transmission for decoders
+
+func (t Transmission) MacAddress() [6]byte            { return t.macAddress }
+func (t Transmission) SensorModel() string            { return t.sensorModel }
+func (t Transmission) DataType() string               { return t.dataType }
+func (t Transmission) SamplingFrequency() uint32      { return t.samplingFrequency }
+func (t Transmission) Timestamp() time.Time           { return t.timestamp }
+func (t Transmission) Version() byte                  { return t.version }
+func (t Transmission) Len() int                       { return t.data.Len() }
+func (t Transmission) Reader() *bufio.Reader          { return t.data.Reader() }
+func (t Transmission) Calibration() model.Calibration { return t.calibration }
+func (t Transmission) VibrationRange() int            { return t.vibrationRange }
+
+// Fields every measurement carries
+func baseMeasurement(t Transmission) map[string]interface{} {
+	return map[string]interface{}{
+		"sensor_id":          model.MacToString(t.macAddress),
+		"time":               t.timestamp,
+		"measurement_type":   t.dataType,
+		"sampling_frequency": t.samplingFrequency,
+	}
+}
+
+func init() {
+	RegisterDecoder("vibration", ANY_MODEL, ANY_VERSION, DecoderFunc(decodeVibration))
+	RegisterDecoder("audio", ANY_MODEL, ANY_VERSION, DecoderFunc(decodeAudio))
+	RegisterDecoder("temperature", "machmo", ANY_VERSION, DecoderFunc(decodeMachMoTemperature))
+	RegisterDecoder("temperature", "machmomini", ANY_VERSION, DecoderFunc(decodeMachMoMiniTemperature))
+	for sensorModel, scale := range FLUX_SCALE {
+		RegisterDecoder("flux", sensorModel, ANY_VERSION, fluxDecoder{scale: scale})
+	}
+}
+
+// Accelerometer json output
+func decodeVibration(t Transmission) ([]map[string]interface{}, error) {
+	scale, ok := model.VIBRATION_SCALE[t.vibrationRange]
+	if !ok {
+		return nil, fmt.Errorf("no scale for an accelerometer range of %d g", t.vibrationRange)
+	}
+	numberOfMeasurements := t.Len() / 6 // 3 axes, 2 bytes per axis => 6 bytes per measurement
+	out.Logger.Println("Vibration data consists of", t.Len(), "bytes =", numberOfMeasurements, "measurements.")
+	x, y, z := make([]float64, numberOfMeasurements), make([]float64, numberOfMeasurements), make([]float64, numberOfMeasurements)
+	reader := t.Reader()
+	sample := make([]byte, 6)
+	for i := 0; i < numberOfMeasurements; i++ {
+		if _, err := io.ReadFull(reader, sample); err != nil {
+			return nil, err
+		}
+		// We're receiving signed integers, of course.
+		x[i] = float64(int16(sample[1])<<8|int16(sample[0]))*scale*t.calibration.AxisGain(0) + t.calibration.Offset[0]
+		y[i] = float64(int16(sample[3])<<8|int16(sample[2]))*scale*t.calibration.AxisGain(1) + t.calibration.Offset[1]
+		z[i] = float64(int16(sample[5])<<8|int16(sample[4]))*scale*t.calibration.AxisGain(2) + t.calibration.Offset[2]
+	}
+
+	measurements := []map[string]interface{}{}
+	for i, values := range [][]float64{x, y, z} {
+		measurement := baseMeasurement(t)
+		measurement["axis"] = model.AXES[i]
+		measurement["raw_data"] = values
+		measurement["range"] = t.vibrationRange
+		measurement["calibration"] = map[string]interface{}{
+			"gain":   t.calibration.AxisGain(i),
+			"offset": t.calibration.Offset[i],
+		}
+		measurements = append(measurements, measurement)
+	}
+	return measurements, nil
+}
+
+// Flux sensor scale of each board model, in millitesla per LSB, as listed in
+// protocol.md. Boards missing here have no flux sensor and are paired without it.
+var FLUX_SCALE = map[string]float64{
+	"machmo": 100.0 / 32768, // +-100 mT full scale over a signed 16 bit reading
+}
+
+// Magnetic flux json output, one signed 16 bit reading per sample
+type fluxDecoder struct {
+	scale float64 // mT per LSB
+}
+
+func (d fluxDecoder) Decode(t Transmission) ([]map[string]interface{}, error) {
+	numberOfMeasurements := t.Len() / 2
+	out.Logger.Println("Flux data consists of", t.Len(), "bytes =", numberOfMeasurements, "measurements.")
+	flux := make([]float64, numberOfMeasurements)
+	reader := t.Reader()
+	sample := make([]byte, 2)
+	for i := 0; i < numberOfMeasurements; i++ {
+		if _, err := io.ReadFull(reader, sample); err != nil {
+			return nil, err
+		}
+		flux[i] = float64(int16(sample[1])<<8|int16(sample[0])) * d.scale
+	}
+
+	measurement := baseMeasurement(t)
+	measurement["raw_data"] = flux
+	measurement["unit"] = "mT"
+	// Nothing to set per unit, the board scale is the whole conversion
+	measurement["calibration"] = map[string]interface{}{
+		"scale": d.scale,
+		"unit":  "mT",
+	}
+	return []map[string]interface{}{measurement}, nil
+}
+
+// Temperature data is a single little endian 16 bit register
+func readTemperatureRegister(t Transmission) (int16, error) {
+	if t.Len() != 2 {
+		return 0, fmt.Errorf("invalid temperature data received, expected 2 bytes but received %d", t.Len())
+	}
+	raw := make([]byte, 2)
+	if _, err := t.data.ReadAt(raw, 0); err != nil {
+		return 0, err
+	}
+	return int16(raw[1])<<8 | int16(raw[0]), nil
+}
+
+// Temperature is a single number in an array
+func temperatureMeasurement(t Transmission, temperature float64) []map[string]interface{} {
+	measurement := baseMeasurement(t)
+	// Has to be an array
+	measurement["raw_data"] = []float64{temperature}
+	return []map[string]interface{}{measurement}
+}
+
+// RTD behind an ADC
+func decodeMachMoTemperature(t Transmission) ([]map[string]interface{}, error) {
+	digitalTemp, err := readTemperatureRegister(t)
+	if err != nil {
+		return nil, err
+	}
+	r_ref, r_0 := t.calibration.RTDReferenceResistor(), t.calibration.RTDNominal()
+	temperature, err := parseTemperatureData(digitalTemp, r_ref, r_0)
+	if err != nil {
+		return nil, err
+	}
+	out.Logger.Println("MachMo temperature reading")
+	measurements := temperatureMeasurement(t, temperature)
+	measurements[0]["calibration"] = map[string]interface{}{
+		"rtd_nominal":   r_0,
+		"rtd_reference": r_ref,
+	}
+	return measurements, nil
+}
+
+// Degrees celsius per LSB of the MachMo mini digital sensor
+const MACHMOMINI_TEMPERATURE_SCALE = 0.0625
+
+// Digital sensor, 1/16 of a degree per LSB
+func decodeMachMoMiniTemperature(t Transmission) ([]map[string]interface{}, error) {
+	digitalTemp, err := readTemperatureRegister(t)
+	if err != nil {
+		return nil, err
+	}
+	temperature := float64(digitalTemp) * MACHMOMINI_TEMPERATURE_SCALE
+	out.Logger.Printf("MachMo mini temperature digital %d celsius %f", digitalTemp, temperature)
+	measurements := temperatureMeasurement(t, temperature)
+	// Factory calibrated sensor, there is no RTD to configure
+	measurements[0]["calibration"] = map[string]interface{}{
+		"scale": MACHMOMINI_TEMPERATURE_SCALE,
+	}
+	return measurements, nil
+}
+
+func decodeAudio(t Transmission) ([]map[string]interface{}, error) {
+	if t.Len()%3 != 0 {
+		return nil, fmt.Errorf("invalid audio data received, packets of length %d not multiple of 3", t.Len())
+	}
+	numberOfMeasurements := t.Len() / 3
+	amplitude := make([]int, numberOfMeasurements)
+	reader := t.Reader()
+	sample := make([]byte, 3)
+	// Collect bytes into 24 bit integers
+	for i := 0; i < numberOfMeasurements; i++ {
+		if _, err := io.ReadFull(reader, sample); err != nil {
+			return nil, err
+		}
+		// Data is sent as left aligned, little endian uint32 bytes
+		// NOTE: this is how OpenPHM expects the bytes to be assembled. Flipped.
+		amplitude[i] = int(sample[0])<<16 | int(sample[1])<<8 | int(sample[2])
+	}
+
+	// NOTE: The mic sensor sends some zeros at the beginning, we want to eliminate those
+	for i, amp := range amplitude {
+		if i > 512 {
+			break
+		}
+		if amp != 0 {
+			// First non-zero byte found
+			amplitude = amplitude[i:]
+			break
+		}
+	}
+
+	measurement := baseMeasurement(t)
+	measurement["raw_data"] = amplitude
+	if sensitivity := t.calibration.MicSensitivity; sensitivity != 0 {
+		// Full scale sample in Pa, the sensitivity is the level of 1 Pa (94 dB SPL)
+		fullScale := math.Pow(10, -sensitivity/20)
+		pressure := make([]float64, len(amplitude))
+		for i, amp := range amplitude {
+			// Sign extend the 24 bit sample
+			signed := int32(uint32(amp)<<8) >> 8
+			pressure[i] = float64(signed) / (1 << 23) * fullScale
+		}
+		measurement["raw_data"] = pressure
+		measurement["calibration"] = map[string]interface{}{
+			"mic_sensitivity": sensitivity,
+			"unit":            "Pa",
+		}
+	}
+	return []map[string]interface{}{measurement}, nil
+}
@@ -0,0 +1,43 @@
+package server
+
+/*
+ * A sink that takes every file without sending it anywhere, what the simulator
+ * uploads to so synthetic captures never reach a real endpoint
+ */
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+// No options
+type dryrunSink struct {
+	name string
+}
+
+func init() {
+	RegisterSinkType("dryrun", newDryrunSink)
+}
+
+func newDryrunSink(config model.SinkConfig, gateway *model.Gateway) (Sink, error) {
+	for option := range config.Options {
+		return nil, errors.New("option " + option + " doesn't exist for dryrun sinks (they have none)")
+	}
+	return &dryrunSink{name: config.Name}, nil
+}
+
+func (s *dryrunSink) Send(jsonData []byte) error {
+	measurements := []map[string]interface{}{}
+	if err := json.Unmarshal(jsonData, &measurements); err != nil {
+		return err
+	}
+	out.Logger.Println("Sink", s.name, "would have sent", len(measurements), "measurements")
+	return nil
+}
+
+func (s *dryrunSink) Close() error {
+	return nil
+}
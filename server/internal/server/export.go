@@ -0,0 +1,629 @@
+package server
+
+/*
+ * Export of captures to files analysts open in their own tools: CSV, WAV for
+ * audio and NumPy arrays, next to a manifest.json describing the sensor and
+ * calibration of each one. Captures come from the measurement store (pending
+ * and archived files) or are decoded again from the raw debug captures.
+ */
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+)
+
+const EXPORT_MANIFEST = "manifest.json"
+
+var EXPORT_FORMATS = []string{"csv", "wav", "npy"}
+
+// Where exported captures are read from, see ExportRequest
+var EXPORT_SOURCES = []string{"measurements", "debug"}
+
+// Unit of raw_data of each data type when the measurement doesn't say
+var EXPORT_UNITS = map[string]string{
+	"vibration":   "g",
+	"temperature": "°C",
+	"flux":        "mT",
+	"audio":       "counts (signed 24 bit)",
+}
+
+// Time in exported file names, sorts like the captures
+const EXPORT_TIME_FORMAT = "20060102T150405.000Z"
+
+// Zero values match everything, like MeasurementQuery
+type ExportRequest struct {
+	Format   string    // One of EXPORT_FORMATS
+	Source   string    // One of EXPORT_SOURCES, measurements if empty
+	Sensor   string    // MAC address
+	DataType string    //
+	From     time.Time //
+	To       time.Time //
+	Dir      string    // Absolute, created if missing
+}
+
+type ExportedSensor struct {
+	Id    string `json:"id"` // MAC address
+	Name  string `json:"name"`
+	Model string `json:"model"`
+}
+
+// A capture as described in the manifest
+type ExportedCapture struct {
+	File              string                 `json:"file"`                     // Relative to the manifest
+	Id                string                 `json:"measurement_id,omitempty"` // Empty for files saved before there was one
+	Sensor            ExportedSensor         `json:"sensor"`                   //
+	DataType          string                 `json:"measurement_type"`         //
+	Time              time.Time              `json:"time"`                     // Start of the transmission
+	SamplingFrequency float64                `json:"sampling_frequency"`       // Hz
+	Samples           int                    `json:"samples"`                  // Rows in File, 1 for a reading of a series
+	Columns           []string               `json:"columns"`                  // Of File, in order
+	Unit              string                 `json:"unit"`                     // Of the samples
+	Calibration       map[string]interface{} `json:"calibration,omitempty"`    // Applied by the decoder, by column
+	Range             int                    `json:"range,omitempty"`          // g, vibration only
+	FullScale         float64                `json:"full_scale,omitempty"`     // wav only, Unit of the largest sample
+	Partial           bool                   `json:"partial,omitempty"`        // Only the part of the transfer that could be salvaged
+	Source            string                 `json:"source"`                   // File it was read from
+}
+
+type SkippedCapture struct {
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+}
+
+type ExportManifest struct {
+	Format    string            `json:"format"`
+	Source    string            `json:"source"`
+	Dir       string            `json:"dir"`
+	Exported  time.Time         `json:"exported"`
+	GatewayId string            `json:"gateway_id"`
+	Sensor    string            `json:"sensor,omitempty"` // Filters of the request
+	DataType  string            `json:"measurement_type,omitempty"`
+	From      *time.Time        `json:"from,omitempty"`
+	To        *time.Time        `json:"to,omitempty"`
+	Files     []string          `json:"files"` // Written, relative to Dir
+	Captures  []ExportedCapture `json:"captures"`
+	Skipped   []SkippedCapture  `json:"skipped"`
+}
+
+// Decoded samples of one capture, one column per axis
+type exportCapture struct {
+	ExportedCapture
+	data [][]float64 // By column
+}
+
+// Readings of single sample captures, exported as one file per sensor and type
+type exportSeries struct {
+	capture ExportedCapture // Of the first reading
+	times   []time.Time
+	values  []float64
+}
+
+type exporter struct {
+	manifest ExportManifest
+	series   map[string]*exportSeries // By file
+}
+
+// Write the captures matching the request to request.Dir, with a manifest
+func Export(request ExportRequest) (ExportManifest, error) {
+	if request.Source == "" {
+		request.Source = "measurements"
+	}
+	if !slices.Contains(EXPORT_FORMATS, request.Format) {
+		return ExportManifest{}, errors.New("invalid export format " + request.Format + " (must be one of " + strings.Join(EXPORT_FORMATS, ", ") + ")")
+	}
+	if !slices.Contains(EXPORT_SOURCES, request.Source) {
+		return ExportManifest{}, errors.New("invalid export source " + request.Source + " (must be one of " + strings.Join(EXPORT_SOURCES, ", ") + ")")
+	}
+	if !filepath.IsAbs(request.Dir) {
+		return ExportManifest{}, errors.New("invalid export directory " + request.Dir + " (must be an absolute path)")
+	}
+	if _, err := os.Stat(path.Join(request.Dir, EXPORT_MANIFEST)); err == nil {
+		return ExportManifest{}, errors.New(request.Dir + " already holds an export")
+	}
+
+	e := exporter{
+		manifest: ExportManifest{
+			Format:    request.Format,
+			Source:    request.Source,
+			Dir:       request.Dir,
+			Exported:  time.Now(),
+			GatewayId: model.GatewaySettings(Gateway).Id,
+			Sensor:    request.Sensor,
+			DataType:  request.DataType,
+			Files:     []string{},
+			Captures:  []ExportedCapture{},
+			Skipped:   []SkippedCapture{},
+		},
+		series: map[string]*exportSeries{},
+	}
+	if !request.From.IsZero() {
+		e.manifest.From = &request.From
+	}
+	if !request.To.IsZero() {
+		e.manifest.To = &request.To
+	}
+
+	var sources []string
+	var load func(string) ([]exportCapture, error)
+	var err error
+	if request.Source == "debug" {
+		sources, err = e.debugCaptures(request)
+		load = loadDebugCapture
+	} else {
+		sources, err = e.measurementFiles(request)
+		load = loadMeasurementFile
+	}
+	if err != nil {
+		return ExportManifest{}, err
+	}
+	if len(sources) == 0 {
+		return ExportManifest{}, errors.New("no captures match")
+	}
+	if err := os.MkdirAll(request.Dir, dirPermCode); err != nil {
+		return ExportManifest{}, err
+	}
+
+	for _, source := range sources {
+		captures, err := load(source)
+		if err != nil {
+			e.skip(source, err.Error())
+			continue
+		}
+		for _, capture := range captures {
+			if request.DataType != "" && capture.DataType != request.DataType {
+				continue
+			}
+			if err := e.write(capture); err != nil {
+				return e.manifest, err
+			}
+		}
+	}
+	if err := e.writeSeries(); err != nil {
+		return e.manifest, err
+	}
+
+	jsonStr, err := json.MarshalIndent(e.manifest, "", "\t")
+	if err != nil {
+		return e.manifest, err
+	}
+	return e.manifest, os.WriteFile(path.Join(request.Dir, EXPORT_MANIFEST), jsonStr, filePermCode)
+}
+
+func (e *exporter) skip(source string, reason string) {
+	e.manifest.Skipped = append(e.manifest.Skipped, SkippedCapture{Source: source, Reason: reason})
+}
+
+// Measurement files in the store matching the request, oldest first
+func (e *exporter) measurementFiles(request ExportRequest) ([]string, error) {
+	results, err := QueryMeasurements(MeasurementQuery{
+		Sensor:   request.Sensor,
+		DataType: request.DataType,
+		From:     request.From,
+		To:       request.To,
+		Limit:    -1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	seen := map[string]bool{}
+	for i := len(results) - 1; i >= 0; i-- {
+		result := results[i]
+		if seen[result.File] {
+			continue
+		}
+		seen[result.File] = true
+		if result.Path == "" {
+			e.skip(result.File, "pruned")
+		} else {
+			files = append(files, result.Path)
+		}
+	}
+	return files, nil
+}
+
+// Sidecars of the debug captures matching the request, oldest first
+func (e *exporter) debugCaptures(request ExportRequest) ([]string, error) {
+	entries, err := os.ReadDir(debugDataDir())
+	if err != nil {
+		return nil, err
+	}
+	to := request.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	type sidecar struct {
+		path string
+		time time.Time
+	}
+	sidecars := []sidecar{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		if base, ok := strings.CutSuffix(name, ".bin"); ok {
+			if _, err := os.Stat(path.Join(debugDataDir(), base+".json")); errors.Is(err, os.ErrNotExist) {
+				e.skip(path.Join(debugDataDir(), name), "no metadata, saved before debug captures had one")
+			}
+			continue
+		}
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		jsonStr, err := os.ReadFile(path.Join(debugDataDir(), name))
+		if err != nil {
+			continue
+		}
+		metadata := CaptureMetadata{}
+		if err := json.Unmarshal(jsonStr, &metadata); err != nil {
+			continue
+		}
+		if request.Sensor != "" && !strings.EqualFold(metadata.SensorId, request.Sensor) {
+			continue
+		}
+		if request.DataType != "" && metadata.DataType != request.DataType {
+			continue
+		}
+		if metadata.Time.Before(request.From) || metadata.Time.After(to) {
+			continue
+		}
+		sidecars = append(sidecars, sidecar{path: path.Join(debugDataDir(), name), time: metadata.Time})
+	}
+	slices.SortFunc(sidecars, func(a, b sidecar) int {
+		return a.time.Compare(b.time)
+	})
+	paths := []string{}
+	for _, s := range sidecars {
+		paths = append(paths, s.path)
+	}
+	return paths, nil
+}
+
+// Captures of a measurement file of the unsent, sent or rejected folder
+func loadMeasurementFile(file string) ([]exportCapture, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) && measurementPath(path.Base(file)) != "" {
+		// Uploaded or rejected since the query
+		file = measurementPath(path.Base(file))
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	measurements := []map[string]interface{}{}
+	if err := json.Unmarshal(data, &measurements); err != nil {
+		return nil, err
+	}
+	return exportCaptures(file, measurements), nil
+}
+
+// Decode a debug capture again from its sidecar
+func loadDebugCapture(sidecar string) ([]exportCapture, error) {
+	capture := Capture{Path: strings.TrimSuffix(sidecar, ".json") + ".bin"}
+	jsonStr, err := os.ReadFile(sidecar)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(jsonStr, &capture.Metadata); err != nil {
+		return nil, err
+	}
+	if capture.Metadata.Corrupt != "" {
+		return nil, errors.New("corrupt: " + capture.Metadata.Corrupt)
+	}
+	t, err := captureTransmission(capture)
+	if err != nil {
+		return nil, err
+	}
+	defer t.data.Release()
+	measurements, err := decode(t)
+	if err != nil {
+		return nil, err
+	}
+	for _, measurement := range measurements {
+		measurement["measurement_id"] = t.id
+		if t.partial {
+			measurement["partial"] = true
+		}
+	}
+	captures := exportCaptures(capture.Path, measurements)
+	for i := range captures {
+		captures[i].Sensor.Model = capture.Metadata.SensorModel
+		if captures[i].Sensor.Name == "" {
+			captures[i].Sensor.Name = capture.Metadata.SensorName
+		}
+	}
+	return captures, nil
+}
+
+// Measurements of a transmission, decoded or read back from json, as one
+// capture per data type with a column per axis
+func exportCaptures(source string, measurements []map[string]interface{}) []exportCapture {
+	captures := []exportCapture{}
+	for _, measurement := range measurements {
+		record, ok := storedMeasurement(path.Base(source), measurement)
+		if !ok {
+			continue
+		}
+		i := slices.IndexFunc(captures, func(c exportCapture) bool { return c.DataType == record.DataType })
+		if i == -1 {
+			captures = append(captures, exportCapture{ExportedCapture: ExportedCapture{
+				Id:                record.Id,
+				Sensor:            ExportedSensor{Id: record.Sensor},
+				DataType:          record.DataType,
+				Time:              record.Time,
+				SamplingFrequency: record.SamplingFrequency,
+				Columns:           []string{},
+				Unit:              EXPORT_UNITS[record.DataType],
+				Source:            source,
+			}})
+			i = len(captures) - 1
+			if mac, err := model.StringToMac(record.Sensor); err == nil {
+				if sensor := sensorExists(mac); sensor != nil {
+					captures[i].Sensor.Name = sensor.Name
+					captures[i].Sensor.Model = sensor.Model
+				}
+			}
+		}
+		capture := &captures[i]
+
+		column := record.DataType
+		if record.Axis != "" {
+			column = record.Axis
+		}
+		samples := toFloats(measurement["raw_data"])
+		calibration, _ := measurement["calibration"].(map[string]interface{})
+		if unit, ok := calibration["unit"].(string); ok {
+			capture.Unit = unit
+		} else if record.DataType == "audio" {
+			// Left aligned 24 bit samples, as sent to OpenPHM
+			for j, sample := range samples {
+				samples[j] = float64(int32(uint32(sample)<<8) >> 8)
+			}
+		}
+		if calibration != nil {
+			if capture.Calibration == nil {
+				capture.Calibration = map[string]interface{}{}
+			}
+			capture.Calibration[column] = calibration
+		}
+		if vibrationRange, ok := toFloat(measurement["range"]); ok {
+			capture.Range = int(vibrationRange)
+		}
+		if partial, _ := measurement["partial"].(bool); partial {
+			capture.Partial = true
+		}
+		capture.Columns = append(capture.Columns, column)
+		capture.data = append(capture.data, samples)
+		capture.Samples = max(capture.Samples, len(samples))
+	}
+	return captures
+}
+
+// Name of the files of a capture, without extension
+func exportName(capture exportCapture) string {
+	name := strings.ReplaceAll(capture.Sensor.Id, ":", "") + "_" + capture.DataType
+	if capture.Samples <= 1 {
+		return name
+	}
+	name += "_" + capture.Time.UTC().Format(EXPORT_TIME_FORMAT)
+	if len(capture.Id) >= 8 {
+		name += "_" + capture.Id[:8]
+	}
+	return name
+}
+
+func (e *exporter) write(capture exportCapture) error {
+	if capture.Samples == 0 {
+		e.skip(capture.Source, "no samples")
+		return nil
+	}
+	if e.manifest.Format == "wav" && capture.DataType != "audio" {
+		e.skip(capture.Source, "wav is for audio only")
+		return nil
+	}
+	if capture.Samples == 1 {
+		e.addToSeries(capture)
+		return nil
+	}
+
+	var err error
+	capture.File = exportName(capture) + "." + e.manifest.Format
+	file := path.Join(e.manifest.Dir, capture.File)
+	switch e.manifest.Format {
+	case "csv":
+		columns := append([]string{"time"}, capture.Columns...)
+		if capture.SamplingFrequency <= 0 {
+			columns[0] = "sample"
+		}
+		err = writeCSV(file, columns, capture.Samples, func(row int) []string {
+			record := []string{formatFloat(float64(row))}
+			if capture.SamplingFrequency > 0 {
+				record[0] = formatFloat(float64(row) / capture.SamplingFrequency)
+			}
+			for _, column := range capture.data {
+				record = append(record, sampleString(column, row))
+			}
+			return record
+		})
+		capture.Columns = columns
+	case "npy":
+		err = writeNpy(file, capture.data, capture.Samples)
+	case "wav":
+		if capture.SamplingFrequency <= 0 || capture.SamplingFrequency > math.MaxUint32 {
+			e.skip(capture.Source, "no sampling frequency")
+			return nil
+		}
+		scale := 1.0
+		if sensitivity, ok := toFloat(audioCalibration(capture)["mic_sensitivity"]); ok {
+			// Back to the samples as the microphone sent them, see decodeAudio
+			capture.FullScale = math.Pow(10, -sensitivity/20)
+			scale = (1 << 23) / capture.FullScale
+		} else {
+			capture.FullScale = 1 << 23
+		}
+		err = writeWav(file, uint32(capture.SamplingFrequency), capture.data[0], scale)
+	}
+	if err != nil {
+		return err
+	}
+	e.manifest.Files = append(e.manifest.Files, capture.File)
+	e.manifest.Captures = append(e.manifest.Captures, capture.ExportedCapture)
+	return nil
+}
+
+func audioCalibration(capture exportCapture) map[string]interface{} {
+	calibration, _ := capture.Calibration["audio"].(map[string]interface{})
+	return calibration
+}
+
+// Single readings go in one file per sensor and type, a row each
+func (e *exporter) addToSeries(capture exportCapture) {
+	capture.File = exportName(capture) + "." + e.manifest.Format
+	series, ok := e.series[capture.File]
+	if !ok {
+		series = &exportSeries{capture: capture.ExportedCapture}
+		e.series[capture.File] = series
+		e.manifest.Files = append(e.manifest.Files, capture.File)
+	}
+	series.times = append(series.times, capture.Time)
+	series.values = append(series.values, capture.data[0][0])
+	if e.manifest.Format == "csv" {
+		capture.Columns = []string{"time", capture.DataType}
+	} else {
+		capture.Columns = []string{"unix_time", capture.DataType}
+	}
+	e.manifest.Captures = append(e.manifest.Captures, capture.ExportedCapture)
+}
+
+func (e *exporter) writeSeries() error {
+	for file, series := range e.series {
+		var err error
+		switch e.manifest.Format {
+		case "csv":
+			err = writeCSV(path.Join(e.manifest.Dir, file), []string{"time", series.capture.DataType}, len(series.values), func(row int) []string {
+				return []string{series.times[row].Format(time.RFC3339Nano), formatFloat(series.values[row])}
+			})
+		case "npy":
+			times := make([]float64, len(series.times))
+			for i, t := range series.times {
+				times[i] = float64(t.UnixNano()) / 1e9
+			}
+			err = writeNpy(path.Join(e.manifest.Dir, file), [][]float64{times, series.values}, len(series.values))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatFloat(number float64) string {
+	return strconv.FormatFloat(number, 'g', -1, 64)
+}
+
+// Empty past the end of a shorter column
+func sampleString(column []float64, row int) string {
+	if row >= len(column) {
+		return ""
+	}
+	return formatFloat(column[row])
+}
+
+func writeCSV(file string, header []string, rows int, row func(int) []string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePermCode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	writer := csv.NewWriter(bufio.NewWriter(f))
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for i := 0; i < rows; i++ {
+		if err := writer.Write(row(i)); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return errors.Join(writer.Error(), f.Close())
+}
+
+// NumPy .npy version 1.0, float64 of shape (rows, len(columns)), NaN past
+// the end of a shorter column
+func writeNpy(file string, columns [][]float64, rows int) error {
+	header := fmt.Sprintf("{'descr': '<f8', 'fortran_order': False, 'shape': (%d, %d), }", rows, len(columns))
+	// Magic, version and header length take 10 bytes, the data starts 64 byte aligned
+	padding := 63 - (10+len(header))%64
+	header += strings.Repeat(" ", padding) + "\n"
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePermCode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+	writer.WriteString("\x93NUMPY\x01\x00")
+	binary.Write(writer, binary.LittleEndian, uint16(len(header)))
+	writer.WriteString(header)
+	value := make([]byte, 8)
+	for row := 0; row < rows; row++ {
+		for _, column := range columns {
+			sample := math.NaN()
+			if row < len(column) {
+				sample = column[row]
+			}
+			binary.LittleEndian.PutUint64(value, math.Float64bits(sample))
+			if _, err := writer.Write(value); err != nil {
+				return err
+			}
+		}
+	}
+	return errors.Join(writer.Flush(), f.Close())
+}
+
+// Mono 24 bit PCM, samples multiplied by scale and clipped to 24 bits
+func writeWav(file string, sampleRate uint32, samples []float64, scale float64) error {
+	dataLength := uint32(len(samples) * 3)
+	pad := dataLength % 2
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePermCode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+	writer.WriteString("RIFF")
+	binary.Write(writer, binary.LittleEndian, 36+dataLength+pad)
+	writer.WriteString("WAVEfmt ")
+	binary.Write(writer, binary.LittleEndian, []uint32{16})
+	binary.Write(writer, binary.LittleEndian, []uint16{1, 1}) // PCM, mono
+	binary.Write(writer, binary.LittleEndian, []uint32{sampleRate, sampleRate * 3})
+	binary.Write(writer, binary.LittleEndian, []uint16{3, 24}) // Block align, bits per sample
+	writer.WriteString("data")
+	binary.Write(writer, binary.LittleEndian, dataLength)
+	for _, sample := range samples {
+		value := int32(max(min(math.Round(sample*scale), 1<<23-1), -1<<23))
+		if _, err := writer.Write([]byte{byte(value), byte(value >> 8), byte(value >> 16)}); err != nil {
+			return err
+		}
+	}
+	if pad == 1 {
+		writer.WriteByte(0)
+	}
+	return errors.Join(writer.Flush(), f.Close())
+}
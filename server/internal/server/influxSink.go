@@ -0,0 +1,308 @@
+package server
+
+/*
+ * Writing scalar measurements and sensor health as InfluxDB line protocol,
+ * to an InfluxDB v2 write endpoint or to a file
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+)
+
+// Options of influx sinks, "url" or "file" is required:
+//   - url: InfluxDB v2 server, eg.: http://localhost:8086
+//   - org, bucket, token: where to write on that server
+//   - file: append the lines to this file instead
+//   - waveforms: true to also write raw arrays, one point per sample
+var INFLUX_OPTIONS = []string{"url", "org", "bucket", "token", "file", "waveforms"}
+
+// Measurement fields that describe a capture rather than measure something,
+// every other number or boolean is written as a field (eg.: computed features)
+var INFLUX_METADATA = []string{"sensor_id", "time", "measurement_type", "sampling_frequency", "axis",
+	"raw_data", "battery_level", "range", "calibration", "partial", "received_bytes", "expected_bytes"}
+
+type influxSink struct {
+	gateway   *model.Gateway
+	writeURL  string // Empty when writing to file
+	token     string
+	file      string
+	waveforms bool
+	fileMutex sync.Mutex
+}
+
+func init() {
+	RegisterSinkType("influx", newInfluxSink)
+}
+
+func newInfluxSink(config model.SinkConfig, gateway *model.Gateway) (Sink, error) {
+	for option := range config.Options {
+		if !slices.Contains(INFLUX_OPTIONS, option) {
+			return nil, errors.New("option " + option + " doesn't exist for influx sinks (must be one of " + strings.Join(INFLUX_OPTIONS, ", ") + ")")
+		}
+	}
+	s := &influxSink{
+		gateway: gateway,
+		token:   config.Options["token"],
+		file:    config.Options["file"],
+	}
+	if value, ok := config.Options["waveforms"]; ok {
+		var err error
+		s.waveforms, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("invalid value for option waveforms (must be true or false)")
+		}
+	}
+
+	base := config.Options["url"]
+	if (base == "") == (s.file == "") {
+		return nil, errors.New("influx sinks need exactly one of the options url and file")
+	}
+	if base != "" {
+		if config.Options["bucket"] == "" {
+			return nil, errors.New("option bucket is required to write to an InfluxDB server")
+		}
+		u, err := url.Parse(base)
+		if err != nil {
+			return nil, err
+		}
+		u = u.JoinPath("/api/v2/write")
+		u.RawQuery = url.Values{
+			"org":       {config.Options["org"]},
+			"bucket":    {config.Options["bucket"]},
+			"precision": {"ns"},
+		}.Encode()
+		s.writeURL = u.String()
+	}
+	return s, nil
+}
+
+func (s *influxSink) Send(jsonData []byte) error {
+	measurements := []map[string]interface{}{}
+	err := json.Unmarshal(jsonData, &measurements)
+	if err != nil {
+		return err
+	}
+
+	lines := []string{}
+	sensors := []string{}
+	for _, measurement := range measurements {
+		lines = append(lines, s.measurementLines(measurement)...)
+		if sensor, ok := measurement["sensor_id"].(string); ok && !slices.Contains(sensors, sensor) {
+			sensors = append(sensors, sensor)
+			// Once per sensor, all measurements of a capture carry the same level
+			if level, ok := measurement["battery_level"].(float64); ok {
+				lines = append(lines, influxLine("battery", influxTags(sensor, nil), []string{"level=" + formatInfluxFloat(level)}, influxTime(measurement)))
+			}
+		}
+	}
+	for _, sensor := range sensors {
+		lines = append(lines, sensorStatusLine(sensor, nil))
+	}
+	return s.write(lines)
+}
+
+// Connection changes as a point of the sensor_status series
+func (s *influxSink) SendStatus(event string, mac [6]byte) error {
+	connected := event == "SENSOR-CONNECTED"
+	return s.write([]string{sensorStatusLine(model.MacToString(mac), &connected)})
+}
+
+// Scalars of a measurement, and its waveform if enabled
+func (s *influxSink) measurementLines(measurement map[string]interface{}) []string {
+	sensor, _ := measurement["sensor_id"].(string)
+	dataType, _ := measurement["measurement_type"].(string)
+	if sensor == "" || dataType == "" {
+		return nil
+	}
+	extraTags := map[string]string{}
+	if axis, ok := measurement["axis"].(string); ok {
+		extraTags["axis"] = axis
+	}
+	tags := influxTags(sensor, extraTags)
+	timestamp := influxTime(measurement)
+
+	fields := []string{}
+	for _, key := range sortedKeys(measurement) {
+		if slices.Contains(INFLUX_METADATA, key) {
+			continue
+		}
+		switch value := measurement[key].(type) {
+		case float64:
+			fields = append(fields, escapeInfluxKey(key)+"="+formatInfluxFloat(value))
+		case bool:
+			fields = append(fields, escapeInfluxKey(key)+"="+strconv.FormatBool(value))
+		}
+	}
+
+	lines := []string{}
+	raw, _ := measurement["raw_data"].([]interface{})
+	if len(raw) == 1 {
+		// Temperature and other single readings
+		if value, ok := raw[0].(float64); ok {
+			fields = append([]string{"value=" + formatInfluxFloat(value)}, fields...)
+		}
+	} else if len(raw) > 1 && s.waveforms {
+		frequency, _ := measurement["sampling_frequency"].(float64)
+		if frequency > 0 {
+			for i, sample := range raw {
+				if value, ok := sample.(float64); ok {
+					at := timestamp + int64(float64(i)*1e9/frequency)
+					lines = append(lines, influxLine(dataType+"_waveform", tags, []string{"value=" + formatInfluxFloat(value)}, at))
+				}
+			}
+		}
+	}
+	if len(fields) > 0 {
+		lines = append(lines, influxLine(dataType, tags, fields, timestamp))
+	}
+	return lines
+}
+
+// Last seen, activity and transfer counters of a sensor, now
+func sensorStatusLine(sensor string, connected *bool) string {
+	fields := []string{}
+	if connected != nil {
+		fields = append(fields, "connected="+strconv.FormatBool(*connected))
+	}
+	if mac, err := model.StringToMac(sensor); err == nil {
+		if s := sensorExists(mac); s != nil {
+			seen := s.FetchLastSeen()
+			if !seen.LastSeen.IsZero() {
+				fields = append(fields, "last_seen="+strconv.FormatInt(seen.LastSeen.Unix(), 10)+"i",
+					"activity="+strconv.Quote(string(seen.LastActivity)))
+			}
+		}
+	}
+	if stats, ok := TransferStatistics()[sensor]; ok {
+		// Same names as TRANSFER-STATS
+		var counters map[string]int
+		jsonStr, _ := json.Marshal(stats)
+		json.Unmarshal(jsonStr, &counters)
+		for _, key := range sortedKeys(counters) {
+			fields = append(fields, key+"="+strconv.Itoa(counters[key])+"i")
+		}
+	}
+	if len(fields) == 0 {
+		fields = append(fields, "known=false")
+	}
+	return influxLine("sensor_status", influxTags(sensor, nil), fields, time.Now().UnixNano())
+}
+
+// sensor, name and model tags, plus extra ones
+func influxTags(sensor string, extra map[string]string) map[string]string {
+	tags := map[string]string{"sensor": sensor}
+	if mac, err := model.StringToMac(sensor); err == nil {
+		if s := sensorExists(mac); s != nil {
+			if s.Name != "" {
+				tags["name"] = s.Name
+			}
+			if s.Model != "" {
+				tags["model"] = s.Model
+			}
+		}
+	}
+	for k, v := range extra {
+		tags[k] = v
+	}
+	return tags
+}
+
+// Capture time in nanoseconds, now if the measurement has none
+func influxTime(measurement map[string]interface{}) int64 {
+	if str, ok := measurement["time"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, str); err == nil {
+			return t.UnixNano()
+		}
+	}
+	return time.Now().UnixNano()
+}
+
+func influxLine(name string, tags map[string]string, fields []string, timestamp int64) string {
+	line := strings.NewReplacer(",", "\\,", " ", "\\ ").Replace(name)
+	for _, key := range sortedKeys(tags) {
+		if tags[key] != "" {
+			line += "," + escapeInfluxKey(key) + "=" + escapeInfluxKey(tags[key])
+		}
+	}
+	return line + " " + strings.Join(fields, ",") + " " + strconv.FormatInt(timestamp, 10)
+}
+
+// Tag keys, tag values and field keys escape commas, equal signs and spaces
+func escapeInfluxKey(str string) string {
+	return strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ").Replace(str)
+}
+
+func formatInfluxFloat(f float64) string {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "0"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (s *influxSink) write(lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	body := strings.Join(lines, "\n") + "\n"
+
+	if s.writeURL == "" {
+		s.fileMutex.Lock()
+		defer s.fileMutex.Unlock()
+		file, err := os.OpenFile(s.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, filePermCode)
+		if err != nil {
+			return err
+		}
+		_, err = file.WriteString(body)
+		return errors.Join(err, file.Close())
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.writeURL, bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	client, err := s.gateway.HTTPClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, model.HTTP_ERROR_BODY_LIMIT))
+		return &model.HTTPError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return nil
+}
+
+func (s *influxSink) Close() error {
+	return nil
+}
@@ -0,0 +1,265 @@
+package server
+
+/*
+ * Keeps archived, debug and rejected data within their retention policies,
+ * oldest files first. unsent_data is never pruned, and once free disk falls
+ * under the reserve nothing else is written so what's left goes to the
+ * measurements not uploaded yet.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+const JANITOR_INTERVAL = 10 * time.Minute
+
+// Usage of a data directory, as shown by "view --storage"
+type StorageStatus struct {
+	Name        string                 `json:"name"`             // unsent or one of model.RETENTION_DIRS
+	Path        string                 `json:"path"`             //
+	Files       int                    `json:"files"`            //
+	Bytes       int64                  `json:"bytes"`            //
+	Oldest      time.Time              `json:"oldest"`           // Zero if empty
+	FreeBytes   int64                  `json:"free_bytes"`       // On the disk holding it
+	Policy      *model.RetentionPolicy `json:"policy,omitempty"` // nil for unsent, never pruned
+	Pruned      int                    `json:"pruned"`           // Files deleted since startup
+	PrunedBytes int64                  `json:"pruned_bytes"`     //
+}
+
+type DiskStatus struct {
+	Dirs         []StorageStatus `json:"dirs"`
+	ReserveBytes int64           `json:"reserve_bytes"`
+	Refusing     bool            `json:"refusing"` // Only unsent data is written
+	LastPrune    time.Time       `json:"last_prune"`
+}
+
+type storedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+type pruneStats struct {
+	files int
+	bytes int64
+}
+
+var prunedByDir = map[string]pruneStats{}
+var lastPrune time.Time
+var janitorMutex sync.Mutex
+
+// Whether writes are refused, to log the changes only
+var refusingWrites bool
+var refusingMutex sync.Mutex
+
+func startJanitor() {
+	for {
+		PruneStorage()
+		time.Sleep(JANITOR_INTERVAL)
+	}
+}
+
+func retentionDir(name string) string {
+	switch name {
+	case "debug":
+		return debugDataDir()
+	case "sent":
+		return archivedDataDir()
+	case "rejected":
+		return rejectedDataDir()
+	}
+	return unsentDataDir()
+}
+
+// Every file under dir, oldest first
+func storedFiles(dir string) ([]storedFile, error) {
+	files := []storedFile{}
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// Uploaded or pruned meanwhile
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		files = append(files, storedFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	slices.SortFunc(files, func(a, b storedFile) int {
+		return a.modTime.Compare(b.modTime)
+	})
+	return files, err
+}
+
+// Bytes available to the server on the disk holding dir
+func freeDisk(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// Apply the retention policy of every directory now
+func PruneStorage() {
+	janitorMutex.Lock()
+	defer janitorMutex.Unlock()
+	for _, name := range model.RETENTION_DIRS {
+		pruneDir(name, Gateway.RetentionFor(name))
+	}
+	lastPrune = time.Now()
+}
+
+// Caller holds janitorMutex
+func pruneDir(name string, policy model.RetentionPolicy) {
+	dir := retentionDir(name)
+	files, err := storedFiles(dir)
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
+	total := int64(0)
+	for _, file := range files {
+		total += file.size
+	}
+	free, err := freeDisk(dir)
+	if err != nil {
+		out.Logger.Println("Error:", err)
+		policy.MinFree = 0
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -policy.MaxAge)
+	stats := prunedByDir[name]
+	for _, file := range files {
+		expired := policy.MaxAge > 0 && file.modTime.Before(cutoff)
+		tooLarge := policy.MaxSize > 0 && total > int64(policy.MaxSize)<<20
+		tooFull := policy.MinFree > 0 && free < int64(policy.MinFree)<<20
+		if !expired && !tooLarge && !tooFull {
+			// The next ones are newer
+			break
+		}
+		measurements := prunedMeasurements(dir, file.path)
+		if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			out.Logger.Println("Error:", err)
+			continue
+		}
+		if name := filepath.Base(file.path); measurements != nil && measurementPath(name) == "" {
+			if err := markPrunedMeasurements(name, measurements); err != nil {
+				out.Logger.Println("Error:", err)
+			}
+		}
+		total -= file.size
+		free += file.size
+		stats.files++
+		stats.bytes += file.size
+	}
+	if stats != prunedByDir[name] {
+		out.Logger.Println("Pruned", stats.files-prunedByDir[name].files, "files from", dir)
+		prunedByDir[name] = stats
+		if name == "rejected" {
+			dropMissingRejected()
+		}
+	}
+}
+
+// Measurements of a file about to be pruned from dir, nil if it isn't a
+// measurements file. Raw captures are in a folder of their own.
+func prunedMeasurements(dir string, file string) []map[string]interface{} {
+	if filepath.Dir(file) != filepath.Clean(dir) || filepath.Ext(file) != ".json" {
+		return nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	measurements := []map[string]interface{}{}
+	if err := json.Unmarshal(data, &measurements); err != nil {
+		return nil
+	}
+	return measurements
+}
+
+// Whether free disk under dir is below the reserve, in which case only unsent
+// data may be written there. what is logged when this starts.
+func diskReserved(dir string, what string) bool {
+	free, err := freeDisk(dir)
+	if err != nil {
+		return false
+	}
+	reserved := free < int64(Gateway.DiskReserveMiB())<<20
+
+	refusingMutex.Lock()
+	changed := reserved != refusingWrites
+	refusingWrites = reserved
+	refusingMutex.Unlock()
+	if changed && reserved {
+		out.Logger.Println("Free disk under the reserve of", Gateway.DiskReserveMiB(), "MiB, not writing", what, "or anything but unsent data")
+		out.Broadcast("DISK-LOW")
+		go PruneStorage()
+	} else if changed {
+		out.Logger.Println("Free disk back above the reserve of", Gateway.DiskReserveMiB(), "MiB")
+	}
+	return reserved
+}
+
+// Usage of every data directory, unsent first
+func StorageUsage() DiskStatus {
+	janitorMutex.Lock()
+	defer janitorMutex.Unlock()
+	status := DiskStatus{
+		Dirs:         []StorageStatus{},
+		ReserveBytes: int64(Gateway.DiskReserveMiB()) << 20,
+		LastPrune:    lastPrune,
+	}
+	for _, name := range append([]string{"unsent"}, model.RETENTION_DIRS...) {
+		dir := storageStatus(name)
+		if name != "unsent" {
+			policy := Gateway.RetentionFor(name)
+			dir.Policy = &policy
+		} else {
+			status.Refusing = dir.FreeBytes < status.ReserveBytes
+		}
+		status.Dirs = append(status.Dirs, dir)
+	}
+	return status
+}
+
+// Caller holds janitorMutex
+func storageStatus(name string) StorageStatus {
+	dir := StorageStatus{
+		Name:        name,
+		Path:        retentionDir(name),
+		Pruned:      prunedByDir[name].files,
+		PrunedBytes: prunedByDir[name].bytes,
+	}
+	files, err := storedFiles(dir.Path)
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
+	dir.Files = len(files)
+	for _, file := range files {
+		dir.Bytes += file.size
+	}
+	if len(files) > 0 {
+		dir.Oldest = files[0].modTime
+	}
+	dir.FreeBytes, err = freeDisk(dir.Path)
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
+	return dir
+}
@@ -0,0 +1,433 @@
+package server
+
+/*
+ * Local index of every decoded measurement, so the last readings of a sensor
+ * can be looked at while the uplink is down. Kept in a bbolt file next to the
+ * data: one bucket per sensor, one per data type inside it, keyed by capture
+ * time so a time range is a cursor walk.
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/out"
+	bolt "go.etcd.io/bbolt"
+)
+
+const MEASUREMENT_STORE_FILE = "measurements.db"
+
+// Results of a query when no limit is given
+const DEFAULT_QUERY_LIMIT = 100
+
+var MEASUREMENTS_BUCKET = []byte("measurements")
+
+// Holds "backfilled" once the files from before the store are indexed
+var STORE_META_BUCKET = []byte("meta")
+
+// Fields of a measurement that are not scalars of it
+var STORE_METADATA = []string{"sampling_frequency", "measurement_id", "sensor_id", "measurement_type", "time", "axis", "raw_data"}
+
+type StoredMeasurement struct {
+	Id                string             `json:"id"`                 // measurement_id, empty for files saved before there was one
+	Sensor            string             `json:"sensor"`             // MAC address
+	DataType          string             `json:"data_type"`          //
+	Time              time.Time          `json:"time"`               // Start of the transmission
+	Axis              string             `json:"axis,omitempty"`     // x, y or z for vibration
+	SamplingFrequency float64            `json:"sampling_frequency"` //
+	Samples           int                `json:"samples"`            // Length of raw_data
+	File              string             `json:"file"`               // Name in the unsent, then sent folder
+	Scalars           map[string]float64 `json:"scalars"`            // Numbers of the measurement, plus value or min, max, mean and rms of raw_data
+	Pruned            bool               `json:"pruned,omitempty"`   // File deleted by the janitor, only the scalars are left
+}
+
+// Narrows down QueryMeasurements, zero values match everything
+type MeasurementQuery struct {
+	Sensor   string
+	DataType string
+	From     time.Time
+	To       time.Time
+	Limit    int  // DEFAULT_QUERY_LIMIT if 0, no limit if negative
+	Samples  bool // Read raw_data back from the files
+}
+
+// A stored measurement where its file is now
+type MeasurementResult struct {
+	StoredMeasurement
+	Path    string    `json:"path"`               // Empty once pruned
+	RawData []float64 `json:"raw_data,omitempty"` // If asked for and the file is still there
+}
+
+var store *bolt.DB
+var storeMutex sync.Mutex
+
+func openMeasurementStore() {
+	db, err := bolt.Open(path.Join(dataDir(), MEASUREMENT_STORE_FILE), filePermCode, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		out.Logger.Println("Error:", err, ", measurements won't be queryable")
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(MEASUREMENTS_BUCKET); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(STORE_META_BUCKET)
+		return err
+	})
+	if err != nil {
+		out.Logger.Println("Error:", err)
+		db.Close()
+		return
+	}
+	storeMutex.Lock()
+	store = db
+	storeMutex.Unlock()
+
+	go backfillMeasurementStore()
+}
+
+func measurementStore() (*bolt.DB, error) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	if store == nil {
+		return nil, errors.New("measurement store is not open")
+	}
+	return store, nil
+}
+
+// Index the files of the unsent and sent folders once, they were written
+// before the store existed
+func backfillMeasurementStore() {
+	db, err := measurementStore()
+	if err != nil {
+		return
+	}
+	done := false
+	db.View(func(tx *bolt.Tx) error {
+		done = tx.Bucket(STORE_META_BUCKET).Get([]byte("backfilled")) != nil
+		return nil
+	})
+	if done {
+		return
+	}
+
+	count := 0
+	for _, dir := range []string{unsentDataDir(), archivedDataDir()} {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			continue
+		}
+		for _, file := range files {
+			if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+				continue
+			}
+			data, err := os.ReadFile(path.Join(dir, file.Name()))
+			if err != nil {
+				continue
+			}
+			measurements := []map[string]interface{}{}
+			if err := json.Unmarshal(data, &measurements); err != nil {
+				continue
+			}
+			if err := indexMeasurements(file.Name(), measurements); err != nil {
+				out.Logger.Println("Error:", err)
+				continue
+			}
+			count++
+		}
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(STORE_META_BUCKET).Put([]byte("backfilled"), []byte(time.Now().Format(time.RFC3339)))
+	})
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
+	out.Logger.Println("Indexed", count, "measurement files saved before the store")
+}
+
+// Key of a measurement in its type bucket, in time order
+func storeKey(m StoredMeasurement) []byte {
+	key := binary.BigEndian.AppendUint64(nil, uint64(m.Time.UnixNano()))
+	return append(key, []byte(m.File+"/"+m.Axis)...)
+}
+
+// Add the measurements of a file to the store, from decoders or from json
+func indexMeasurements(file string, measurements []map[string]interface{}) error {
+	db, err := measurementStore()
+	if err != nil {
+		return err
+	}
+	records := []StoredMeasurement{}
+	for _, measurement := range measurements {
+		record, ok := storedMeasurement(file, measurement)
+		if ok {
+			records = append(records, record)
+		}
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, record := range records {
+			sensor, err := tx.Bucket(MEASUREMENTS_BUCKET).CreateBucketIfNotExists([]byte(record.Sensor))
+			if err != nil {
+				return err
+			}
+			dataType, err := sensor.CreateBucketIfNotExists([]byte(record.DataType))
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if err := dataType.Put(storeKey(record), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Flag the measurements of a file the janitor deleted from every folder
+func markPrunedMeasurements(file string, measurements []map[string]interface{}) error {
+	db, err := measurementStore()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, measurement := range measurements {
+			record, ok := storedMeasurement(file, measurement)
+			if !ok {
+				continue
+			}
+			sensor := tx.Bucket(MEASUREMENTS_BUCKET).Bucket([]byte(record.Sensor))
+			if sensor == nil {
+				continue
+			}
+			dataType := sensor.Bucket([]byte(record.DataType))
+			if dataType == nil {
+				continue
+			}
+			value := dataType.Get(storeKey(record))
+			if value == nil {
+				continue
+			}
+			stored := StoredMeasurement{}
+			if err := json.Unmarshal(value, &stored); err != nil {
+				return err
+			}
+			stored.Pruned = true
+			value, err := json.Marshal(stored)
+			if err != nil {
+				return err
+			}
+			if err := dataType.Put(storeKey(record), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func storedMeasurement(file string, measurement map[string]interface{}) (StoredMeasurement, bool) {
+	record := StoredMeasurement{File: file, Scalars: map[string]float64{}}
+	record.Id, _ = measurement["measurement_id"].(string)
+	record.Sensor, _ = measurement["sensor_id"].(string)
+	record.Sensor = strings.ToUpper(record.Sensor)
+	record.DataType, _ = measurement["measurement_type"].(string)
+	record.Axis, _ = measurement["axis"].(string)
+	record.SamplingFrequency, _ = toFloat(measurement["sampling_frequency"])
+	switch t := measurement["time"].(type) {
+	case time.Time:
+		record.Time = t
+	case string:
+		record.Time, _ = time.Parse(time.RFC3339Nano, t)
+	}
+	if record.Sensor == "" || record.DataType == "" || record.Time.IsZero() {
+		return record, false
+	}
+
+	for key, value := range measurement {
+		if slices.Contains(STORE_METADATA, key) {
+			continue
+		}
+		if number, ok := toFloat(value); ok {
+			record.Scalars[key] = number
+		}
+	}
+	raw := toFloats(measurement["raw_data"])
+	record.Samples = len(raw)
+	if len(raw) == 1 {
+		record.Scalars["value"] = raw[0]
+	} else if len(raw) > 1 {
+		minimum, maximum, sum, squares := raw[0], raw[0], 0.0, 0.0
+		for _, sample := range raw {
+			minimum = min(minimum, sample)
+			maximum = max(maximum, sample)
+			sum += sample
+			squares += sample * sample
+		}
+		record.Scalars["min"] = minimum
+		record.Scalars["max"] = maximum
+		record.Scalars["mean"] = sum / float64(len(raw))
+		record.Scalars["rms"] = math.Sqrt(squares / float64(len(raw)))
+	}
+	return record, true
+}
+
+// Numbers as decoded or as read back from json
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func toFloats(value interface{}) []float64 {
+	switch v := value.(type) {
+	case []float64:
+		return v
+	case []int:
+		result := make([]float64, len(v))
+		for i, sample := range v {
+			result[i] = float64(sample)
+		}
+		return result
+	case []interface{}:
+		result := make([]float64, 0, len(v))
+		for _, sample := range v {
+			if number, ok := toFloat(sample); ok {
+				result = append(result, number)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// Stored measurements matching the query, newest first
+func QueryMeasurements(query MeasurementQuery) ([]MeasurementResult, error) {
+	db, err := measurementStore()
+	if err != nil {
+		return nil, err
+	}
+	if query.Limit == 0 {
+		query.Limit = DEFAULT_QUERY_LIMIT
+	}
+	if query.To.IsZero() {
+		query.To = time.Now()
+	}
+	from := binary.BigEndian.AppendUint64(nil, uint64(max(query.From.UnixNano(), 0)))
+	// Past every key at query.To, whatever the file and axis
+	to := binary.BigEndian.AppendUint64(nil, uint64(query.To.UnixNano()+1))
+
+	records := []StoredMeasurement{}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(MEASUREMENTS_BUCKET).ForEachBucket(func(sensor []byte) error {
+			if query.Sensor != "" && !strings.EqualFold(string(sensor), query.Sensor) {
+				return nil
+			}
+			sensorBucket := tx.Bucket(MEASUREMENTS_BUCKET).Bucket(sensor)
+			return sensorBucket.ForEachBucket(func(dataType []byte) error {
+				if query.DataType != "" && string(dataType) != query.DataType {
+					return nil
+				}
+				// The newest Limit of each bucket, walking back from To
+				cursor := sensorBucket.Bucket(dataType).Cursor()
+				key, value := cursor.Seek(to)
+				if key == nil {
+					key, value = cursor.Last()
+				} else {
+					key, value = cursor.Prev()
+				}
+				for n := 0; key != nil && bytes.Compare(key, from) >= 0 && (query.Limit < 0 || n < query.Limit); n++ {
+					record := StoredMeasurement{}
+					if err := json.Unmarshal(value, &record); err != nil {
+						return err
+					}
+					records = append(records, record)
+					key, value = cursor.Prev()
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(records, func(a, b StoredMeasurement) int {
+		if c := b.Time.Compare(a.Time); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Axis, b.Axis)
+	})
+	if query.Limit > 0 {
+		records = records[:min(len(records), query.Limit)]
+	}
+
+	results := []MeasurementResult{}
+	for _, record := range records {
+		result := MeasurementResult{StoredMeasurement: record}
+		if !record.Pruned {
+			result.Path = measurementPath(record.File)
+		}
+		if query.Samples && result.Path != "" {
+			result.RawData, err = readRawData(result.Path, record)
+			if err != nil {
+				out.Logger.Println("Error:", err)
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Where a measurement file is now, empty if pruned
+func measurementPath(file string) string {
+	for _, dir := range []string{unsentDataDir(), archivedDataDir(), rejectedDataDir()} {
+		if _, err := os.Stat(path.Join(dir, file)); err == nil {
+			return path.Join(dir, file)
+		}
+	}
+	return ""
+}
+
+// raw_data of a stored measurement, from its file
+func readRawData(file string, record StoredMeasurement) ([]float64, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	measurements := []map[string]interface{}{}
+	if err := json.Unmarshal(data, &measurements); err != nil {
+		return nil, err
+	}
+	for _, measurement := range measurements {
+		dataType, _ := measurement["measurement_type"].(string)
+		axis, _ := measurement["axis"].(string)
+		if dataType == record.DataType && axis == record.Axis {
+			return toFloats(measurement["raw_data"]), nil
+		}
+	}
+	return nil, errors.New("no " + record.DataType + " measurement in " + file)
+}
@@ -5,35 +5,36 @@ package server
  */
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
 	"math"
-	"net/http"
 	"os"
 	"path"
 	"time"
 
-	"github.com/jukuly/ss_machmos/server/internal/model"
 	"github.com/jukuly/ss_machmos/server/internal/out"
 )
 
-// Used to notify of any data that wasn't uploaded
-// serialized and sent over pipe
-type UnsentDataError struct {
-	//Reason              string    `json:"reason"`
-	LastAttemptedUpload time.Time `json:"last_attempted_upload"`
-}
-
-var unsentData []UnsentDataError = []UnsentDataError{}
-
 // NOTE: the 0 at the beginning makes the number octal
 // NOTE: This is for directories only since it sets executable bit
 const dirPermCode os.FileMode = 0775
 
 const filePermCode os.FileMode = 0644
 
+// Directory of the captures, debug ones included, replaces ss_machmos in the
+// user cache and temp directories when set so the simulator doesn't touch the
+// real gateway's
+var DataRoot string
+
 func dataDir() string {
+	if DataRoot != "" {
+		err := os.MkdirAll(DataRoot, dirPermCode)
+		if err != nil {
+			out.Logger.Panic(err.Error())
+		}
+		return DataRoot
+	}
 	userDir, err := os.UserCacheDir()
 	if err != nil {
 		out.Logger.Println(err.Error())
@@ -69,6 +70,9 @@ func archivedDataDir() string {
 
 func debugDataDir() string {
 	dir := path.Join(os.TempDir(), "/ss_machmos/debug_data/")
+	if DataRoot != "" {
+		dir = path.Join(DataRoot, "/debug_data/")
+	}
 	err := os.MkdirAll(dir, dirPermCode)
 	if err != nil {
 		out.Logger.Panic(err.Error())
@@ -76,111 +80,78 @@ func debugDataDir() string {
 	return dir
 }
 
-// FIXME: this should be the only entry point to gateway uploading. Server
-// should NOT handle saving unsent measurements
-func sendMeasurements(jsonData []byte, gateway *model.Gateway) (*http.Response, error) {
-	//gateway.AuthError = false
-	body := model.RequestBody{
-		GatewayId:       gateway.Id,
-		GatewayPassword: gateway.Password,
-	}
-	err := json.Unmarshal(jsonData, &body.Measurements)
-	if err != nil {
-		return nil, err
-	}
-	json, err := json.Marshal(body)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := http.Post(gateway.HTTPEndpoint, "application/json", bytes.NewBuffer([]byte(json)))
-	if err == nil && resp.StatusCode == http.StatusOK {
-		// if success, archive
-		err := archiveMeasurements(jsonData, time.Now())
-		if err != nil {
-			out.Logger.Println(err.Error())
-		}
-		out.Broadcast("UPLOAD-SUCCESS")
-	}
-
-	if resp.StatusCode == http.StatusUnauthorized {
-		// Unauthorized
-		out.Broadcast("GATEWAY-INVALID")
-	}
-
-	return resp, err
+// Name of the file holding the measurements of a transmission, unsent or sent
+func measurementsFile(id string) string {
+	return id + ".json"
 }
 
-// Sending failed, save to disk for later
-func saveUnsentMeasurements(data []byte, timestamp time.Time) error {
-	unsentData = append(unsentData, UnsentDataError{
-		//Reason: "",
-		LastAttemptedUpload: timestamp,
-	})
-
-	// Notify GUI of a new unsent measurement
-	out.Broadcast("UPLOAD-FAILED")
-	return os.WriteFile(path.Join(unsentDataDir(), timestamp.String()+".json"), data, filePermCode)
+// Save to disk until uploaded, returns the name of the file in unsentDataDir
+func saveUnsentMeasurements(data []byte, id string) (string, error) {
+	file := measurementsFile(id)
+	return file, os.WriteFile(path.Join(unsentDataDir(), file), data, filePermCode)
 }
 
-func archiveMeasurements(data []byte, timestamp time.Time) error {
-	return os.WriteFile(path.Join(archivedDataDir(), timestamp.String()+".json"), data, filePermCode)
+func archiveMeasurements(data []byte, id string) error {
+	if diskReserved(archivedDataDir(), "archived measurements") {
+		return errors.New("free disk under the reserve, measurements " + id + " not archived")
+	}
+	return os.WriteFile(path.Join(archivedDataDir(), measurementsFile(id)), data, filePermCode)
 }
 
+// Raw bytes of every transmission, with a CaptureMetadata sidecar of the same
+// name so they can be decoded again or exported later
 func saveDebugMeasurements(transmission Transmission) error {
-	err := os.WriteFile(path.Join(debugDataDir(), transmission.sensorModel+"_"+transmission.dataType+"_"+time.Now().String()+".bin"), transmission.packets, filePermCode)
+	if diskReserved(debugDataDir(), "debug captures") {
+		return nil
+	}
+	name := transmission.sensorModel + "_" + transmission.dataType + "_" + time.Now().String()
+	if transmission.corrupt != "" {
+		name += "_corrupt"
+	}
+	file, err := os.OpenFile(path.Join(debugDataDir(), name+".bin"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePermCode)
 	if err != nil {
 		out.Logger.Println(err)
+		return err
 	}
-	return err
-}
-
-func PendingUploads() []UnsentDataError {
-	return unsentData
-}
-
-func sendUnsentMeasurements() {
-	files, err := os.ReadDir(unsentDataDir())
+	defer file.Close()
+	_, err = io.Copy(file, transmission.data.Reader())
 	if err != nil {
-		out.Logger.Println("Error:", err)
-		return
+		out.Logger.Println(err)
+		return err
 	}
 
-	for _, file := range files {
-		data, err := os.ReadFile(path.Join(unsentDataDir(), file.Name()))
-		if err != nil {
-			out.Logger.Println("Error:", err)
-			continue
-		}
-
-		resp, err := sendMeasurements(data, Gateway)
-		if err != nil {
-			out.Logger.Println("Error:", err)
-			continue
-		}
-
-		if resp.StatusCode == 200 {
-			// Don't delete, keep around for debugging
-			os.Rename(path.Join(unsentDataDir(), file.Name()), path.Join(archivedDataDir(), file.Name()))
-		}
+	metadata, err := captureMetadata(transmission)
+	if err != nil {
+		out.Logger.Println(err)
+		return err
 	}
+	metadata.Corrupt = transmission.corrupt
+	jsonStr, err := json.MarshalIndent(metadata, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path.Join(debugDataDir(), name+".json"), jsonStr, filePermCode)
+	if err != nil {
+		out.Logger.Println(err)
+	}
+	return err
 }
 
 // Parse and convert raw data received from MachMo boards
-func parseTemperatureData(data int16) (float64, error) {
+// r_ref is the reference resistor, r_0 the RTD resistance at 0 degrees
+func parseTemperatureData(data int16, r_ref float64, r_0 float64) (float64, error) {
 	adc_fs := math.Pow(2, 15) - 1.0
-	const r_ref = 1500.0
-	const r_0 = 1000.0
 
 	adc_in := float64(data)
-	rtd_resistance := adc_in / adc_fs * r_ref
+	// Constants below are for a PT1000, scale other RTDs to match
+	rtd_resistance := adc_in / adc_fs * r_ref * 1000 / r_0
 
 	if rtd_resistance >= 1000 {
 		const A = 3.9083e-3
 		const B = -5.775e-7
 
 		// Callendar-Van Dusen equation
-		sqrt := math.Sqrt(math.Pow(A, 2) - 4*B*(1-rtd_resistance/r_0))
+		sqrt := math.Sqrt(math.Pow(A, 2) - 4*B*(1-rtd_resistance/1000))
 		if sqrt < 0 {
 			return 0, errors.New("negative square root")
 		}
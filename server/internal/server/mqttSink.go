@@ -0,0 +1,229 @@
+package server
+
+/*
+ * Publishing measurements and sensor status to an MQTT broker
+ */
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+)
+
+const DEFAULT_MQTT_TOPIC = "machmos/{gateway}/{sensor}/{type}"
+
+const DEFAULT_MQTT_STATUS_TOPIC = "machmos/{gateway}/{sensor}/status"
+
+// Longest wait for the broker to acknowledge a connection or a message
+const MQTT_TIMEOUT = 30 * time.Second
+
+// Options of mqtt sinks:
+//   - broker: required, tcp://<host>:1883, or ssl://<host>:8883 for TLS
+//   - topic, status_topic: templates with {gateway}, {sensor} and {type}
+//   - qos: 0, 1 (default) or 2
+//   - retain_status: keep the last status of each sensor on the broker, true by default
+//   - client_id: ssmachmos-<gateway-id> by default
+//   - username, password
+//   - tls_ca, tls_cert, tls_key: PEM files, tls_insecure skips verifying the broker
+var MQTT_OPTIONS = []string{"broker", "topic", "status_topic", "qos", "retain_status", "client_id",
+	"username", "password", "tls_ca", "tls_cert", "tls_key", "tls_insecure"}
+
+type mqttSink struct {
+	gateway      *model.Gateway
+	topic        string
+	statusTopic  string
+	qos          byte
+	retainStatus bool
+	client       mqtt.Client
+	connectMutex sync.Mutex
+}
+
+func init() {
+	RegisterSinkType("mqtt", newMQTTSink)
+}
+
+func newMQTTSink(config model.SinkConfig, gateway *model.Gateway) (Sink, error) {
+	for option := range config.Options {
+		if !slices.Contains(MQTT_OPTIONS, option) {
+			return nil, errors.New("option " + option + " doesn't exist for mqtt sinks (must be one of " + strings.Join(MQTT_OPTIONS, ", ") + ")")
+		}
+	}
+	option := func(name string, fallback string) string {
+		if value, ok := config.Options[name]; ok {
+			return value
+		}
+		return fallback
+	}
+
+	s := &mqttSink{
+		gateway:      gateway,
+		topic:        option("topic", DEFAULT_MQTT_TOPIC),
+		statusTopic:  option("status_topic", DEFAULT_MQTT_STATUS_TOPIC),
+		retainStatus: true,
+	}
+	broker := option("broker", "")
+	if broker == "" {
+		return nil, errors.New("option broker is required for mqtt sinks")
+	}
+	qos, err := strconv.Atoi(option("qos", "1"))
+	if err != nil || qos < 0 || qos > 2 {
+		return nil, errors.New("invalid value for option qos (must be 0, 1 or 2)")
+	}
+	s.qos = byte(qos)
+	if value, ok := config.Options["retain_status"]; ok {
+		s.retainStatus, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("invalid value for option retain_status (must be true or false)")
+		}
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(option("client_id", "ssmachmos-"+gateway.Id)).
+		SetUsername(option("username", "")).
+		SetPassword(option("password", "")).
+		SetConnectTimeout(MQTT_TIMEOUT).
+		SetWriteTimeout(MQTT_TIMEOUT).
+		// Reconnecting is done in Send, failed messages are retried by the upload queue
+		SetAutoReconnect(false).
+		SetConnectRetry(false)
+	tlsConfig, err := mqttTLSConfig(config.Options)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	s.client = mqtt.NewClient(opts)
+	return s, nil
+}
+
+// nil if no TLS option is set, the broker scheme alone decides to use TLS then
+func mqttTLSConfig(options map[string]string) (*tls.Config, error) {
+	ca, cert, key, insecure := options["tls_ca"], options["tls_cert"], options["tls_key"], options["tls_insecure"]
+	if ca == "" && cert == "" && key == "" && insecure == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + ca)
+		}
+	}
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, errors.New("options tls_cert and tls_key go together")
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	if insecure != "" {
+		skip, err := strconv.ParseBool(insecure)
+		if err != nil {
+			return nil, errors.New("invalid value for option tls_insecure (must be true or false)")
+		}
+		config.InsecureSkipVerify = skip
+	}
+	return config, nil
+}
+
+func (s *mqttSink) connect() error {
+	s.connectMutex.Lock()
+	defer s.connectMutex.Unlock()
+	if s.client.IsConnectionOpen() {
+		return nil
+	}
+	return waitMQTT(s.client.Connect())
+}
+
+func waitMQTT(token mqtt.Token) error {
+	if !token.WaitTimeout(MQTT_TIMEOUT) {
+		return errors.New("timed out waiting for the MQTT broker")
+	}
+	return token.Error()
+}
+
+// Fill the placeholders of a topic template
+func (s *mqttSink) expandTopic(template string, sensor string, dataType string) string {
+	return strings.NewReplacer(
+		"{gateway}", model.GatewaySettings(s.gateway).Id,
+		"{sensor}", sensor,
+		"{type}", dataType,
+	).Replace(template)
+}
+
+// One message per measurement, on the topic of its sensor and type
+func (s *mqttSink) Send(jsonData []byte) error {
+	measurements := []map[string]interface{}{}
+	err := json.Unmarshal(jsonData, &measurements)
+	if err != nil {
+		return err
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	tokens := []mqtt.Token{}
+	for _, measurement := range measurements {
+		payload, err := json.Marshal(measurement)
+		if err != nil {
+			return err
+		}
+		sensor, _ := measurement["sensor_id"].(string)
+		dataType, _ := measurement["measurement_type"].(string)
+		tokens = append(tokens, s.client.Publish(s.expandTopic(s.topic, sensor, dataType), s.qos, false, payload))
+	}
+	// A measurement already published is sent again on retry, subscribers get it at least once
+	for _, token := range tokens {
+		if err := waitMQTT(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mqttSink) SendStatus(event string, mac [6]byte) error {
+	status := strings.ToLower(strings.TrimPrefix(event, "SENSOR-"))
+	sensor := model.MacToString(mac)
+	payload, err := json.Marshal(map[string]interface{}{
+		"sensor_id": sensor,
+		"status":    status,
+		"time":      time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+	return waitMQTT(s.client.Publish(s.expandTopic(s.statusTopic, sensor, "status"), s.qos, s.retainStatus, payload))
+}
+
+func (s *mqttSink) Close() error {
+	s.connectMutex.Lock()
+	defer s.connectMutex.Unlock()
+	if s.client.IsConnected() {
+		s.client.Disconnect(250)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package server
+
+/*
+ * Posting measurements to OpenPHM, the original and default destination
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+// Options: "url", "id" and "password", each defaulting to the Gateway's own
+// settings so "config --http", "--id" and "--password" keep working
+type openphmSink struct {
+	config  model.SinkConfig
+	gateway *model.Gateway
+}
+
+func init() {
+	RegisterSinkType("openphm", newOpenPHMSink)
+}
+
+func newOpenPHMSink(config model.SinkConfig, gateway *model.Gateway) (Sink, error) {
+	for option := range config.Options {
+		if option != "url" && option != "id" && option != "password" {
+			return nil, errors.New("option " + option + " doesn't exist for openphm sinks (must be url, id or password)")
+		}
+	}
+	return &openphmSink{config: config, gateway: gateway}, nil
+}
+
+// Option of the sink or the Gateway setting it overrides
+func (s *openphmSink) option(name string, fallback string) string {
+	if value, ok := s.config.Options[name]; ok {
+		return value
+	}
+	return fallback
+}
+
+func (s *openphmSink) Send(jsonData []byte) error {
+	return s.SendBatch([][]byte{jsonData})
+}
+
+// The measurements of every file in a single RequestBody
+func (s *openphmSink) SendBatch(files [][]byte) error {
+	gateway := model.GatewaySettings(s.gateway)
+	body := model.RequestBody{
+		GatewayId:       s.option("id", gateway.Id),
+		GatewayPassword: s.option("password", gateway.Password),
+		Measurements:    []map[string]interface{}{},
+	}
+	for _, jsonData := range files {
+		measurements := []map[string]interface{}{}
+		err := json.Unmarshal(jsonData, &measurements)
+		if err != nil {
+			return err
+		}
+		body.Measurements = append(body.Measurements, measurements...)
+	}
+
+	client, err := s.gateway.HTTPClient()
+	if err != nil {
+		return err
+	}
+	status, err := model.PostRequestBody(client, s.option("url", gateway.HTTPEndpoint), body, gateway.Compression)
+	if status == http.StatusUnauthorized {
+		// Unauthorized
+		out.Broadcast("GATEWAY-INVALID")
+	}
+	return err
+}
+
+func (s *openphmSink) Close() error {
+	return nil
+}
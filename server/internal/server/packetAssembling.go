@@ -5,62 +5,131 @@ package server
  */
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
-	"errors"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/jukuly/ss_machmos/server/internal/model"
 	"github.com/jukuly/ss_machmos/server/internal/out"
-	"tinygo.org/x/bluetooth"
 )
 
 // Maximum time in seconds a transmission can stay idle before being cancelled
 // NOTE: Should this be less than the wake-up time? Or simply extrememly short?
 const TRANSMISSION_TIMEOUT = 5 // Seconds
 
+// Every transfer starts with a header write, anything else is data.
+// Version 0: magic "MMHD" (4 bytes) | 0x00 | total length (4 bytes) | sampling frequency (4 bytes)
+// Version 1: magic "MMHD" (4 bytes) | 0x01 | total length (4 bytes) | sampling frequency (4 bytes) | CRC32 of data (4 bytes)
+// Version 2: version 1 header with 0x02 | chunk size in bytes (2 bytes)
+// In version 1 every data write starts with its sequence number (4 bytes), counting from 0
+// In version 2 every data write starts with its chunk index (4 bytes), chunk i
+// holds data[i*chunk size:(i+1)*chunk size] so chunks may arrive in any order
+var HEADER_MAGIC = []byte{'M', 'M', 'H', 'D'}
+
+const HEADER_VERSION = 2
+
+// Length of the header of each supported framing version
+var HEADER_LENGTHS = map[byte]int{
+	0: 13,
+	1: 17,
+	2: 19,
+}
+
+// Length of the sequence number or chunk index in front of each data write, version 1 and up
+const SEQUENCE_LENGTH = 4
+
 type Packet struct {
 	offset int
 	data   []byte
 }
 
 type Transmission struct {
-	macAddress        [6]byte   // FIXME make this a string
-	sensorModel       string    // Board model to choose conversion algorithm
-	timestamp         time.Time // Transmission start time
-	endTimestamp      time.Time // transmission end time
-	dataType          string    // Enum-like
-	samplingFrequency uint32    // Frequency of samples
-	currentLength     int       // To compare with totalLength promised by sensor
-	totalLength       uint32    // Total amount announced by sensor
-	packets           []byte    // Byte stream of sent numbers
-	lastActivity      int64     // Last time activity was seen here
-	stale             bool      // Transmission timed out, discard on next touch
+	id                string            // UUID, names its files and is the measurement_id of its measurements
+	macAddress        [6]byte           // FIXME make this a string
+	sensorModel       string            // Board model to choose conversion algorithm
+	timestamp         time.Time         // Transmission start time
+	endTimestamp      time.Time         // transmission end time
+	dataType          string            // Enum-like
+	samplingFrequency uint32            // Frequency of samples
+	currentLength     int               // To compare with totalLength promised by sensor
+	totalLength       uint32            // Total amount announced by sensor
+	data              *transmissionData // Byte stream of sent numbers, spills to disk when large
+	lastActivity      int64             // Last time activity was seen here
+	stale             bool              // Transmission timed out, discard on next touch
+	version           byte              // Framing version announced in the header
+	checksum          uint32            // CRC32 of the whole data announced by sensor
+	nextSequence      uint32            // Sequence number expected next
+	corrupt           string            // Why the data can't be trusted, empty if it can
+	chunkSize         uint16            // Bytes per chunk, version 2 and up
+	received          []bool            // Which chunks arrived, version 2 and up
+	receivedChunks    int               // Number of true in received
+	retransmitCount   int               // Retransmission requests sent for this transmission
+	intactLength      int               // Bytes received before the first gap, versions 0 and 1
+	partial           bool              // Timed out, data is only the part that could be salvaged
+	calibration       model.Calibration // Of the sensor when the transmission started
+	vibrationRange    int               // Accelerometer full scale in g the data was sampled at
+}
+
+// Whether all the data announced by the header is in
+func (t *Transmission) complete() bool {
+	if t.version >= 2 {
+		return t.receivedChunks == len(t.received)
+	}
+	return t.currentLength >= int(t.totalLength)
+}
+
+// A board uploads each data type on its own characteristic, possibly at the
+// same time, so in-flight transmissions are tracked per sensor and data type
+type transmissionKey struct {
+	mac      [6]byte
+	dataType string
 }
 
 // https://go.dev/doc/faq#atomic_maps
 // TODO: See if another package like concurrent-map might help here
+// Guards transmissions and transmissionLocks only, never held across file I/O
+// or notifications
 var transmissionMutex sync.RWMutex
 
-type TransmissionMap map[[6]byte]Transmission
+type TransmissionMap map[transmissionKey]Transmission
 
 var transmissions TransmissionMap = make(TransmissionMap)
 
-// func (tm *TransmissionMap) Put(key [6]byte, value Transmission) {
-// 	transmissionMutex.Lock()
-// 	(*tm)[key] = value
-// 	transmissionMutex.Unlock()
-// }
+// Sensors that sent a header with the magic since the gateway started. Their
+// writes are never read as a legacy header, whatever arrives late.
+var framedSensors = map[[6]byte]bool{}
+
+// Held while a transmission is read, changed and stored back, so writes of one
+// characteristic are handled in order without holding up the others
+var transmissionLocks = map[transmissionKey]*sync.Mutex{}
+
+func transmissionLock(key transmissionKey) *sync.Mutex {
+	transmissionMutex.Lock()
+	defer transmissionMutex.Unlock()
+	lock, ok := transmissionLocks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		transmissionLocks[key] = lock
+	}
+	return lock
+}
+
+func storeTransmission(key transmissionKey, t Transmission) {
+	transmissionMutex.Lock()
+	transmissions[key] = t
+	transmissionMutex.Unlock()
+}
 
-// func (tm *TransmissionMap) Read(key [6]byte) Transmission {
-// 	transmissionMutex.RLock()
-// 	value := (*tm)[key]
-// 	transmissionMutex.RUnlock()
-// 	return value
-// }
+func dropTransmission(key transmissionKey) {
+	transmissionMutex.Lock()
+	delete(transmissions, key)
+	transmissionMutex.Unlock()
+}
 
 // Activity watchdog goroutine timer to delete stale pending transmissions. If a
 // sensor fails during upload or crashes, the gateway would still keep the data
@@ -73,78 +142,253 @@ func startWatchdog() {
 		time.Sleep(1 * time.Second)
 		now := time.Now().Unix()
 
-		transmissionMutex.RLock() // Lock read
-		for mac, transmission := range transmissions {
-			transmissionMutex.RUnlock() // unlock after read
+		requests := [][]byte{}
+		timedOut := []Transmission{}
+		transmissionMutex.Lock()
+		for key, transmission := range transmissions {
+			lock := transmissionLocks[key]
+			if !lock.TryLock() {
+				// A write is being handled, the transmission isn't idle
+				continue
+			}
 			// Time is up, mark for deletion
-			if !transmission.stale && now-transmission.lastActivity >= TRANSMISSION_TIMEOUT {
-				transmissionMutex.Lock() // write lock
-				t := transmissions[mac]
-				t.stale = true // Flag as stale
-				transmissions[mac] = t
-				transmissionMutex.Unlock() // write unlock
-				out.Logger.Printf("Idle timeout transmission for %s datatype %s", model.MacToString(mac), transmission.dataType)
+			if !transmission.stale && transmission.shouldRequestRetransmission(now) {
+				if request := retransmissionRequest(&transmission); request != nil {
+					requests = append(requests, request)
+				}
+				transmissions[key] = transmission
+			} else if !transmission.stale && now-transmission.lastActivity >= TRANSMISSION_TIMEOUT {
+				countTransfer(key.mac, func(s *TransferStats) { s.TimedOut++ })
+				out.Logger.Printf("Idle timeout transmission for %s datatype %s", model.MacToString(key.mac), key.dataType)
+				// Salvaged or released below, the stale entry drops what the sensor still sends
+				timedOut = append(timedOut, transmission)
+				transmission.stale = true // Flag as stale
+				transmission.data = nil
+				transmission.lastActivity = now
+				transmissions[key] = transmission
+			} else if transmission.stale && now-transmission.lastActivity >= TRANSMISSION_TIMEOUT {
+				// The sensor went quiet, what it writes next can only be a new header
+				delete(transmissions, key)
 			}
-			transmissionMutex.RLock() // lock before read
+			lock.Unlock()
 		}
-		transmissionMutex.RUnlock()
+		transmissionMutex.Unlock()
+
+		for _, request := range requests {
+			sendRetransmission(request)
+		}
+		for _, transmission := range timedOut {
+			policy := Gateway.PartialPolicyFor(transmission.dataType)
+			if policy != model.PartialPolicyDiscard && salvage(&transmission) {
+				// Uploading blocks, don't hold up the watchdog for it
+				go processTransmission(transmission, policy == model.PartialPolicyUpload)
+				continue
+			}
+			transmission.data.Release()
+		}
+	}
+}
+
+// Length of the bare header of firmware from before the magic
+const LEGACY_HEADER_LENGTH = 8
+
+// Framing version and fields, from the total length on, of a transfer header
+// this gateway understands, ok false if data isn't one. Firmware from before
+// the magic starts every transfer with a bare total length | sampling
+// frequency, so when legacy is true a write without the magic is read as such
+// a version 0 header. Only for sensors that never sent the magic, while
+// nothing is in progress or stale on the characteristic.
+func parseHeader(data []byte, legacy bool) (version byte, fields []byte, magic bool, ok bool) {
+	if len(data) > len(HEADER_MAGIC) && bytes.Equal(data[:len(HEADER_MAGIC)], HEADER_MAGIC) {
+		length, ok := HEADER_LENGTHS[data[4]]
+		return data[4], data[5:], true, ok && len(data) == length
 	}
+	return 0, data, false, legacy && len(data) >= LEGACY_HEADER_LENGTH
 }
 
 func savePacket(data []byte, macAddress [6]byte, dataType string) (t Transmission, ok bool) {
+	key := transmissionKey{mac: macAddress, dataType: dataType}
+
+	// Notified once every lock is released, see receiveChunk
+	var request []byte
+	defer func() {
+		if request != nil {
+			sendRetransmission(request)
+		}
+	}()
+	lock := transmissionLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
 	transmissionMutex.RLock()
-	transmission, exists := transmissions[macAddress]
+	transmission, exists := transmissions[key]
+	framed := framedSensors[macAddress]
 	transmissionMutex.RUnlock()
-	// If new transmission, or replacing stale transmission
-	if exists == false || transmission.stale == true {
+
+	version, fields, magic, header := parseHeader(data, !exists && !framed)
+	if header {
+		if magic && !framed {
+			transmissionMutex.Lock()
+			framedSensors[macAddress] = true
+			transmissionMutex.Unlock()
+		}
 		// New transmission
+		if exists && !transmission.stale {
+			out.Logger.Println("New", dataType, "header from", model.MacToString(macAddress), "before previous transmission completed",
+				transmission.currentLength, "/", transmission.totalLength, ", discarding previous")
+			countTransfer(macAddress, func(s *TransferStats) { s.Abandoned++ })
+		}
+		if exists {
+			transmission.data.Release()
+		}
+		// Header is not part of the data, unpack
+		totalLength := binary.LittleEndian.Uint32(fields[0:4])
+		samplingFrequency := binary.LittleEndian.Uint32(fields[4:8])
+		if totalLength == 0 {
+			out.Logger.Println("Received", dataType, "header announcing 0 bytes from", model.MacToString(macAddress), ", dropping")
+			dropTransmission(key)
+			return Transmission{}, false
+		}
+		sensorModel := "unknown"
+		calibration := model.Calibration{}
+		vibrationRange := model.DEFAULT_VIBRATION_RANGE
+		if sensor := sensorExists(macAddress); sensor != nil {
+			sensorModel = sensor.Model
+			calibration = sensor.Calibration
+			vibrationRange = vibrationRangeOf(sensor)
+			// A corrupted header could announce up to 4 GiB, don't wait for it
+			if totalLength > sensor.TransmissionLimit() {
+				out.Logger.Println("Received", dataType, "header announcing", totalLength, "bytes from", model.MacToString(macAddress),
+					", more than the limit of", sensor.TransmissionLimit(), ", dropping")
+				countTransfer(macAddress, func(s *TransferStats) { s.Oversized++ })
+				dropTransmission(key)
+				return Transmission{}, false
+			}
+		}
 		out.Logger.Println("COLLECT-START:" + model.MacToString(macAddress))
-		// First packet is a header, unpack
-		totalLength := binary.LittleEndian.Uint32(data[0:4])
-		samplingFrequency := binary.LittleEndian.Uint32(data[4:8])
-		//timestamp := int64(binary.LittleEndian.Uint64(data[8:16]))
-		transmissionMutex.Lock()
-		transmissions[macAddress] = Transmission{
+		transmission = Transmission{
+			id:                uuid.NewString(),
 			macAddress:        macAddress,
-			sensorModel:       sensorExists(macAddress).Model,
-			timestamp:         time.Now(), // time.Unix(timestamp, 0),
+			sensorModel:       sensorModel,
+			calibration:       calibration,
+			vibrationRange:    vibrationRange,
+			timestamp:         time.Now(),
 			dataType:          dataType,
 			samplingFrequency: samplingFrequency,
 			currentLength:     0,
 			totalLength:       totalLength,
-			packets:           make([]byte, 0),
+			data:              &transmissionData{},
 			lastActivity:      time.Now().Unix(),
 			stale:             false,
+			version:           version,
 		}
-		transmissionMutex.Unlock()
-		out.Logger.Println("Received collection header")
-		out.Logger.Println("DataType:", transmissions[macAddress].dataType)
-		out.Logger.Println("Total expected length:", transmissions[macAddress].totalLength)
+		if transmission.version >= 1 {
+			transmission.checksum = binary.LittleEndian.Uint32(fields[8:12])
+		}
+		if transmission.version >= 2 {
+			transmission.chunkSize = binary.LittleEndian.Uint16(fields[12:14])
+			if transmission.chunkSize == 0 {
+				out.Logger.Println("Received", dataType, "header with chunk size 0 from", model.MacToString(macAddress), ", dropping")
+				transmission.data.Release()
+				dropTransmission(key)
+				return Transmission{}, false
+			}
+			chunks := (int(totalLength) + int(transmission.chunkSize) - 1) / int(transmission.chunkSize)
+			transmission.received = make([]bool, chunks)
+		}
+		out.Logger.Println("Received collection header version", transmission.version)
+		out.Logger.Println("DataType:", transmission.dataType)
+		out.Logger.Println("Total expected length:", transmission.totalLength)
 	} else {
-		transmissionMutex.Lock()
-		// Other packets are raw data
-		transmission := transmissions[macAddress]
-		transmission.packets = append(transmission.packets, data...) // Append data to end of stream
-		transmission.currentLength += len(data)                      // increase current byte count
-		transmission.lastActivity = time.Now().Unix()                // Update idle timer
-		transmissions[macAddress] = transmission
-		transmissionMutex.Unlock()
+		if !exists || transmission.stale {
+			// Tail of a transmission that was abandoned, or a sensor with newer framing
+			out.Logger.Println("Received", len(data), "bytes of", dataType, "data from", model.MacToString(macAddress), "without a header, dropping")
+			if exists {
+				// Stays stale until the sensor is quiet for TRANSMISSION_TIMEOUT
+				transmission.lastActivity = time.Now().Unix()
+				storeTransmission(key, transmission)
+			}
+			return Transmission{}, false
+		}
+		transmission.lastActivity = time.Now().Unix() // Update idle timer
+
+		if transmission.version >= 2 {
+			var stored bool
+			stored, request = receiveChunk(&transmission, data)
+			if !stored {
+				storeTransmission(key, transmission)
+				return Transmission{}, false
+			}
+		} else if transmission.version == 1 {
+			if len(data) < SEQUENCE_LENGTH {
+				out.Logger.Println("Received", len(data), "bytes from", model.MacToString(macAddress), "too short for a sequence number, dropping")
+				storeTransmission(key, transmission)
+				return Transmission{}, false
+			}
+			sequence := binary.LittleEndian.Uint32(data[:SEQUENCE_LENGTH])
+			data = data[SEQUENCE_LENGTH:]
+			if sequence < transmission.nextSequence {
+				// Sensor repeated a write, already have it
+				out.Logger.Println("Duplicate chunk", sequence, "from", model.MacToString(macAddress), "ignored")
+				countTransfer(macAddress, func(s *TransferStats) { s.Duplicates++ })
+				storeTransmission(key, transmission)
+				return Transmission{}, false
+			}
+			if sequence > transmission.nextSequence {
+				missing := sequence - transmission.nextSequence
+				out.Logger.Println("Missing", missing, "chunks from", model.MacToString(macAddress), "before chunk", sequence)
+				countTransfer(macAddress, func(s *TransferStats) { s.MissingChunks += int(missing) })
+				transmission.corrupt = "missing chunks"
+				transmission.intactLength = transmission.currentLength
+			}
+			transmission.nextSequence = sequence + 1
+		}
+
+		if transmission.version < 2 {
+			// Other packets are raw data
+			if _, err := transmission.data.Write(data); err != nil { // Append data to end of stream
+				out.Logger.Println("Error:", err)
+				transmission.corrupt = "could not store data"
+			}
+			transmission.currentLength += len(data) // increase current byte count
+			if transmission.corrupt == "" {
+				transmission.intactLength = transmission.currentLength
+			}
+		}
 		out.Logger.Println("Received packet from", model.MacToString(macAddress), "total", transmission.currentLength, "/", transmission.totalLength)
 	}
 
 	// Header includes expected length, expect more from that
-	if transmissions[macAddress].currentLength >= int(transmissions[macAddress].totalLength) {
-		fullTransmit := transmissions[macAddress]
+	if transmission.complete() {
 		// Plug in end timestamp
-		fullTransmit.endTimestamp = time.Now()
-		//copy(fullTransmit.packets, transmissions[macAddress].packets)
-		delete(transmissions, macAddress)
+		transmission.endTimestamp = time.Now()
+		dropTransmission(key)
 		out.Logger.Println("Assembled transmission packets for", model.MacToString(macAddress),
-			"time taken", fullTransmit.endTimestamp.Sub(fullTransmit.timestamp))
+			"time taken", transmission.endTimestamp.Sub(transmission.timestamp))
+
+		if transmission.version >= 1 && transmission.corrupt == "" {
+			checksum, err := transmission.data.Checksum()
+			if err != nil {
+				out.Logger.Println("Error:", err)
+				transmission.corrupt = "could not read back data"
+			} else if checksum != transmission.checksum {
+				transmission.corrupt = "checksum mismatch"
+				countTransfer(macAddress, func(s *TransferStats) { s.ChecksumErrors++ })
+			}
+		}
+		if transmission.currentLength > int(transmission.totalLength) && transmission.corrupt == "" {
+			transmission.corrupt = "more data than announced"
+		}
+		if transmission.corrupt != "" {
+			countTransfer(macAddress, func(s *TransferStats) { s.Corrupt++ })
+		} else {
+			countTransfer(macAddress, func(s *TransferStats) { s.Completed++ })
+		}
 
 		out.Logger.Println("COLLECT-END:" + model.MacToString(macAddress))
-		return fullTransmit, true
+		return transmission, true
 	}
+	storeTransmission(key, transmission)
 
 	// Nothing to return
 	return Transmission{}, false
@@ -154,7 +398,7 @@ func savePacket(data []byte, macAddress [6]byte, dataType string) (t Transmissio
  * Receive a data upload from the sensor
  * Each sensor data type would have a dedicated characteristic
  */
-func handleData(dataType string, _ bluetooth.Connection, address string, _mtu int, value []byte) {
+func handleData(dataType string, address string, value []byte) {
 	if len(value) == 0 {
 		out.Logger.Println("Zero byte array received from " + address + " handling data for " + dataType)
 		return
@@ -187,190 +431,75 @@ func handleData(dataType string, _ bluetooth.Connection, address string, _mtu in
 	// Done collecting data, serialize to json and attempt immediate transfer after
 	out.Logger.Println("Received " + dataType + " data transmission from " + model.MacToString(macAddress) + " (" + sensor.Name + ")")
 	sensor.UpdateLastSeen(model.SensorActivityIdle)
+	processTransmission(transmitData, true)
+}
+
+// Decode an assembled transmission, then upload it or only archive it
+func processTransmission(transmitData Transmission, upload bool) {
+	// Everything below works on the assembled data, drop the temp file after
+	defer transmitData.data.Release()
+	dataType := transmitData.dataType
+	macAddress := transmitData.macAddress
 
 	// Save raw binary data received from sensor
 	saveDebugMeasurements(transmitData)
 
-	// Pick apart data and place into json structures
-	var measurements []map[string]interface{}
-	if dataType == "vibration" {
-		measurements = handleVibrationData(transmitData)
-	} else if dataType == "temperature" {
-		measurements = handleTemperatureData(transmitData)
-	} else if dataType == "audio" {
-		measurements = handleAudioData(transmitData)
-	} else {
-		out.Logger.Println("unknown data type", dataType)
+	// Never upload a shifted or damaged waveform
+	if transmitData.corrupt != "" {
+		out.Logger.Println("Discarding corrupt", dataType, "transmission from", model.MacToString(macAddress)+":", transmitData.corrupt)
+		out.Broadcast("TRANSFER-CORRUPT:" + model.MacToString(macAddress))
 		return
 	}
 
-	jsonData, err := json.Marshal(measurements)
+	// Pick apart data and place into json structures
+	measurements, err := decode(transmitData)
 	if err != nil {
-		out.Logger.Println("Error:", err)
+		// Raw data is still in the debug folder for a decoder written later
+		out.Logger.Println("Could not decode", dataType, "transmission from", model.MacToString(macAddress)+":", err)
+		countTransfer(macAddress, func(s *TransferStats) { s.Undecodable++ })
+		out.Broadcast("TRANSFER-UNDECODABLE:" + model.MacToString(macAddress))
 		return
 	}
 
-	// Upload to gateway
-	resp, err := sendMeasurements(jsonData, Gateway)
-
-	// catch marshal errors
-	if err != nil {
-		out.Logger.Println("Error:", err)
-		// Save to disk instead
-		if err := saveUnsentMeasurements(jsonData, transmitData.timestamp); err != nil {
-			out.Logger.Println("Error:", err)
+	for _, measurement := range measurements {
+		measurement["measurement_id"] = transmitData.id
+	}
+	if battery := batteryLevelOf(macAddress); battery >= 0 {
+		for _, measurement := range measurements {
+			measurement["battery_level"] = battery
 		}
-		return
 	}
-
-	// TODO: we could use this point to verify gateway settings
-
-	// Catch gateway response
-	if resp.StatusCode != 200 {
-		out.Logger.Println("Error sending data to server")
-		// Print out response error
-		body := make([]byte, resp.ContentLength)
-		defer resp.Body.Close()
-		resp.Body.Read(body)
-		out.Logger.Println(string(body))
-		// Save data
-		if err := saveUnsentMeasurements(jsonData, transmitData.timestamp); err != nil {
-			out.Logger.Println(err)
+	if transmitData.partial {
+		for _, measurement := range measurements {
+			measurement["partial"] = true
+			measurement["received_bytes"] = transmitData.data.Len()
+			measurement["expected_bytes"] = transmitData.totalLength
 		}
-		return
 	}
 
-	// Send everything else in store
-	sendUnsentMeasurements()
-}
-
-// Accelerometer json output
-func handleVibrationData(transmitData Transmission) []map[string]interface{} {
-	convRange8G := .000244
-	rawData := transmitData.packets
-	numberOfMeasurements := len(rawData) / 6 // 3 axes, 2 bytes per axis => 6 bytes per measurement
-	out.Logger.Println("Vibration data consists of", len(rawData), "bytes =", numberOfMeasurements, "measurements.")
-	x, y, z := make([]float64, numberOfMeasurements), make([]float64, numberOfMeasurements), make([]float64, numberOfMeasurements)
-	for i := 0; i < len(rawData); i += 6 {
-		//out.Logger.Println(rawData[i:i+6])
-		// We're receiving signed integers, of course.
-		x[i/6] = float64(int16(transmitData.packets[i+1])<<8|int16(transmitData.packets[i+0])) * convRange8G
-		y[i/6] = float64(int16(transmitData.packets[i+3])<<8|int16(transmitData.packets[i+2])) * convRange8G
-		z[i/6] = float64(int16(transmitData.packets[i+5])<<8|int16(transmitData.packets[i+4])) * convRange8G
+	jsonData, err := json.Marshal(measurements)
+	if err != nil {
+		out.Logger.Println("Error:", err)
+		return
 	}
-
-	measurements := []map[string]interface{}{}
-	measurements = append(measurements,
-		map[string]interface{}{
-			"sensor_id":          model.MacToString(transmitData.macAddress),
-			"time":               transmitData.timestamp,
-			"measurement_type":   transmitData.dataType,
-			"sampling_frequency": transmitData.samplingFrequency,
-			"axis":               "x",
-			"raw_data":           x,
-		},
-		map[string]interface{}{
-			"sensor_id":          model.MacToString(transmitData.macAddress),
-			"time":               transmitData.timestamp,
-			"measurement_type":   transmitData.dataType,
-			"sampling_frequency": transmitData.samplingFrequency,
-			"axis":               "y",
-			"raw_data":           y,
-		},
-		map[string]interface{}{
-			"sensor_id":          model.MacToString(transmitData.macAddress),
-			"time":               transmitData.timestamp,
-			"measurement_type":   transmitData.dataType,
-			"sampling_frequency": transmitData.samplingFrequency,
-			"axis":               "z",
-			"raw_data":           z,
-		},
-	)
-
-	return measurements
-}
-
-// Temperature data is a single number in an array
-func handleTemperatureData(transmitData Transmission) []map[string]any {
-	measurements := []map[string]any{}
-
-	if len(transmitData.packets) == 2 {
-		// TODO: Get sensor model from transmission
-		var temperature float64
-		var err error
-		if transmitData.sensorModel == "machmo" {
-			var digitalTemp int16 = int16(transmitData.packets[1])<<8 | int16(transmitData.packets[0])
-			temperature, err = parseTemperatureData(digitalTemp)
-			out.Logger.Println("MachMo temperature reading")
-		} else if transmitData.sensorModel == "machmomini" {
-			var digitalTemp int16 = int16(transmitData.packets[1])<<8 | int16(transmitData.packets[0])
-			err = nil
-			temperature = float64(digitalTemp) * 0.0625
-			out.Logger.Println(transmitData.packets)
-			out.Logger.Printf("MachMo mini temperature digital %d celsius %f", digitalTemp, temperature)
-		} else {
-			err = errors.New("Unknown board model " + transmitData.sensorModel)
-		}
-
-		if err == nil {
-			measurements = append(measurements,
-				map[string]any{
-					"sensor_id":          model.MacToString(transmitData.macAddress),
-					"time":               transmitData.timestamp,
-					"measurement_type":   transmitData.dataType,
-					"sampling_frequency": transmitData.samplingFrequency,
-					// Has to be an array
-					"raw_data": []float64{temperature},
-				},
-			)
-		} else {
+	if !upload {
+		if err := archiveMeasurements(jsonData, transmitData.id); err != nil {
+			// Not indexed either, the store would point at nothing
 			out.Logger.Println("Error:", err)
+			return
 		}
-	} else {
-		out.Logger.Println("Invalid temperature data received, expected 2 bytes but received", len(transmitData.packets))
+	}
+	if err := indexMeasurements(measurementsFile(transmitData.id), measurements); err != nil {
+		out.Logger.Println("Error:", err)
+	}
+	if !upload {
+		return
 	}
 
-	return measurements
-}
-
-func handleAudioData(transmitData Transmission) []map[string]interface{} {
-	measurements := []map[string]interface{}{}
-	if len(transmitData.packets)%3 == 0 {
-		//out.Logger.Println(transmitData.packets[5000])
-		numberOfMeasurements := len(transmitData.packets) / 3
-		amplitude := make([]int, numberOfMeasurements)
-		// Collect bytes into 24 bit integers
-		for i := 0; i < numberOfMeasurements; i++ {
-			// Data is sent as left aligned, little endian uint32 bytes
-			// NOTE: this is how OpenPHM expects the bytes to be assembled. Flipped.
-			amplitude[i] = int(transmitData.packets[i*3])<<16 | int(transmitData.packets[i*3+1])<<8 | int(transmitData.packets[i*3+2])
-		}
-
-		// NOTE: The mic sensor sends some zeros at the beginning, we want to eliminate those
-		for i, amp := range amplitude {
-			if i > 512 {
-				break
-			}
-			if amp != 0 {
-				// First non-zero byte found
-				amplitude = amplitude[i:]
-				break
-			}
-		}
-
-		measurements = append(measurements,
-			map[string]interface{}{
-				"sensor_id":          model.MacToString(transmitData.macAddress),
-				"time":               transmitData.timestamp,
-				"measurement_type":   transmitData.dataType,
-				"sampling_frequency": transmitData.samplingFrequency,
-				"raw_data":           amplitude,
-			},
-		)
-	} else {
-		out.Logger.Println("Invalid audio data received. Packets of length", len(transmitData.packets), "not multiple of 3.")
+	// Workers take it from here, never wait on the network in a BLE callback
+	if err := queueMeasurements(jsonData, transmitData); err != nil {
+		out.Logger.Println("Error:", err)
 	}
-	return measurements
 }
 
 // Map device address to byte cache
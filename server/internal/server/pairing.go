@@ -68,8 +68,8 @@ func ConnectedDevices() []SensorStatus {
 	for _, sensor := range model.Sensors {
 		connected := false
 		// Intersect with bluetooth connected devices
-		for _, dev := range adapter.GetConnectedDevices() {
-			if sensor.IsMacEqual(dev.Address.MAC.String()) {
+		for _, mac := range transport.ConnectedDevices() {
+			if sensor.Mac == mac {
 				connected = true
 				break
 			}
@@ -87,17 +87,13 @@ func ConnectedDevices() []SensorStatus {
 
 // If device is already written down
 func sensorExists(MAC [6]byte) *model.Sensor {
-	for _, sens := range model.Sensors {
-		for m := range MAC {
-			if MAC[m] != sens.Mac[m] {
-				// Get next sensor
-				break
-			}
-			// Exact match, early out with true
-			return &sens
+	for i, sens := range model.Sensors {
+		if sens.Mac == MAC {
+			// Exact match, early out
+			return &model.Sensors[i]
 		}
 	}
-	// No sensors matched, false
+	// No sensors matched
 	return nil
 }
 
@@ -115,6 +111,7 @@ func pairDeviceConnected(MAC [6]byte) bool {
 		sensor.UpdateLastSeen(model.SensorActivityIdle)
 		// Log that device already exists
 		out.Broadcast("SENSOR-CONNECTED:" + model.MacToString(MAC))
+		sendSinkStatus("SENSOR-CONNECTED", MAC)
 		return false
 	} else {
 		out.Logger.Println("pairConnectedDevice newly discovered " + model.MacToString(MAC))
@@ -133,6 +130,9 @@ func pairDeviceDisconnected(MAC [6]byte) bool {
 		out.Broadcast("PAIR-DEVICE-DISCONNECTED: " + model.MacToString(MAC))
 	}
 	out.Broadcast("SENSOR-DISCONNECTED:" + model.MacToString(MAC))
+	if sensorExists(MAC) != nil {
+		sendSinkStatus("SENSOR-DISCONNECTED", MAC)
+	}
 
 	return true
 }
@@ -169,7 +169,7 @@ func pairReceiveCapabilities(MAC [6]byte, data []byte) bool {
 	// Parse sensor information
 	// from protocol.md
 	// data types (1 byte) | collection capacity in bytes (4 bytes) | sensor model (1 byte)
-	// Data types: b(0 0 0 0 0 vibration temperature audio)
+	// Data types: b(0 0 0 0 flux vibration temperature audio)
 	// Save sensors to memory
 	bit_types := map[byte]string{
 		1 << 0: "audio",
@@ -177,20 +177,24 @@ func pairReceiveCapabilities(MAC [6]byte, data []byte) bool {
 		1 << 2: "vibration",
 		1 << 3: "flux",
 	}
+	if model, ok := model.SENSOR_MODELS[data[5]]; ok {
+		req.announcedModel = model
+	} else {
+		req.announcedModel = "unknown"
+	}
+
 	for bit, name := range bit_types {
 		// If bit is turned on
 		if data[0]&bit == bit {
+			if _, ok := FLUX_SCALE[req.announcedModel]; name == "flux" && !ok {
+				out.Logger.Println("Sensor", model.MacToString(MAC), "announces flux but board model", req.announcedModel, "has no flux sensor, pairing without it")
+				continue
+			}
 			req.dataTypes = append(req.dataTypes, name)
 		}
 	}
 	req.collectionCapacity = binary.LittleEndian.Uint32(data[1:5])
 
-	if model, ok := model.SENSOR_MODELS[data[5]]; ok {
-		req.announcedModel = model
-	} else {
-		req.announcedModel = "unknown"
-	}
-
 	req.announcedSensors = true
 	state.requested[MAC] = req
 
@@ -213,7 +217,7 @@ func pairConfirmation(mac [6]byte) {
 	// Display pair code inline with each entry?
 	// Or just do it automatically over serial maybe
 	// Write sensor data to disk
-	model.AddSensor(mac, state.requested[mac].dataTypes, state.requested[mac].collectionCapacity)
+	model.AddSensor(mac, state.requested[mac].announcedModel, state.requested[mac].dataTypes, state.requested[mac].collectionCapacity)
 	delete(state.requested, mac)
 
 	// I'm 80% sure GUI reads this for pairing information
@@ -244,5 +248,5 @@ func Pair(mac [6]byte) {
 }
 
 func DisconnectDevice(mac [6]byte) {
-	//adapter.
+	//transport.
 }
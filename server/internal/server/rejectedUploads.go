@@ -0,0 +1,371 @@
+package server
+
+/*
+ * Dead letters: files a sink refused for good (400, 404, 422...) are not
+ * retried anymore. A copy goes to the rejected folder with the response, to be
+ * looked at, requeued once the destination is fixed, or deleted.
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+const REJECTED_INDEX_FILE = "rejected_uploads.json"
+
+type uploadFailure int
+
+const (
+	FAILURE_RETRYABLE uploadFailure = iota // 5xx, 408, 429, timeouts, network errors
+	FAILURE_AUTH                           // 401 and 403, retried until the credentials are fixed
+	FAILURE_PERMANENT                      // Any other 4xx, or a file that isn't valid json
+)
+
+func classifyUploadError(err error) uploadFailure {
+	var httpErr *model.HTTPError
+	if errors.As(err, &httpErr) {
+		switch {
+		case httpErr.StatusCode == http.StatusUnauthorized || httpErr.StatusCode == http.StatusForbidden:
+			return FAILURE_AUTH
+		case httpErr.StatusCode == http.StatusRequestTimeout || httpErr.StatusCode == http.StatusTooEarly ||
+			httpErr.StatusCode == http.StatusTooManyRequests:
+			return FAILURE_RETRYABLE
+		case httpErr.StatusCode >= 400 && httpErr.StatusCode < 500:
+			return FAILURE_PERMANENT
+		}
+		return FAILURE_RETRYABLE
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return FAILURE_PERMANENT
+	}
+	return FAILURE_RETRYABLE
+}
+
+type RejectedUpload struct {
+	Id          string    `json:"id"`           // Stable for a file and a sink
+	File        string    `json:"file"`         // Name in the rejected folder
+	Sink        string    `json:"sink"`         //
+	Sensor      string    `json:"sensor"`       // MAC address
+	DataType    string    `json:"data_type"`    //
+	CaptureTime time.Time `json:"capture_time"` //
+	Size        int64     `json:"size"`         // Bytes of json
+	Attempts    int       `json:"attempts"`     // Deliveries tried, the rejected one included
+	RejectedAt  time.Time `json:"rejected_at"`  //
+	StatusCode  int       `json:"status_code"`  // 0 if the sink isn't HTTP or the file wasn't sent
+	Response    string    `json:"response"`     // Body of the response, or the error
+}
+
+var rejectedIndex = map[string]RejectedUpload{}
+var rejectedMutex sync.Mutex
+
+func rejectedDataDir() string {
+	dir := path.Join(dataDir(), "/rejected_data/")
+	err := os.MkdirAll(dir, dirPermCode)
+	if err != nil {
+		out.Logger.Panic(err.Error())
+	}
+	return dir
+}
+
+func rejectedIndexPath() string {
+	return path.Join(dataDir(), REJECTED_INDEX_FILE)
+}
+
+func rejectedId(file string, sink string) string {
+	sum := sha256.Sum256([]byte(file + "\x00" + sink))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Read the saved index, dropping entries whose copy is gone
+func loadRejectedIndex() {
+	rejectedMutex.Lock()
+	rejectedIndex = map[string]RejectedUpload{}
+	jsonStr, err := os.ReadFile(rejectedIndexPath())
+	if errors.Is(err, os.ErrNotExist) {
+		rejectedMutex.Unlock()
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(jsonStr, &rejectedIndex)
+	}
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
+	rejectedMutex.Unlock()
+	dropMissingRejected()
+}
+
+// Forget the entries whose copy is gone, deleted by hand or pruned
+func dropMissingRejected() {
+	rejectedMutex.Lock()
+	defer rejectedMutex.Unlock()
+	for id, entry := range rejectedIndex {
+		if _, err := os.Stat(path.Join(rejectedDataDir(), entry.File)); err != nil {
+			delete(rejectedIndex, id)
+		}
+	}
+	saveRejectedIndex()
+}
+
+// Caller holds rejectedMutex
+func saveRejectedIndex() {
+	jsonStr, err := json.MarshalIndent(rejectedIndex, "", "\t")
+	if err != nil {
+		out.Logger.Println("Error:", err)
+		return
+	}
+	tmp := rejectedIndexPath() + ".tmp"
+	if err := os.WriteFile(tmp, jsonStr, filePermCode); err != nil {
+		out.Logger.Println("Error:", err)
+		return
+	}
+	if err := os.Rename(tmp, rejectedIndexPath()); err != nil {
+		out.Logger.Println("Error:", err)
+	}
+}
+
+// Stop delivering a file to a sink and keep a copy of it, and of its raw
+// capture, in the rejected folder. false if the copy couldn't be written.
+func rejectUpload(job uploadJob, data []byte, err error) bool {
+	entry, _ := pendingEntry(job.file)
+	rejected := RejectedUpload{
+		Id:          rejectedId(job.file, job.sink),
+		File:        job.file,
+		Sink:        job.sink,
+		Sensor:      entry.Sensor,
+		DataType:    entry.DataType,
+		CaptureTime: entry.CaptureTime,
+		Size:        int64(len(data)),
+		Attempts:    entry.Sinks[job.sink].Attempts + 1,
+		RejectedAt:  time.Now(),
+		Response:    err.Error(),
+	}
+	var httpErr *model.HTTPError
+	if errors.As(err, &httpErr) {
+		rejected.StatusCode = httpErr.StatusCode
+		rejected.Response = httpErr.Body
+	}
+
+	if diskReserved(rejectedDataDir(), "rejected uploads") {
+		// Retried like any failure until there is room for the copy
+		return false
+	}
+	writeErr := os.WriteFile(path.Join(rejectedDataDir(), job.file), data, filePermCode)
+	if writeErr != nil {
+		out.Logger.Println("Error:", writeErr)
+		return false
+	}
+	fromBin, fromMeta := capturePaths(unsentDataDir(), job.file)
+	toBin, toMeta := capturePaths(rejectedDataDir(), job.file)
+	for from, to := range map[string]string{fromBin: toBin, fromMeta: toMeta} {
+		if err := copyFile(from, to); err != nil && !errors.Is(err, os.ErrNotExist) {
+			out.Logger.Println("Error:", err)
+		}
+	}
+
+	rejectedMutex.Lock()
+	rejectedIndex[rejected.Id] = rejected
+	saveRejectedIndex()
+	rejectedMutex.Unlock()
+	rejectPending(job.file, job.sink, err)
+
+	out.Logger.Println("Upload of", job.file, "rejected by", job.sink+", not retrying. Error:", err)
+	out.Broadcast("UPLOAD-REJECTED")
+	return true
+}
+
+func copyFile(from string, to string) error {
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(to, data, filePermCode)
+}
+
+// Rejected uploads matching the filter, most recently rejected first, and how
+// many match in total
+func RejectedUploads(filter PendingFilter) ([]RejectedUpload, int) {
+	rejectedMutex.Lock()
+	result := []RejectedUpload{}
+	for _, entry := range rejectedIndex {
+		if filter.Sensor != "" && !strings.EqualFold(entry.Sensor, filter.Sensor) {
+			continue
+		}
+		if filter.DataType != "" && entry.DataType != filter.DataType {
+			continue
+		}
+		if filter.Sink != "" && entry.Sink != filter.Sink {
+			continue
+		}
+		result = append(result, entry)
+	}
+	rejectedMutex.Unlock()
+
+	slices.SortFunc(result, func(a, b RejectedUpload) int {
+		if c := b.RejectedAt.Compare(a.RejectedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Id, b.Id)
+	})
+	total := len(result)
+	result = result[min(filter.Offset, total):]
+	if filter.Limit > 0 && len(result) > filter.Limit {
+		result = result[:filter.Limit]
+	}
+	return result, total
+}
+
+// A rejected upload and where its copy is
+func RejectedUploadById(id string) (RejectedUpload, string, error) {
+	rejectedMutex.Lock()
+	defer rejectedMutex.Unlock()
+	entry, ok := rejectedIndex[id]
+	if !ok {
+		return entry, "", errors.New("rejected upload " + id + " doesn't exist")
+	}
+	return entry, path.Join(rejectedDataDir(), entry.File), nil
+}
+
+// Ids of the rejected uploads to act on, every one for "all"
+func rejectedIds(id string) ([]string, error) {
+	rejectedMutex.Lock()
+	defer rejectedMutex.Unlock()
+	if id == "all" {
+		ids := []string{}
+		for id := range rejectedIndex {
+			ids = append(ids, id)
+		}
+		return ids, nil
+	}
+	if _, ok := rejectedIndex[id]; !ok {
+		return nil, errors.New("rejected upload " + id + " doesn't exist")
+	}
+	return []string{id}, nil
+}
+
+// Deliver rejected uploads to their sink again, "all" for every one. Returns
+// how many were requeued.
+func RequeueRejectedUploads(id string) (int, error) {
+	ids, err := rejectedIds(id)
+	if err != nil {
+		return 0, err
+	}
+	errs := []error{}
+	count := 0
+	for _, id := range ids {
+		if err := requeueRejectedUpload(id); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		count++
+	}
+	return count, errors.Join(errs...)
+}
+
+func requeueRejectedUpload(id string) error {
+	rejectedMutex.Lock()
+	entry, ok := rejectedIndex[id]
+	rejectedMutex.Unlock()
+	if !ok {
+		return errors.New("rejected upload " + id + " doesn't exist")
+	}
+	if _, ok := Gateway.SinkConfig(entry.Sink); !ok {
+		return errors.New("sink " + entry.Sink + " of rejected upload " + id + " doesn't exist anymore")
+	}
+
+	unsent := path.Join(unsentDataDir(), entry.File)
+	if _, err := os.Stat(unsent); errors.Is(err, os.ErrNotExist) {
+		if err := copyFile(path.Join(rejectedDataDir(), entry.File), unsent); err != nil {
+			return err
+		}
+		fromBin, fromMeta := capturePaths(rejectedDataDir(), entry.File)
+		toBin, toMeta := capturePaths(unsentDataDir(), entry.File)
+		for from, to := range map[string]string{fromBin: toBin, fromMeta: toMeta} {
+			if err := copyFile(from, to); err != nil && !errors.Is(err, os.ErrNotExist) {
+				out.Logger.Println("Error:", err)
+			}
+		}
+	}
+
+	pending, ok := pendingEntry(entry.File)
+	if !ok {
+		// Gone from the unsent folder, only this sink still needs it
+		pending = PendingUpload{
+			File:        entry.File,
+			Sensor:      entry.Sensor,
+			DataType:    entry.DataType,
+			CaptureTime: entry.CaptureTime,
+			Size:        entry.Size,
+			Sinks:       map[string]DeliveryStatus{},
+		}
+		// Copied back above, its measurement_id is in it
+		if described, err := describeUnsentFile(entry.File); err == nil {
+			pending.Id = described.Id
+		}
+		for _, sink := range requiredSinks() {
+			if sink != entry.Sink {
+				pending.Sinks[sink] = DeliveryStatus{Delivered: true}
+			}
+		}
+	}
+	pending.Sinks = maps.Clone(pending.Sinks)
+	delete(pending.Sinks, entry.Sink)
+	addPending(pending)
+
+	removeRejected(id)
+	if slices.Contains(activeSinks(), entry.Sink) {
+		go scheduleUpload(uploadJob{file: entry.File, sink: entry.Sink}, 0)
+	}
+	return nil
+}
+
+// Forget rejected uploads and their copies, "all" for every one. Returns how
+// many were deleted.
+func DeleteRejectedUploads(id string) (int, error) {
+	ids, err := rejectedIds(id)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		removeRejected(id)
+	}
+	return len(ids), nil
+}
+
+// Drop an entry, and the copy of its file once no other sink's entry needs it
+func removeRejected(id string) {
+	rejectedMutex.Lock()
+	defer rejectedMutex.Unlock()
+	entry, ok := rejectedIndex[id]
+	if !ok {
+		return
+	}
+	delete(rejectedIndex, id)
+	saveRejectedIndex()
+	for _, other := range rejectedIndex {
+		if other.File == entry.File {
+			return
+		}
+	}
+	bin, meta := capturePaths(rejectedDataDir(), entry.File)
+	for _, file := range []string{path.Join(rejectedDataDir(), entry.File), bin, meta} {
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			out.Logger.Println("Error:", err)
+		}
+	}
+}
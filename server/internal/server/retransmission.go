@@ -0,0 +1,177 @@
+package server
+
+/*
+ * Asking sensors to resend the chunks that never made it, version 2 framing
+ */
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+// Seconds a transmission with missing chunks stays idle before asking for them
+const RETRANSMIT_DELAY = 2
+
+// Requests sent per transmission before giving up and letting it time out
+const RETRANSMIT_ATTEMPTS = 3
+
+// Missing ranges per request, keeps the notification under the MTU
+const MAX_RETRANSMIT_RANGES = 32
+
+type chunkRange struct {
+	first uint32
+	count uint16
+}
+
+// Place a version 2 chunk where it belongs. Returns false if nothing new was
+// stored, and the retransmission request to send if this chunk calls for one.
+func receiveChunk(t *Transmission, data []byte) (bool, []byte) {
+	mac := model.MacToString(t.macAddress)
+	if len(data) < SEQUENCE_LENGTH {
+		out.Logger.Println("Received", len(data), "bytes from", mac, "too short for a chunk index, dropping")
+		return false, nil
+	}
+	index := binary.LittleEndian.Uint32(data[:SEQUENCE_LENGTH])
+	data = data[SEQUENCE_LENGTH:]
+	if int(index) >= len(t.received) {
+		out.Logger.Println("Chunk", index, "from", mac, "out of range, transmission has", len(t.received), "chunks")
+		return false, nil
+	}
+	start := int(index) * int(t.chunkSize)
+	end := min(start+int(t.chunkSize), int(t.totalLength))
+	if len(data) != end-start {
+		out.Logger.Println("Chunk", index, "from", mac, "has", len(data), "bytes, expected", end-start)
+		return false, nil
+	}
+	if t.received[index] {
+		out.Logger.Println("Duplicate chunk", index, "from", mac, "ignored")
+		countTransfer(t.macAddress, func(s *TransferStats) { s.Duplicates++ })
+		return false, nil
+	}
+
+	if _, err := t.data.WriteAt(data, int64(start)); err != nil {
+		out.Logger.Println("Error:", err)
+		return false, nil
+	}
+	t.received[index] = true
+	t.receivedChunks++
+	t.currentLength += len(data)
+	if t.retransmitCount > 0 {
+		countTransfer(t.macAddress, func(s *TransferStats) { s.RetransmittedChunks++ })
+	}
+
+	// Last chunk is in but some are missing, no need to wait for the idle timer
+	if int(index) == len(t.received)-1 && !t.complete() && t.retransmitCount == 0 {
+		return true, retransmissionRequest(t)
+	}
+	return true, nil
+}
+
+func (t *Transmission) shouldRequestRetransmission(now int64) bool {
+	return t.version >= 2 && !t.complete() && t.retransmitCount < RETRANSMIT_ATTEMPTS && now-t.lastActivity >= RETRANSMIT_DELAY
+}
+
+// Consecutive runs of chunks not received yet, at most limit of them
+func missingRanges(t *Transmission, limit int) []chunkRange {
+	ranges := []chunkRange{}
+	for i := 0; i < len(t.received) && len(ranges) < limit; i++ {
+		if t.received[i] {
+			continue
+		}
+		r := chunkRange{first: uint32(i)}
+		for i < len(t.received) && !t.received[i] && r.count < 0xFFFF {
+			r.count++
+			i++
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// MAC address reversed (6 bytes) | data type (1 byte) | number of ranges (1 byte) | repeat {first chunk index (4 bytes) | chunk count (2 bytes)}
+func retransmissionPayload(t *Transmission) []byte {
+	ranges := missingRanges(t, MAX_RETRANSMIT_RANGES)
+	payload := make([]byte, 0, 8+len(ranges)*6)
+	for i := range t.macAddress {
+		payload = append(payload, t.macAddress[len(t.macAddress)-i-1])
+	}
+	typeByte, _ := dataTypeByte(t.dataType)
+	payload = append(payload, typeByte, byte(len(ranges)))
+	for _, r := range ranges {
+		payload = binary.LittleEndian.AppendUint32(payload, r.first)
+		payload = binary.LittleEndian.AppendUint16(payload, r.count)
+	}
+	return payload
+}
+
+// Count a request for the chunks t is missing and build it, nil if none are.
+// Send it with sendRetransmission once the locks are released.
+func retransmissionRequest(t *Transmission) []byte {
+	missing := len(t.received) - t.receivedChunks
+	if missing == 0 {
+		return nil
+	}
+	if t.retransmitCount == 0 {
+		countTransfer(t.macAddress, func(s *TransferStats) { s.MissingChunks += missing })
+	}
+	t.retransmitCount++
+	// Give the sensor a full timeout to answer
+	t.lastActivity = time.Now().Unix()
+	countTransfer(t.macAddress, func(s *TransferStats) { s.RetransmitRequests++ })
+
+	out.Logger.Println("Requesting", missing, "missing", t.dataType, "chunks from", model.MacToString(t.macAddress),
+		"attempt", t.retransmitCount, "/", RETRANSMIT_ATTEMPTS)
+	return retransmissionPayload(t)
+}
+
+// Notify the sensor of the chunks it needs to send again
+func sendRetransmission(payload []byte) {
+	err := transport.Notify(CONFIG_RETRANSMIT_CHRC_UUID, payload)
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
+}
+
+// For sensors that poll instead of subscribing, the pending request of any of
+// their transmissions, or a single zero byte if there is none
+func retransmissionRequestFor(address string) []byte {
+	mac, err := model.StringToMac(address)
+	if err != nil {
+		return []byte{0x0}
+	}
+	keys := []transmissionKey{}
+	transmissionMutex.RLock()
+	for key := range transmissions {
+		if key.mac == mac {
+			keys = append(keys, key)
+		}
+	}
+	transmissionMutex.RUnlock()
+	for _, key := range keys {
+		// Chunks are placed under the lock of their transmission
+		lock := transmissionLock(key)
+		lock.Lock()
+		transmissionMutex.RLock()
+		t, ok := transmissions[key]
+		transmissionMutex.RUnlock()
+		if ok && !t.stale && t.retransmitCount > 0 && !t.complete() {
+			payload := retransmissionPayload(&t)
+			lock.Unlock()
+			return payload
+		}
+		lock.Unlock()
+	}
+	return []byte{0x0}
+}
+
+func dataTypeByte(dataType string) (byte, bool) {
+	for b, name := range DATA_TYPES {
+		if name == dataType {
+			return b, true
+		}
+	}
+	return 0xFF, false
+}
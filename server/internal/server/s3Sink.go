@@ -0,0 +1,363 @@
+package server
+
+/*
+ * Storing raw captures in an S3 compatible bucket (AWS, MinIO...), each as
+ * the bytes the sensor sent plus a json sidecar describing them
+ */
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+// Options of s3 sinks, "endpoint" and "bucket" are required:
+//   - endpoint: eg.: https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+//   - bucket, region (us-east-1 by default), access_key, secret_key
+//   - prefix: prepended to every key
+//   - types: comma separated data types to store, vibration,audio by default
+//   - part_size: MiB per part of a multipart upload, 8 by default, 5 at least
+//   - path_style: false to put the bucket in the host name, true by default
+var S3_OPTIONS = []string{"endpoint", "bucket", "region", "access_key", "secret_key", "prefix", "types", "part_size", "path_style"}
+
+const S3_DEFAULT_TYPES = "vibration,audio"
+
+const S3_DEFAULT_PART_SIZE = 8
+
+// S3 refuses smaller parts, except the last one
+const S3_MIN_PART_SIZE = 5
+
+// Tries of a single request before the upload queue retries the whole capture
+const S3_ATTEMPTS = 3
+
+type s3Sink struct {
+	gateway   *model.Gateway
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string
+	types     []string
+	partSize  int // Bytes
+	pathStyle bool
+}
+
+func init() {
+	RegisterSinkType("s3", newS3Sink)
+}
+
+func newS3Sink(config model.SinkConfig, gateway *model.Gateway) (Sink, error) {
+	for option := range config.Options {
+		if !slices.Contains(S3_OPTIONS, option) {
+			return nil, errors.New("option " + option + " doesn't exist for s3 sinks (must be one of " + strings.Join(S3_OPTIONS, ", ") + ")")
+		}
+	}
+	option := func(name string, fallback string) string {
+		if value, ok := config.Options[name]; ok {
+			return value
+		}
+		return fallback
+	}
+
+	s := &s3Sink{
+		gateway:   gateway,
+		bucket:    option("bucket", ""),
+		region:    option("region", "us-east-1"),
+		accessKey: option("access_key", ""),
+		secretKey: option("secret_key", ""),
+		prefix:    strings.Trim(option("prefix", ""), "/"),
+		types:     strings.Split(option("types", S3_DEFAULT_TYPES), ","),
+	}
+	if option("endpoint", "") == "" || s.bucket == "" {
+		return nil, errors.New("options endpoint and bucket are required for s3 sinks")
+	}
+	var err error
+	s.endpoint, err = url.Parse(option("endpoint", ""))
+	if err != nil || s.endpoint.Host == "" {
+		return nil, errors.New("invalid value for option endpoint (must be like https://<host>)")
+	}
+	partSize, err := strconv.Atoi(option("part_size", strconv.Itoa(S3_DEFAULT_PART_SIZE)))
+	if err != nil || partSize < S3_MIN_PART_SIZE {
+		return nil, errors.New("invalid value for option part_size (must be a number of MiB, " + strconv.Itoa(S3_MIN_PART_SIZE) + " or more)")
+	}
+	s.partSize = partSize << 20
+	s.pathStyle, err = strconv.ParseBool(option("path_style", "true"))
+	if err != nil {
+		return nil, errors.New("invalid value for option path_style (must be true or false)")
+	}
+	return s, nil
+}
+
+// Decoded measurements are left to the other sinks, see SendCapture
+func (s *s3Sink) Send(jsonData []byte) error {
+	return nil
+}
+
+// <prefix>/<gateway>/<sensor>/<type>/<date>/<time>.bin and .json
+func (s *s3Sink) SendCapture(capture Capture) error {
+	m := capture.Metadata
+	if !slices.Contains(s.types, m.DataType) {
+		return nil
+	}
+	t := m.Time.UTC()
+	key := strings.Join([]string{
+		m.GatewayId,
+		strings.ReplaceAll(m.SensorId, ":", ""),
+		m.DataType,
+		t.Format(time.DateOnly),
+		t.Format("150405.000000000"),
+	}, "/")
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+
+	// Sidecar last, its presence means the capture is complete
+	if err := s.putFile(key+".bin", capture.Path); err != nil {
+		return err
+	}
+	metadata, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = s.request(http.MethodPut, key+".json", nil, metadata)
+	return err
+}
+
+func (s *s3Sink) putFile(key string, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() <= int64(s.partSize) {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		_, err = s.request(http.MethodPut, key, nil, data)
+		return err
+	}
+	return s.putMultipart(key, f)
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *s3Sink) putMultipart(key string, f io.Reader) error {
+	resp, err := s.request(http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp, &initiated); err != nil || initiated.UploadId == "" {
+		return errors.New("S3 did not start the multipart upload of " + key)
+	}
+
+	parts := []s3Part{}
+	buffer := make([]byte, s.partSize)
+	for {
+		n, readErr := io.ReadFull(f, buffer)
+		if n > 0 {
+			number := len(parts) + 1
+			query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiated.UploadId}}
+			etag, err := s.requestETag(http.MethodPut, key, query, buffer[:n])
+			if err != nil {
+				s.abortMultipart(key, initiated.UploadId)
+				return err
+			}
+			parts = append(parts, s3Part{PartNumber: number, ETag: etag})
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			s.abortMultipart(key, initiated.UploadId)
+			return readErr
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err = s.request(http.MethodPost, key, url.Values{"uploadId": {initiated.UploadId}}, body)
+	if err == nil && bytes.Contains(resp, []byte("<Error>")) {
+		// Completing can fail after a 200
+		err = errors.New("S3 could not complete the multipart upload of " + key + ": " + string(resp))
+	}
+	if err != nil {
+		s.abortMultipart(key, initiated.UploadId)
+	}
+	return err
+}
+
+// Free the parts already stored, best effort
+func (s *s3Sink) abortMultipart(key string, uploadId string) {
+	if _, err := s.request(http.MethodDelete, key, url.Values{"uploadId": {uploadId}}, nil); err != nil {
+		out.Logger.Println("Error:", err)
+	}
+}
+
+// Body of the response
+func (s *s3Sink) request(method string, key string, query url.Values, body []byte) ([]byte, error) {
+	resp, _, err := s.do(method, key, query, body)
+	return resp, err
+}
+
+// ETag of the response
+func (s *s3Sink) requestETag(method string, key string, query url.Values, body []byte) (string, error) {
+	_, header, err := s.do(method, key, query, body)
+	if err != nil {
+		return "", err
+	}
+	return header.Get("ETag"), nil
+}
+
+// Signed request, retried on network errors and 5xx
+func (s *s3Sink) do(method string, key string, query url.Values, body []byte) ([]byte, http.Header, error) {
+	client, err := s.gateway.HTTPClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	for attempt := 1; attempt <= S3_ATTEMPTS; attempt++ {
+		var resp *http.Response
+		resp, err = client.Do(s.sign(method, key, query, body))
+		if err == nil {
+			var reader io.Reader = resp.Body
+			if resp.StatusCode >= 300 {
+				reader = io.LimitReader(resp.Body, model.HTTP_ERROR_BODY_LIMIT)
+			}
+			var data []byte
+			data, err = io.ReadAll(reader)
+			resp.Body.Close()
+			if err == nil && resp.StatusCode < 300 {
+				return data, resp.Header, nil
+			}
+			if err == nil {
+				err = fmt.Errorf("S3 %s %s: %w", method, key, &model.HTTPError{StatusCode: resp.StatusCode, Body: string(data)})
+			}
+			if resp.StatusCode < 500 {
+				// Not going to get better by asking again
+				return nil, nil, err
+			}
+		}
+		if attempt < S3_ATTEMPTS {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return nil, nil, err
+}
+
+// Request signed with AWS Signature Version 4
+func (s *s3Sink) sign(method string, key string, query url.Values, body []byte) *http.Request {
+	u := *s.endpoint
+	escapedPath := "/" + s3Escape(key, false)
+	if s.pathStyle {
+		escapedPath = strings.TrimSuffix(u.Path, "/") + "/" + s3Escape(s.bucket, true) + escapedPath
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		escapedPath = strings.TrimSuffix(u.Path, "/") + escapedPath
+	}
+	u.Path, _ = url.PathUnescape(escapedPath)
+	u.RawPath = escapedPath
+
+	// Canonical query: sorted keys, strictly escaped
+	keys := []string{}
+	for k := range query {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(query.Get(k), true))
+	}
+	u.RawQuery = strings.Join(pairs, "&")
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req, _ := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		escapedPath,
+		u.RawQuery,
+		"host:" + u.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		"host;x-amz-content-sha256;x-amz-date",
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="+signature)
+	return req
+}
+
+// URI encoding of SigV4, everything but unreserved characters, and slashes
+// unless encodeSlash
+func s3Escape(str string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(str) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s *s3Sink) Close() error {
+	return nil
+}
@@ -0,0 +1,48 @@
+package server
+
+/*
+ * Keeping what arrived of a transmission that timed out, for data types
+ * whose partial policy asks for it
+ */
+
+import (
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+// Bytes from the start of the data that arrived without a gap
+func (t *Transmission) salvageableLength() int {
+	if t.version < 2 {
+		return t.intactLength
+	}
+	for i, received := range t.received {
+		if !received {
+			return i * int(t.chunkSize)
+		}
+	}
+	return int(t.totalLength)
+}
+
+// Cut a timed out transmission down to its intact part, whole samples only.
+// Returns false if nothing worth decoding is left.
+func salvage(t *Transmission) bool {
+	length := t.salvageableLength()
+	if size := model.DATA_SIZE[t.dataType]; size > 0 {
+		length -= length % size
+	}
+	if length == 0 {
+		return false
+	}
+	if err := t.data.Truncate(length); err != nil {
+		out.Logger.Println("Error:", err)
+		return false
+	}
+	t.partial = true
+	t.corrupt = ""
+	t.endTimestamp = time.Now()
+	countTransfer(t.macAddress, func(s *TransferStats) { s.Salvaged++ })
+	out.Logger.Println("Salvaged", length, "/", t.totalLength, "bytes of", t.dataType, "transmission from", model.MacToString(t.macAddress))
+	return true
+}
@@ -2,7 +2,6 @@ package server
 
 import (
 	"encoding/binary"
-	"errors"
 	"os"
 	"os/signal"
 	"time"
@@ -14,7 +13,8 @@ import (
 
 const DEFAULT_GATEWAY_HTTP_ENDPOINT = "https://openphm.org/gateway_data"
 
-var adapter = bluetooth.DefaultAdapter
+// Radio used to talk to sensors, BLE or fake
+var transport Transport
 
 var DATA_SERVICE_UUID = bluetooth.MustParseUUID("2deacc71-7b29-4ff4-8fc2-59461c7a73f5")
 var DEBUG_DATA_CHRC_UUID = bluetooth.MustParseUUID("ad690aaa-cfd4-4b4a-96a6-1110cb6782f6")
@@ -24,6 +24,7 @@ var FLUX_DATA_CHRC_UUID = bluetooth.MustParseUUID("68e92ad3-0fb5-4c93-8b99-0d217
 var RTD_DATA_CHRC_UUID = bluetooth.MustParseUUID("e64d1230-86ba-46aa-a62d-736d6f58226c")
 var ACCEL_DATA_CHRC_UUID = bluetooth.MustParseUUID("e70ada20-ac8e-45f8-9f5d-593226bb7284")
 var MIC_DATA_CHRC_UUID = bluetooth.MustParseUUID("fee1ed78-2a76-490e-8a7c-9b698c9202d1")
+var BATTERY_DATA_CHRC_UUID = bluetooth.MustParseUUID("3f1c5f3e-8d0b-4c6a-9e3d-2b7a41c9d5e0")
 
 var CONFIG_SERVICE_UUID, _ = bluetooth.ParseUUID("0ffd06bd-5f9c-4583-b852-e92fdbe8e862")
 var CONFIG_IDENTIFY_CHRC_UUID, _ = bluetooth.ParseUUID("4a488208-f3b9-414f-85c7-17eb16c653b0")
@@ -32,6 +33,9 @@ var CONFIG_TIME_UUID, _ = bluetooth.ParseUUID("7aeb6aa1-5e11-4543-ba04-a6d1d6bf9
 // Chrc to notify a sensor to start sending data immediately.
 var CONFIG_START_SAMPLING_CHRC_UUID, _ = bluetooth.ParseUUID("f6344769-e905-4c4d-a6e8-0aa8b63f1153")
 
+// Chrc to notify a sensor of chunks to send again.
+var CONFIG_RETRANSMIT_CHRC_UUID, _ = bluetooth.ParseUUID("beb377ef-41eb-4df1-a335-6667295033ef")
+
 // Chrc to notify a sensor of next wake up time.
 var CONFIG_WAKE_AT_CHRC_UUID, _ = bluetooth.ParseUUID("9203c6cb-b4d4-49e2-a84d-415d2cb790f1")
 
@@ -43,25 +47,21 @@ var DATA_TYPES = map[byte]string{
 	0x04: "flux",
 }
 
-var pairResponseCharacteristic bluetooth.Characteristic
-var settingsCharacteristic bluetooth.Characteristic
-var configWakeAtChar bluetooth.Characteristic
-var configStartSampleChar bluetooth.Characteristic
-var configTimeChar bluetooth.Characteristic
-
 // Gateway config
 var Gateway *model.Gateway
 
 // List of devices flagged for collection
 var flaggedForCollect []string
 
-func Init(g *model.Gateway) error {
+func Init(g *model.Gateway, t Transport) error {
 	dataDir() // ensure data dir exists
 	unsentDataDir()
 	archivedDataDir()
+	clearTransferDataDir()
 	Gateway = g
+	transport = t
 
-	err := adapter.Enable()
+	err := transport.Enable()
 	if err != nil {
 		return err
 	}
@@ -74,13 +74,13 @@ func Init(g *model.Gateway) error {
 	// Data collection service, requires pairing and bonding for authentication
 	// https://lpccs-docs.renesas.com/Tutorial-DA145x-BLE-Security/ble_security.html
 	// Out of Band could be done with a USB serial connection
-	dataService := bluetooth.Service{
+	dataService := Service{
 		UUID: DATA_SERVICE_UUID,
-		Characteristics: []bluetooth.CharacteristicConfig{
+		Characteristics: []Characteristic{
 			{
 				UUID:  DEBUG_DATA_CHRC_UUID,
 				Flags: bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicWriteWithoutResponsePermission,
-				WriteEvent: func(client bluetooth.Connection, address string, offset int, value []byte) {
+				WriteEvent: func(address string, value []byte) {
 					// Dump any data received into a bin file
 					handleDebugData(address, value)
 				},
@@ -93,46 +93,55 @@ func Init(g *model.Gateway) error {
 			{
 				UUID:  ACCEL_DATA_CHRC_UUID,
 				Flags: bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicWriteWithoutResponsePermission,
-				// offset is used for when the MTU is less than 512 bytes, but maybe bluez handles that???
-				WriteEvent: func(client bluetooth.Connection, address string, offset int, value []byte) {
-					handleData("vibration", client, address, offset, value)
+				WriteEvent: func(address string, value []byte) {
+					handleData("vibration", address, value)
 				},
 			},
 			{
 				UUID:  FLUX_DATA_CHRC_UUID,
 				Flags: bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicWriteWithoutResponsePermission,
-				WriteEvent: func(client bluetooth.Connection, address string, offset int, value []byte) {
-					handleData("flux", client, address, offset, value)
+				WriteEvent: func(address string, value []byte) {
+					handleData("flux", address, value)
 				},
 			},
 			{
 				UUID:  MIC_DATA_CHRC_UUID,
 				Flags: bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicWriteWithoutResponsePermission,
-				WriteEvent: func(client bluetooth.Connection, address string, offset int, value []byte) {
-					handleData("audio", client, address, offset, value)
+				WriteEvent: func(address string, value []byte) {
+					handleData("audio", address, value)
 				},
 			},
 			{
 				UUID:  RTD_DATA_CHRC_UUID,
 				Flags: bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicWriteWithoutResponsePermission,
-				WriteEvent: func(client bluetooth.Connection, address string, offset int, value []byte) {
-					handleData("temperature", client, address, offset, value)
+				WriteEvent: func(address string, value []byte) {
+					handleData("temperature", address, value)
+				},
+			},
+			{
+				// Battery report, see protocol.md
+				UUID:  BATTERY_DATA_CHRC_UUID,
+				Flags: bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicWriteWithoutResponsePermission,
+				WriteEvent: func(address string, value []byte) {
+					handleBatteryData(address, value)
 				},
 			},
 		},
 	}
-	adapter.AddService(&dataService)
+	err = transport.AddService(dataService)
+	if err != nil {
+		return err
+	}
 
-	configService := bluetooth.Service{
+	configService := Service{
 		UUID: CONFIG_SERVICE_UUID,
-		Characteristics: []bluetooth.CharacteristicConfig{
+		Characteristics: []Characteristic{
 			{
 				// Keep this, use for devices to manage settings
-				Handle: &settingsCharacteristic,
-				UUID:   CONFIG_IDENTIFY_CHRC_UUID,
-				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicNotifyPermission,
+				UUID:  CONFIG_IDENTIFY_CHRC_UUID,
+				Flags: bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicWritePermission | bluetooth.CharacteristicNotifyPermission,
 				// WriteEvent to collect device information
-				WriteEvent: func(connection bluetooth.Connection, address string, offset int, value []byte) {
+				WriteEvent: func(address string, value []byte) {
 					mac, err := bluetooth.ParseMAC(address)
 					if err != nil {
 						out.Logger.Println("SettingsCharacteristic: Failed to parse MAC", address)
@@ -146,17 +155,16 @@ func Init(g *model.Gateway) error {
 				},
 				// ReadEvent to return device-appropriate settings
 				// Also how...
-				ReadEvent: func(client bluetooth.Connection, address string, offset int) []byte {
+				ReadEvent: func(address string) []byte {
 					out.Logger.Println("Device", address, "requested settings")
 					return getSettingsForSensor(address)
 				},
 			},
 			{
 				// Separate from settings characteristic to reduce latency
-				Handle: &configTimeChar,
-				UUID:   CONFIG_TIME_UUID,
-				Flags:  bluetooth.CharacteristicReadPermission,
-				ReadEvent: func(_ bluetooth.Connection, _ string, _ int) []byte {
+				UUID:  CONFIG_TIME_UUID,
+				Flags: bluetooth.CharacteristicReadPermission,
+				ReadEvent: func(_ string) []byte {
 					var now int64 = time.Now().UnixMicro()
 					return binary.LittleEndian.AppendUint64([]byte{}, uint64(now))
 				},
@@ -164,10 +172,9 @@ func Init(g *model.Gateway) error {
 			{
 				// Signals to devices if they should start sampling immediately
 				// works if device is awake and connected, mostly for debugging transmission speed
-				Handle: &configStartSampleChar,
-				UUID:   CONFIG_START_SAMPLING_CHRC_UUID,
-				Flags:  bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
-				ReadEvent: func(client bluetooth.Connection, address string, offset int) []byte {
+				UUID:  CONFIG_START_SAMPLING_CHRC_UUID,
+				Flags: bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+				ReadEvent: func(address string) []byte {
 					for i, dev := range flaggedForCollect {
 						if dev == address {
 							// Remove flag FIXME: this is just invalid code.
@@ -180,9 +187,17 @@ func Init(g *model.Gateway) error {
 					return []byte{0x0}
 				},
 			},
+			{
+				// Lists chunks of an upload that never arrived, see protocol.md
+				UUID:  CONFIG_RETRANSMIT_CHRC_UUID,
+				Flags: bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+				ReadEvent: func(address string) []byte {
+					return retransmissionRequestFor(address)
+				},
+			},
 		},
 	}
-	err = adapter.AddService(&configService)
+	err = transport.AddService(configService)
 	if err != nil {
 		return err
 	}
@@ -194,36 +209,28 @@ func Init(g *model.Gateway) error {
 	 * Could the default agent handle it? Think of supplying a code other than 0000
 	 * Alternative would be to accept pairing only if device sends MAC address over serial
 	 */
-	adapter.SetConnectHandler(func(device bluetooth.Device, connected bool) {
+	transport.SetConnectHandler(func(mac [6]byte, connected bool) {
 		if connected {
-			// NOTE upstream go bluetooth MAC address arrays are reversed
-			// This here works if using the patched branch
 			// On connect add to list of devices pending pairing
-			pairDeviceConnected(device.Address.MAC)
-			out.Logger.Println("Bluetooth connection with device", device.Address.MAC.String())
+			pairDeviceConnected(mac)
+			out.Logger.Println("Bluetooth connection with device", model.MacToString(mac))
 		} else {
-			pairDeviceDisconnected(device.Address.MAC)
-			out.Logger.Println("Bluetooth disconnected", device.Address.MAC.String())
+			pairDeviceDisconnected(mac)
+			out.Logger.Println("Bluetooth disconnected", model.MacToString(mac))
 		}
 	})
 
-	adapter.Enable()
-
-	adv := adapter.DefaultAdvertisement()
-	if adv == nil {
-		return errors.New("advertisement is nil")
-	}
-	err = adv.Configure(bluetooth.AdvertisementOptions{
-		LocalName: "Gateway Server",
-		// BUG can't advertise more than one service UUID
-		ServiceUUIDs: []bluetooth.UUID{DATA_SERVICE_UUID},
-	})
+	// BUG can't advertise more than one service UUID
+	err = transport.ConfigureAdvertisement("Gateway Server", []bluetooth.UUID{DATA_SERVICE_UUID})
 	if err != nil {
 		return err
 	}
 
 	// Setup watchdog timer
 	go startWatchdog()
+	openMeasurementStore()
+	startUploadWorkers()
+	go startJanitor()
 
 	return nil
 }
@@ -234,7 +241,7 @@ func StartAdvertising() error {
 	go func() {
 		for sig := range c {
 			if sig == os.Interrupt {
-				err := adapter.DefaultAdvertisement().Stop()
+				err := transport.StopAdvertising()
 				if err != nil {
 					out.Logger.Println("Error:", err)
 				}
@@ -244,15 +251,11 @@ func StartAdvertising() error {
 			}
 		}
 	}()
-	adv := adapter.DefaultAdvertisement()
-	if adv == nil {
-		return errors.New("advertisement is nil")
-	}
-	return adv.Start()
+	return transport.StartAdvertising()
 }
 
 func StopAdvertising() {
-	adapter.DefaultAdvertisement().Stop()
+	transport.StopAdvertising()
 	out.Logger.Println("Stopping server")
 	os.Exit(0)
 }
@@ -262,7 +265,10 @@ func TriggerSettingCollection() {
 	out.Logger.Println("Notifying all connected devices of new configs")
 	// NOTE: this triggers our own ReadEvent callback
 	// because this library has no way to direct notify...
-	settingsCharacteristic.Write([]byte{0x0})
+	err := transport.Notify(CONFIG_IDENTIFY_CHRC_UUID, []byte{0x0})
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
 }
 
 func TriggerCollection(address string) {
@@ -278,5 +284,8 @@ func TriggerCollection(address string) {
 	output[7] = 0x0 // Targets sensor
 
 	// Notify
-	configStartSampleChar.Write(output)
+	err := transport.Notify(CONFIG_START_SAMPLING_CHRC_UUID, output)
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
 }
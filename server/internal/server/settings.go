@@ -1,12 +1,28 @@
 package server
 
 import (
+	"sync"
 	"time"
 
 	"github.com/jukuly/ss_machmos/server/internal/model"
 	"github.com/jukuly/ss_machmos/server/internal/out"
 )
 
+// Accelerometer range last sent to each sensor, the one its data was sampled at
+var deliveredRanges = map[[6]byte]int{}
+var deliveredRangesMutex sync.Mutex
+
+// Range to decode vibration data of a sensor with
+func vibrationRangeOf(sensor *model.Sensor) int {
+	deliveredRangesMutex.Lock()
+	defer deliveredRangesMutex.Unlock()
+	if r, ok := deliveredRanges[sensor.Mac]; ok {
+		return r
+	}
+	// Nothing sent since the gateway started, assume the sensor is up to date
+	return sensor.VibrationRange()
+}
+
 /* 0x01 | mac address | Sleep until | repeat {dataTypeByte | active | Sampling Frequency | SamplingDuration}  */
 func getSettingsForSensor(address string) []byte {
 	mac, _ := model.StringToMac(address)
@@ -25,6 +41,9 @@ func getSettingsForSensor(address string) []byte {
 	sensor.UpdateLastSeen(model.SensorActivityIdle)
 
 	settings := sensor.SettingsBytes()
+	deliveredRangesMutex.Lock()
+	deliveredRanges[sensor.Mac] = sensor.VibrationRange()
+	deliveredRangesMutex.Unlock()
 
 	// Debug announce setting returned
 	out.Logger.Printf("%s [%s] receives:\n\t[% x]", sensor.Name, sensor.MacString(), settings)
@@ -0,0 +1,252 @@
+package server
+
+/*
+ * Destinations for measurements. Every file of the unsent folder is delivered
+ * to each enabled sink on its own, with its own retries, and archived once all
+ * of them have it. A new kind of destination only needs a RegisterSinkType call.
+ */
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+type Sink interface {
+	// Deliver one file of the unsent folder, a json array of measurements.
+	// An error means the sink didn't take it and it will be retried.
+	Send(jsonData []byte) error
+	// Release connections, the sink is not used after
+	Close() error
+}
+
+// Implemented by sinks that also publish sensor status changes
+type StatusSink interface {
+	Sink
+	// event is SENSOR-CONNECTED or SENSOR-DISCONNECTED. Best effort, status
+	// changes are not stored or retried like measurements.
+	SendStatus(event string, mac [6]byte) error
+}
+
+// Implemented by sinks that can take several files in one request, used when
+// Gateway.BatchSize is set
+type BatchSink interface {
+	Sink
+	// Deliver several files of the unsent folder at once, an error means none
+	// of them was taken
+	SendBatch(files [][]byte) error
+}
+
+// Builds a sink from its configuration. Must not block on the network,
+// connect lazily in Send instead.
+type SinkFactory func(config model.SinkConfig, gateway *model.Gateway) (Sink, error)
+
+var sinkTypes = map[string]SinkFactory{}
+
+// Make sinkType available to "config --sink". Registering the same type again replaces it.
+func RegisterSinkType(sinkType string, factory SinkFactory) {
+	sinkTypes[sinkType] = factory
+}
+
+func SinkTypes() []string {
+	types := []string{}
+	for sinkType := range sinkTypes {
+		types = append(types, sinkType)
+	}
+	slices.Sort(types)
+	return types
+}
+
+// Health of a sink since the gateway started
+type SinkStatus struct {
+	Active      bool      `json:"active"` // Enabled and built without errors
+	Delivered   int       `json:"delivered"`
+	Failed      int       `json:"failed"`
+	Rejected    int       `json:"rejected"` // Failures not retried, see rejectedUploads.go
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error"`
+}
+
+// Enabled sinks by name, in configuration order
+var sinks = map[string]Sink{}
+var sinkOrder = []string{}
+var sinkStatuses = map[string]*SinkStatus{}
+var sinksMutex sync.Mutex
+
+// Rebuild the sinks from Gateway.Sinks, then deliver pending files to any sink
+// that doesn't have them yet. Errors of sinks that couldn't be built are joined.
+func ReloadSinks() error {
+	sinksMutex.Lock()
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			out.Logger.Println("Error:", err)
+		}
+	}
+	sinks = map[string]Sink{}
+	sinkOrder = []string{}
+
+	errs := []error{}
+	for _, config := range Gateway.SinkConfigs() {
+		status, ok := sinkStatuses[config.Name]
+		if !ok {
+			status = &SinkStatus{}
+			sinkStatuses[config.Name] = status
+		}
+		status.Active = false
+		if !config.Enabled {
+			continue
+		}
+		sink, err := buildSink(config)
+		if err != nil {
+			status.LastError = err.Error()
+			errs = append(errs, errors.New("sink "+config.Name+": "+err.Error()))
+			continue
+		}
+		status.Active = true
+		sinks[config.Name] = sink
+		sinkOrder = append(sinkOrder, config.Name)
+	}
+	sinksMutex.Unlock()
+
+	go resumeUploads()
+	err := errors.Join(errs...)
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
+	return err
+}
+
+func buildSink(config model.SinkConfig) (Sink, error) {
+	factory, ok := sinkTypes[config.Type]
+	if !ok {
+		return nil, errors.New("sink type " + config.Type + " doesn't exist")
+	}
+	return factory(config, Gateway)
+}
+
+// Build a configured sink without using it, to report bad options even while it is disabled
+func CheckSink(name string) error {
+	config, ok := Gateway.SinkConfig(name)
+	if !ok {
+		return errors.New("sink " + name + " doesn't exist")
+	}
+	sink, err := buildSink(config)
+	if err != nil {
+		return err
+	}
+	return sink.Close()
+}
+
+// Error if a sink of that type doesn't exist
+func CheckSinkType(sinkType string) error {
+	if _, ok := sinkTypes[sinkType]; !ok {
+		return errors.New("invalid sink type " + sinkType + " (must be one of " + strings.Join(SinkTypes(), ", ") + ")")
+	}
+	return nil
+}
+
+func sinkFor(name string) (Sink, bool) {
+	sinksMutex.Lock()
+	defer sinksMutex.Unlock()
+	sink, ok := sinks[name]
+	return sink, ok
+}
+
+// Names of the sinks built and ready to send
+func activeSinks() []string {
+	sinksMutex.Lock()
+	defer sinksMutex.Unlock()
+	return slices.Clone(sinkOrder)
+}
+
+// Names of the sinks every file has to reach before it is archived. An enabled
+// sink that couldn't be built still counts, files wait until it is fixed.
+func requiredSinks() []string {
+	names := []string{}
+	for _, config := range Gateway.SinkConfigs() {
+		if config.Enabled {
+			names = append(names, config.Name)
+		}
+	}
+	return names
+}
+
+func recordSinkResult(name string, err error) {
+	sinksMutex.Lock()
+	defer sinksMutex.Unlock()
+	status, ok := sinkStatuses[name]
+	if !ok {
+		return
+	}
+	if err != nil {
+		status.Failed++
+		if classifyUploadError(err) == FAILURE_PERMANENT {
+			status.Rejected++
+		}
+		status.LastError = err.Error()
+		return
+	}
+	status.Delivered++
+	status.LastSuccess = time.Now()
+}
+
+type sinkStatusEvent struct {
+	event string
+	mac   [6]byte
+}
+
+// Status changes are sent one at a time so sinks get them in order
+var sinkStatusQueue = make(chan sinkStatusEvent, 256)
+
+// Pass a sensor status change to the sinks that publish them, without waiting
+func sendSinkStatus(event string, mac [6]byte) {
+	select {
+	case sinkStatusQueue <- sinkStatusEvent{event: event, mac: mac}:
+	default:
+		out.Logger.Println("Sink status queue full, dropping", event, model.MacToString(mac))
+	}
+}
+
+func sinkStatusWorker() {
+	for e := range sinkStatusQueue {
+		sinksMutex.Lock()
+		statusSinks := []StatusSink{}
+		for _, name := range sinkOrder {
+			if sink, ok := sinks[name].(StatusSink); ok {
+				statusSinks = append(statusSinks, sink)
+			}
+		}
+		sinksMutex.Unlock()
+
+		for _, sink := range statusSinks {
+			if err := sink.SendStatus(e.event, e.mac); err != nil {
+				out.Logger.Println("Error:", err)
+			}
+		}
+	}
+}
+
+type SinkInfo struct {
+	model.SinkConfig
+	Status SinkStatus `json:"status"`
+}
+
+// Configuration and status of every sink, in configuration order
+func SinkInfos() []SinkInfo {
+	sinksMutex.Lock()
+	defer sinksMutex.Unlock()
+	infos := []SinkInfo{}
+	for _, config := range Gateway.SinkConfigs() {
+		info := SinkInfo{SinkConfig: config}
+		if status, ok := sinkStatuses[config.Name]; ok {
+			info.Status = *status
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
@@ -0,0 +1,49 @@
+package server
+
+/*
+ * Per sensor counters of how well uploads are going
+ */
+
+import (
+	"sync"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+)
+
+type TransferStats struct {
+	Completed      int `json:"completed"`       // Assembled and intact
+	Corrupt        int `json:"corrupt"`         // Assembled but not uploaded
+	TimedOut       int `json:"timed_out"`       // Sensor went quiet midway
+	Abandoned      int `json:"abandoned"`       // Sensor restarted before finishing
+	MissingChunks  int `json:"missing_chunks"`  // Gaps in sequence numbers
+	Duplicates     int `json:"duplicates"`      // Chunks received twice
+	ChecksumErrors int `json:"checksum_errors"` // CRC32 of data did not match header
+	Oversized      int `json:"oversized"`       // Header announced more than the sensor may send
+	Salvaged       int `json:"salvaged"`        // Timed out but the received part was kept
+	Undecodable    int `json:"undecodable"`     // No decoder for the data type and board model, or decoding failed
+
+	RetransmitRequests  int `json:"retransmit_requests"`  // Notifications asking for missing chunks
+	RetransmittedChunks int `json:"retransmitted_chunks"` // Missing chunks that came back
+}
+
+var statsMutex sync.Mutex
+var transferStats = map[[6]byte]TransferStats{}
+
+func countTransfer(mac [6]byte, update func(s *TransferStats)) {
+	statsMutex.Lock()
+	stats := transferStats[mac]
+	update(&stats)
+	transferStats[mac] = stats
+	statsMutex.Unlock()
+}
+
+// Counters of every sensor that uploaded since the server started, by MAC address
+func TransferStatistics() map[string]TransferStats {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	result := make(map[string]TransferStats, len(transferStats))
+	for mac, stats := range transferStats {
+		result[model.MacToString(mac)] = stats
+	}
+	return result
+}
@@ -0,0 +1,148 @@
+package server
+
+/*
+ * Storage for the bytes of a transmission being assembled. Small uploads stay
+ * in memory, anything larger spills to a file in the cache directory so a few
+ * simultaneous audio uploads don't exhaust the RAM of the gateway.
+ */
+
+import (
+	"bufio"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+// Bytes kept in memory before moving a transmission to disk
+const SPILL_THRESHOLD = 64 * 1024
+
+type transmissionData struct {
+	memory []byte   // Data while under SPILL_THRESHOLD
+	file   *os.File // Data once spilled, nil before
+	length int      // One past the highest byte written
+}
+
+// Folder of in-flight transmissions, anything left there is from a previous run
+func transferDataDir() string {
+	dir := path.Join(dataDir(), "/transfers/")
+	err := os.MkdirAll(dir, dirPermCode)
+	if err != nil {
+		out.Logger.Panic(err.Error())
+	}
+	return dir
+}
+
+// Remove temp files of transmissions interrupted by a restart
+func clearTransferDataDir() {
+	err := os.RemoveAll(transferDataDir())
+	if err != nil {
+		out.Logger.Println("Error:", err)
+	}
+	transferDataDir()
+}
+
+// Move everything written so far to a temp file
+func (d *transmissionData) spill() error {
+	file, err := os.CreateTemp(transferDataDir(), "transfer-*.bin")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(d.memory); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	d.file = file
+	d.memory = nil
+	return nil
+}
+
+// Store p at offset off, gaps in between read back as zeros
+func (d *transmissionData) WriteAt(p []byte, off int64) (int, error) {
+	end := int(off) + len(p)
+	if d.file == nil && end > SPILL_THRESHOLD {
+		if err := d.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	var err error
+	if d.file != nil {
+		n, err = d.file.WriteAt(p, off)
+	} else {
+		if len(d.memory) < end {
+			d.memory = append(d.memory, make([]byte, end-len(d.memory))...)
+		}
+		n = copy(d.memory[off:end], p)
+	}
+	d.length = max(d.length, int(off)+n)
+	return n, err
+}
+
+// Append p after the last byte written
+func (d *transmissionData) Write(p []byte) (int, error) {
+	return d.WriteAt(p, int64(d.length))
+}
+
+func (d *transmissionData) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(d.length) {
+		return 0, io.EOF
+	}
+	if d.file != nil {
+		return d.file.ReadAt(p, off)
+	}
+	n := copy(p, d.memory[off:d.length])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *transmissionData) Len() int {
+	return d.length
+}
+
+// Drop everything past the first n bytes
+func (d *transmissionData) Truncate(n int) error {
+	if n >= d.length {
+		return nil
+	}
+	d.length = n
+	if d.file != nil {
+		return d.file.Truncate(int64(n))
+	}
+	d.memory = d.memory[:n]
+	return nil
+}
+
+// Buffered reader over the whole data, for decoders
+func (d *transmissionData) Reader() *bufio.Reader {
+	return bufio.NewReader(io.NewSectionReader(d, 0, int64(d.length)))
+}
+
+// CRC32 (IEEE) of the whole data
+func (d *transmissionData) Checksum() (uint32, error) {
+	hash := crc32.NewIEEE()
+	_, err := io.Copy(hash, io.NewSectionReader(d, 0, int64(d.length)))
+	return hash.Sum32(), err
+}
+
+// Free the memory or delete the temp file. Safe to call more than once.
+func (d *transmissionData) Release() {
+	if d == nil {
+		return
+	}
+	if d.file != nil {
+		d.file.Close()
+		if err := os.Remove(d.file.Name()); err != nil {
+			out.Logger.Println("Error:", err)
+		}
+		d.file = nil
+	}
+	d.memory = nil
+	d.length = 0
+}
@@ -0,0 +1,44 @@
+package server
+
+/*
+ * Abstraction over the radio. The gateway only ever talks to a Transport, so
+ * the same pairing, reassembly and upload code runs on BlueZ or in-process.
+ */
+
+import (
+	"tinygo.org/x/bluetooth"
+)
+
+// Called when a device writes to a characteristic
+type WriteHandler func(address string, value []byte)
+
+// Called when a device reads a characteristic, returns the value to send back
+type ReadHandler func(address string) []byte
+
+type Characteristic struct {
+	UUID       bluetooth.UUID
+	Flags      bluetooth.CharacteristicPermissions
+	WriteEvent WriteHandler
+	ReadEvent  ReadHandler
+}
+
+type Service struct {
+	UUID            bluetooth.UUID
+	Characteristics []Characteristic
+}
+
+type Transport interface {
+	// Power on the radio (or whatever stands in for it)
+	Enable() error
+	// Register a GATT service and the handlers of its characteristics
+	AddService(service Service) error
+	// Called with the device MAC on every connection and disconnection
+	SetConnectHandler(handler func(mac [6]byte, connected bool))
+	// Send a notification on a characteristic to every subscribed device
+	Notify(uuid bluetooth.UUID, value []byte) error
+	// MAC addresses of every device currently connected
+	ConnectedDevices() [][6]byte
+	ConfigureAdvertisement(localName string, serviceUUIDs []bluetooth.UUID) error
+	StartAdvertising() error
+	StopAdvertising() error
+}
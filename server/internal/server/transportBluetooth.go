@@ -0,0 +1,111 @@
+package server
+
+/*
+ * Transport backed by the tinygo bluetooth adapter (BlueZ on linux)
+ */
+
+import (
+	"errors"
+
+	"tinygo.org/x/bluetooth"
+)
+
+type bluetoothTransport struct {
+	adapter *bluetooth.Adapter
+	// Handles of characteristics that can notify, needed to write to them later
+	handles map[bluetooth.UUID]*bluetooth.Characteristic
+}
+
+func NewBluetoothTransport() Transport {
+	return &bluetoothTransport{
+		adapter: bluetooth.DefaultAdapter,
+		handles: make(map[bluetooth.UUID]*bluetooth.Characteristic),
+	}
+}
+
+func (t *bluetoothTransport) Enable() error {
+	return t.adapter.Enable()
+}
+
+func (t *bluetoothTransport) AddService(service Service) error {
+	s := bluetooth.Service{UUID: service.UUID}
+	for _, c := range service.Characteristics {
+		config := bluetooth.CharacteristicConfig{
+			UUID:  c.UUID,
+			Flags: c.Flags,
+		}
+		if c.Flags&bluetooth.CharacteristicNotifyPermission != 0 {
+			handle := &bluetooth.Characteristic{}
+			t.handles[c.UUID] = handle
+			config.Handle = handle
+		}
+		// Copy handlers, c is reused by the loop
+		writeEvent := c.WriteEvent
+		readEvent := c.ReadEvent
+		if writeEvent != nil {
+			// offset is used for when the MTU is less than 512 bytes, but maybe bluez handles that???
+			config.WriteEvent = func(_ bluetooth.Connection, address string, _ int, value []byte) {
+				writeEvent(address, value)
+			}
+		}
+		if readEvent != nil {
+			config.ReadEvent = func(_ bluetooth.Connection, address string, _ int) []byte {
+				return readEvent(address)
+			}
+		}
+		s.Characteristics = append(s.Characteristics, config)
+	}
+	return t.adapter.AddService(&s)
+}
+
+func (t *bluetoothTransport) SetConnectHandler(handler func(mac [6]byte, connected bool)) {
+	t.adapter.SetConnectHandler(func(device bluetooth.Device, connected bool) {
+		// NOTE upstream go bluetooth MAC address arrays are reversed
+		// This here works if using the patched branch
+		handler(device.Address.MAC, connected)
+	})
+}
+
+func (t *bluetoothTransport) Notify(uuid bluetooth.UUID, value []byte) error {
+	handle, ok := t.handles[uuid]
+	if !ok {
+		return errors.New("characteristic " + uuid.String() + " cannot notify")
+	}
+	_, err := handle.Write(value)
+	return err
+}
+
+func (t *bluetoothTransport) ConnectedDevices() [][6]byte {
+	devices := [][6]byte{}
+	for _, dev := range t.adapter.GetConnectedDevices() {
+		devices = append(devices, dev.Address.MAC)
+	}
+	return devices
+}
+
+func (t *bluetoothTransport) ConfigureAdvertisement(localName string, serviceUUIDs []bluetooth.UUID) error {
+	adv := t.adapter.DefaultAdvertisement()
+	if adv == nil {
+		return errors.New("advertisement is nil")
+	}
+	return adv.Configure(bluetooth.AdvertisementOptions{
+		LocalName:    localName,
+		ServiceUUIDs: serviceUUIDs,
+	})
+}
+
+func (t *bluetoothTransport) StartAdvertising() error {
+	adv := t.adapter.DefaultAdvertisement()
+	if adv == nil {
+		return errors.New("advertisement is nil")
+	}
+	return adv.Start()
+}
+
+func (t *bluetoothTransport) StopAdvertising() error {
+	adv := t.adapter.DefaultAdvertisement()
+	if adv == nil {
+		return errors.New("advertisement is nil")
+	}
+	return adv.Stop()
+}
@@ -0,0 +1,182 @@
+package server
+
+/*
+ * In-process stand-in for the BLE adapter. Virtual devices drive it by calling
+ * Connect, Write and Read directly, so the whole gateway (pairing, reassembly,
+ * decoding, upload) can run in CI or on a laptop without a radio.
+ */
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"tinygo.org/x/bluetooth"
+)
+
+type FakeTransport struct {
+	// BlueZ delivers GATT events one at a time, do the same here
+	events sync.Mutex
+	// Guards everything below
+	lock        sync.RWMutex
+	chrcs       map[bluetooth.UUID]Characteristic
+	connected   map[[6]byte]bool
+	subscribers map[[6]byte]func(uuid bluetooth.UUID, value []byte)
+	onConnect   func(mac [6]byte, connected bool)
+	advertising bool
+}
+
+func NewFakeTransport() *FakeTransport {
+	return &FakeTransport{
+		chrcs:       make(map[bluetooth.UUID]Characteristic),
+		connected:   make(map[[6]byte]bool),
+		subscribers: make(map[[6]byte]func(uuid bluetooth.UUID, value []byte)),
+	}
+}
+
+func (t *FakeTransport) Enable() error {
+	return nil
+}
+
+func (t *FakeTransport) AddService(service Service) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, c := range service.Characteristics {
+		t.chrcs[c.UUID] = c
+	}
+	return nil
+}
+
+func (t *FakeTransport) SetConnectHandler(handler func(mac [6]byte, connected bool)) {
+	t.lock.Lock()
+	t.onConnect = handler
+	t.lock.Unlock()
+}
+
+// Notifications are delivered asynchronously to every connected subscriber,
+// a handler may write back to the gateway without deadlocking
+func (t *FakeTransport) Notify(uuid bluetooth.UUID, value []byte) error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	c, ok := t.chrcs[uuid]
+	if !ok || c.Flags&bluetooth.CharacteristicNotifyPermission == 0 {
+		return errors.New("characteristic " + uuid.String() + " cannot notify")
+	}
+	for mac, handler := range t.subscribers {
+		if !t.connected[mac] {
+			continue
+		}
+		data := make([]byte, len(value))
+		copy(data, value)
+		go handler(uuid, data)
+	}
+	return nil
+}
+
+func (t *FakeTransport) ConnectedDevices() [][6]byte {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	devices := [][6]byte{}
+	for mac, connected := range t.connected {
+		if connected {
+			devices = append(devices, mac)
+		}
+	}
+	return devices
+}
+
+func (t *FakeTransport) ConfigureAdvertisement(_ string, _ []bluetooth.UUID) error {
+	return nil
+}
+
+func (t *FakeTransport) StartAdvertising() error {
+	t.lock.Lock()
+	t.advertising = true
+	t.lock.Unlock()
+	return nil
+}
+
+func (t *FakeTransport) StopAdvertising() error {
+	t.lock.Lock()
+	t.advertising = false
+	t.lock.Unlock()
+	return nil
+}
+
+// Device side: connect a virtual device to the gateway
+func (t *FakeTransport) Connect(mac [6]byte) {
+	t.setConnected(mac, true)
+}
+
+// Device side: disconnect a virtual device from the gateway
+func (t *FakeTransport) Disconnect(mac [6]byte) {
+	t.setConnected(mac, false)
+}
+
+func (t *FakeTransport) setConnected(mac [6]byte, connected bool) {
+	t.lock.Lock()
+	if t.connected[mac] == connected {
+		t.lock.Unlock()
+		return
+	}
+	t.connected[mac] = connected
+	handler := t.onConnect
+	t.lock.Unlock()
+
+	if handler != nil {
+		t.events.Lock()
+		handler(mac, connected)
+		t.events.Unlock()
+	}
+}
+
+// Device side: receive notifications sent by the gateway
+func (t *FakeTransport) Subscribe(mac [6]byte, handler func(uuid bluetooth.UUID, value []byte)) {
+	t.lock.Lock()
+	t.subscribers[mac] = handler
+	t.lock.Unlock()
+}
+
+// Device side: write to a characteristic of the gateway
+func (t *FakeTransport) Write(mac [6]byte, uuid bluetooth.UUID, value []byte) error {
+	c, err := t.characteristic(mac, uuid)
+	if err != nil {
+		return err
+	}
+	if c.WriteEvent == nil {
+		return errors.New("characteristic " + uuid.String() + " is not writable")
+	}
+	data := make([]byte, len(value))
+	copy(data, value)
+	t.events.Lock()
+	c.WriteEvent(model.MacToString(mac), data)
+	t.events.Unlock()
+	return nil
+}
+
+// Device side: read a characteristic of the gateway
+func (t *FakeTransport) Read(mac [6]byte, uuid bluetooth.UUID) ([]byte, error) {
+	c, err := t.characteristic(mac, uuid)
+	if err != nil {
+		return nil, err
+	}
+	if c.ReadEvent == nil {
+		return nil, errors.New("characteristic " + uuid.String() + " is not readable")
+	}
+	t.events.Lock()
+	defer t.events.Unlock()
+	return c.ReadEvent(model.MacToString(mac)), nil
+}
+
+func (t *FakeTransport) characteristic(mac [6]byte, uuid bluetooth.UUID) (Characteristic, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if !t.connected[mac] {
+		return Characteristic{}, errors.New("device " + model.MacToString(mac) + " is not connected")
+	}
+	c, ok := t.chrcs[uuid]
+	if !ok {
+		return Characteristic{}, errors.New("characteristic " + uuid.String() + " not found")
+	}
+	return c, nil
+}
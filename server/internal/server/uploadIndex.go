@@ -0,0 +1,325 @@
+package server
+
+/*
+ * Index of the files waiting in the unsent folder, saved next to them so
+ * attempt counts and errors survive a restart
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+const PENDING_INDEX_FILE = "pending_uploads.json"
+
+type PendingUpload struct {
+	Id          string                    `json:"id"`           // measurement_id, empty for files saved before there was one
+	File        string                    `json:"file"`         // Name in the unsent folder
+	Sensor      string                    `json:"sensor"`       // MAC address
+	DataType    string                    `json:"data_type"`    //
+	CaptureTime time.Time                 `json:"capture_time"` // Start of the transmission
+	Size        int64                     `json:"size"`         // Bytes of json
+	Sinks       map[string]DeliveryStatus `json:"sinks"`        // By sink name, missing until a first attempt
+}
+
+// Where a file stands with one sink
+type DeliveryStatus struct {
+	Delivered bool      `json:"delivered"`
+	Rejected  bool      `json:"rejected"`   // For good, a copy is in the rejected folder
+	Attempts  int       `json:"attempts"`   // Failed deliveries so far
+	LastError string    `json:"last_error"` // Empty until a delivery fails
+	AuthError bool      `json:"auth_error"` // The last failure was 401 or 403
+	NextRetry time.Time `json:"next_retry"` // Zero if not waiting for a retry
+	Batch     string    `json:"batch"`      // File leading the batch that failed with it, retried together under the same Idempotency-Key, empty if sent alone
+}
+
+// Nothing left to do for the sink, delivered or rejected
+func (status DeliveryStatus) Done() bool {
+	return status.Delivered || status.Rejected
+}
+
+// Narrows down the pending uploads returned by PendingUploads, zero values match everything
+type PendingFilter struct {
+	Sensor   string
+	DataType string
+	Sink     string // Only files this sink doesn't have yet, or rejected for RejectedUploads
+	Offset   int
+	Limit    int // 0 for no limit
+}
+
+var pendingIndex = map[string]PendingUpload{}
+var pendingMutex sync.Mutex
+
+func pendingIndexPath() string {
+	return path.Join(dataDir(), PENDING_INDEX_FILE)
+}
+
+// Read the saved index and reconcile it with the unsent folder: entries whose
+// file is gone are dropped, files missing from the index are added
+func loadPendingIndex() {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+
+	saved := map[string]PendingUpload{}
+	if jsonStr, err := os.ReadFile(pendingIndexPath()); err == nil {
+		if err := json.Unmarshal(jsonStr, &saved); err != nil {
+			out.Logger.Println("Error:", err, ", rebuilding pending upload index")
+		}
+	}
+
+	files, err := os.ReadDir(unsentDataDir())
+	if err != nil {
+		out.Logger.Println("Error:", err)
+		return
+	}
+	pendingIndex = map[string]PendingUpload{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if entry, ok := saved[file.Name()]; ok {
+			pendingIndex[file.Name()] = entry
+			continue
+		}
+		entry, err := describeUnsentFile(file.Name())
+		if err != nil {
+			out.Logger.Println("Error:", err)
+			continue
+		}
+		pendingIndex[file.Name()] = entry
+	}
+	savePendingIndex()
+}
+
+// Index entry of a file nobody indexed, from its content
+func describeUnsentFile(file string) (PendingUpload, error) {
+	entry := PendingUpload{File: file}
+	data, err := os.ReadFile(path.Join(unsentDataDir(), file))
+	if err != nil {
+		return entry, err
+	}
+	entry.Size = int64(len(data))
+
+	var measurements []struct {
+		MeasurementId   string    `json:"measurement_id"`
+		SensorId        string    `json:"sensor_id"`
+		Time            time.Time `json:"time"`
+		MeasurementType string    `json:"measurement_type"`
+	}
+	if err := json.Unmarshal(data, &measurements); err == nil && len(measurements) > 0 {
+		entry.Id = measurements[0].MeasurementId
+		entry.Sensor = measurements[0].SensorId
+		entry.DataType = measurements[0].MeasurementType
+		entry.CaptureTime = measurements[0].Time
+	}
+	return entry, nil
+}
+
+// Caller holds pendingMutex
+func savePendingIndex() {
+	jsonStr, err := json.MarshalIndent(pendingIndex, "", "\t")
+	if err != nil {
+		out.Logger.Println("Error:", err)
+		return
+	}
+	// Write then rename, a crash never leaves half an index
+	tmp := pendingIndexPath() + ".tmp"
+	if err := os.WriteFile(tmp, jsonStr, filePermCode); err != nil {
+		out.Logger.Println("Error:", err)
+		return
+	}
+	if err := os.Rename(tmp, pendingIndexPath()); err != nil {
+		out.Logger.Println("Error:", err)
+	}
+}
+
+func addPending(entry PendingUpload) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	pendingIndex[entry.File] = entry
+	savePendingIndex()
+}
+
+// Record a failed delivery to a sink and when to retry it, returns the updated
+// status. batch is the batch it failed in, empty if sent alone.
+func failPending(file string, sink string, err error, batch string) DeliveryStatus {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	entry, ok := pendingIndex[file]
+	if !ok {
+		return DeliveryStatus{Attempts: 1, NextRetry: time.Now().Add(uploadBackoff(1))}
+	}
+	status := entry.Sinks[sink]
+	status.Attempts++
+	status.LastError = err.Error()
+	status.AuthError = classifyUploadError(err) == FAILURE_AUTH
+	status.NextRetry = time.Now().Add(uploadBackoff(status.Attempts))
+	status.Batch = batch
+	setDeliveryStatus(&entry, sink, status)
+	savePendingIndex()
+	return status
+}
+
+func deliverPending(file string, sink string) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	entry, ok := pendingIndex[file]
+	if !ok {
+		return
+	}
+	status := entry.Sinks[sink]
+	status.Delivered = true
+	status.NextRetry = time.Time{}
+	setDeliveryStatus(&entry, sink, status)
+	savePendingIndex()
+}
+
+// Record that a sink refused a file for good
+func rejectPending(file string, sink string, err error) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	entry, ok := pendingIndex[file]
+	if !ok {
+		return
+	}
+	status := entry.Sinks[sink]
+	status.Rejected = true
+	status.Attempts++
+	status.LastError = err.Error()
+	status.NextRetry = time.Time{}
+	setDeliveryStatus(&entry, sink, status)
+	savePendingIndex()
+}
+
+// Caller holds pendingMutex. Copies of the entry handed out by pendingEntry
+// and PendingUploads share its map and are read without the lock, so it is
+// replaced rather than written to.
+func setDeliveryStatus(entry *PendingUpload, sink string, status DeliveryStatus) {
+	if entry.Sinks == nil {
+		entry.Sinks = map[string]DeliveryStatus{}
+	} else {
+		entry.Sinks = maps.Clone(entry.Sinks)
+	}
+	entry.Sinks[sink] = status
+	pendingIndex[entry.File] = *entry
+}
+
+// Remove and return the entry of a file if every sink in required is done
+// with it, only one caller gets true for a file
+func takeDeliveredPending(file string, required []string) (PendingUpload, bool) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	entry, ok := pendingIndex[file]
+	if !ok {
+		return entry, false
+	}
+	for _, sink := range required {
+		if !entry.Sinks[sink].Done() {
+			return entry, false
+		}
+	}
+	delete(pendingIndex, file)
+	savePendingIndex()
+	return entry, true
+}
+
+func removePending(file string) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	delete(pendingIndex, file)
+	savePendingIndex()
+}
+
+func pendingEntry(file string) (PendingUpload, bool) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	entry, ok := pendingIndex[file]
+	return entry, ok
+}
+
+// Where the measurements of a transmission are, by their measurement_id
+type UploadState struct {
+	Id       string           `json:"id"`
+	State    string           `json:"state"`              // pending, archived or rejected
+	Path     string           `json:"path"`               // Of the file, in the unsent, sent or rejected folder
+	Pending  *PendingUpload   `json:"pending,omitempty"`  // Deliveries so far while pending
+	Rejected []RejectedUpload `json:"rejected,omitempty"` // Sinks that refused it
+}
+
+func UploadById(id string) (UploadState, error) {
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return UploadState{}, errors.New("invalid measurement id " + id)
+	}
+	state := UploadState{Id: parsed.String()}
+	file := measurementsFile(state.Id)
+
+	rejectedMutex.Lock()
+	for _, entry := range rejectedIndex {
+		if entry.File == file {
+			state.Rejected = append(state.Rejected, entry)
+		}
+	}
+	rejectedMutex.Unlock()
+	slices.SortFunc(state.Rejected, func(a, b RejectedUpload) int {
+		return strings.Compare(a.Sink, b.Sink)
+	})
+
+	if entry, ok := pendingEntry(file); ok {
+		state.State = "pending"
+		state.Path = path.Join(unsentDataDir(), file)
+		state.Pending = &entry
+	} else if _, err := os.Stat(path.Join(archivedDataDir(), file)); err == nil {
+		state.State = "archived"
+		state.Path = path.Join(archivedDataDir(), file)
+	} else if len(state.Rejected) > 0 {
+		state.State = "rejected"
+		state.Path = path.Join(rejectedDataDir(), file)
+	} else {
+		return state, errors.New("measurement " + state.Id + " doesn't exist")
+	}
+	return state, nil
+}
+
+// Uploads not accepted yet matching the filter, oldest capture first, and how
+// many match in total
+func PendingUploads(filter PendingFilter) ([]PendingUpload, int) {
+	pendingMutex.Lock()
+	result := []PendingUpload{}
+	for _, entry := range pendingIndex {
+		if filter.Sensor != "" && !strings.EqualFold(entry.Sensor, filter.Sensor) {
+			continue
+		}
+		if filter.DataType != "" && entry.DataType != filter.DataType {
+			continue
+		}
+		if filter.Sink != "" && entry.Sinks[filter.Sink].Done() {
+			continue
+		}
+		result = append(result, entry)
+	}
+	pendingMutex.Unlock()
+
+	slices.SortFunc(result, func(a, b PendingUpload) int {
+		if c := a.CaptureTime.Compare(b.CaptureTime); c != 0 {
+			return c
+		}
+		return strings.Compare(a.File, b.File)
+	})
+	total := len(result)
+	result = result[min(filter.Offset, total):]
+	if filter.Limit > 0 && len(result) > filter.Limit {
+		result = result[:filter.Limit]
+	}
+	return result, total
+}
@@ -0,0 +1,348 @@
+package server
+
+/*
+ * Uploading measurements in the background. The BLE callbacks only write
+ * measurements to the unsent folder and queue them, workers deliver them to
+ * every sink and retry each sink with exponential backoff, so a slow
+ * destination never stalls a sensor or the other destinations.
+ */
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+)
+
+// Uploads in flight at once
+const UPLOAD_WORKERS = 2
+
+// Delay before the first retry, doubled on every failure up to UPLOAD_BACKOFF_MAX
+const UPLOAD_BACKOFF_MIN = 5 * time.Second
+
+const UPLOAD_BACKOFF_MAX = 10 * time.Minute
+
+// Attempt counts are kept in the pending index
+type uploadJob struct {
+	file string // Name in unsentDataDir
+	sink string // Name of the sink to deliver it to
+}
+
+var uploadQueue = make(chan uploadJob, 1024)
+
+// Jobs waiting in the queue or for a retry, so none is delivered twice
+var queuedUploads = map[uploadJob]bool{}
+
+// Jobs a worker is delivering, its own and the ones batched with it
+var sendingUploads = map[uploadJob]bool{}
+var queuedMutex sync.Mutex
+
+func startUploadWorkers() {
+	for i := 0; i < UPLOAD_WORKERS; i++ {
+		go uploadWorker()
+	}
+	go sinkStatusWorker()
+
+	// Anything left over from before a restart, retried when it was due
+	go func() {
+		loadPendingIndex()
+		loadRejectedIndex()
+		ReloadSinks()
+	}()
+}
+
+// Schedule every pending file for the active sinks that don't have it yet,
+// and archive the ones no required sink is waiting for anymore
+func resumeUploads() {
+	pending, _ := PendingUploads(PendingFilter{})
+	active := activeSinks()
+	for _, entry := range pending {
+		if finishUpload(entry.File) {
+			continue
+		}
+		for _, sink := range active {
+			status := entry.Sinks[sink]
+			if !status.Done() {
+				scheduleUpload(uploadJob{file: entry.File, sink: sink}, time.Until(status.NextRetry))
+			}
+		}
+	}
+}
+
+// Queue a delivery after delay
+func scheduleUpload(job uploadJob, delay time.Duration) {
+	queuedMutex.Lock()
+	if queuedUploads[job] {
+		queuedMutex.Unlock()
+		return
+	}
+	queuedUploads[job] = true
+	queuedMutex.Unlock()
+	if delay > 0 {
+		time.AfterFunc(delay, func() { uploadQueue <- job })
+		return
+	}
+	uploadQueue <- job
+}
+
+func unqueueUpload(job uploadJob) {
+	queuedMutex.Lock()
+	delete(queuedUploads, job)
+	queuedMutex.Unlock()
+}
+
+// Persist measurements and queue them, returns as soon as they are on disk
+func queueMeasurements(jsonData []byte, transmission Transmission) error {
+	file, err := saveUnsentMeasurements(jsonData, transmission.id)
+	if err != nil {
+		return err
+	}
+	if captureSinksActive() {
+		if err := saveRawCapture(transmission, file); err != nil {
+			out.Logger.Println("Error:", err)
+		}
+	}
+	addPending(PendingUpload{
+		Id:          transmission.id,
+		File:        file,
+		Sensor:      model.MacToString(transmission.macAddress),
+		DataType:    transmission.dataType,
+		CaptureTime: transmission.timestamp,
+		Size:        int64(len(jsonData)),
+		Sinks:       map[string]DeliveryStatus{},
+	})
+	if finishUpload(file) {
+		// No sink enabled
+		return nil
+	}
+	for _, sink := range activeSinks() {
+		go scheduleUpload(uploadJob{file: file, sink: sink}, 0)
+	}
+	return nil
+}
+
+func uploadWorker() {
+	for job := range uploadQueue {
+		sink, ok := sinkFor(job.sink)
+		if !ok {
+			// Disabled or removed since it was queued
+			unqueueUpload(job)
+			finishUpload(job.file)
+			continue
+		}
+		if entry, ok := pendingEntry(job.file); ok {
+			status := entry.Sinks[job.sink]
+			if status.Done() {
+				// Went out, or was rejected, in a batch while it waited
+				unqueueUpload(job)
+				finishUpload(job.file)
+				continue
+			}
+			if delay := time.Until(status.NextRetry); delay > 0 {
+				// Failed in a batch since it was queued
+				time.AfterFunc(delay, func() { uploadQueue <- job })
+				continue
+			}
+		}
+
+		jobs, ok := claimUploads(job, sink)
+		if !ok {
+			// In a batch of another worker, look again once it is done
+			time.AfterFunc(UPLOAD_BACKOFF_MIN, func() { uploadQueue <- job })
+			continue
+		}
+		sendUploads(sink, jobs)
+		queuedMutex.Lock()
+		for _, j := range jobs {
+			delete(sendingUploads, j)
+		}
+		queuedMutex.Unlock()
+	}
+}
+
+// job and, if its sink takes batches, the oldest other files queued for that
+// sink up to Gateway.BatchSize KiB in all. A job retried after its batch failed
+// goes out with the same files again, so the request keeps its Idempotency-Key.
+// false if job is being sent already.
+func claimUploads(job uploadJob, sink Sink) ([]uploadJob, bool) {
+	batchSize := model.GatewaySettings(Gateway).BatchSize
+	size := int64(0)
+	batch := ""
+	if entry, ok := pendingEntry(job.file); ok {
+		size = entry.Size
+		batch = entry.Sinks[job.sink].Batch
+	}
+	candidates := []PendingUpload{}
+	if _, ok := sink.(BatchSink); ok && (batch != "" || batchSize > 0) {
+		candidates, _ = PendingUploads(PendingFilter{Sink: job.sink})
+	}
+
+	queuedMutex.Lock()
+	defer queuedMutex.Unlock()
+	if sendingUploads[job] {
+		return nil, false
+	}
+	jobs := []uploadJob{job}
+	sendingUploads[job] = true
+	for _, entry := range candidates {
+		other := uploadJob{file: entry.File, sink: job.sink}
+		if other == job || sendingUploads[other] || entry.Sinks[job.sink].Batch != batch {
+			continue
+		}
+		if batch == "" {
+			if !queuedUploads[other] || size+entry.Size > int64(batchSize)<<10 {
+				continue
+			}
+			size += entry.Size
+		}
+		jobs = append(jobs, other)
+		sendingUploads[other] = true
+	}
+	return jobs, true
+}
+
+// Deliver jobs to sink in one go. Only the first job is rescheduled here, the
+// others still have their own place in the queue.
+func sendUploads(sink Sink, jobs []uploadJob) {
+	files := [][]byte{}
+	sending := []uploadJob{}
+	for _, job := range jobs {
+		data, err := os.ReadFile(path.Join(unsentDataDir(), job.file))
+		if errors.Is(err, os.ErrNotExist) {
+			if job == jobs[0] {
+				unqueueUpload(job)
+			}
+			removePending(job.file)
+			continue
+		}
+		if err != nil {
+			failUpload(job, err, job == jobs[0], "")
+			continue
+		}
+		files = append(files, data)
+		sending = append(sending, job)
+	}
+	if len(sending) == 0 {
+		return
+	}
+
+	if len(sending) == 1 {
+		settleUpload(sending[0], files[0], deliver(sink, sending[0].file, files[0]), sending[0] == jobs[0], "")
+		return
+	}
+	// Named after the file that first led it, kept through retries
+	batch := sending[0].file
+	if entry, ok := pendingEntry(sending[0].file); ok && entry.Sinks[sending[0].sink].Batch != "" {
+		batch = entry.Sinks[sending[0].sink].Batch
+	}
+	err := sink.(BatchSink).SendBatch(files)
+	if err != nil && classifyUploadError(err) == FAILURE_PERMANENT {
+		// Send them one by one to find out which the destination refuses
+		for i, job := range sending {
+			settleUpload(job, files[i], deliver(sink, job.file, files[i]), job == jobs[0], "")
+		}
+		return
+	}
+	for i, job := range sending {
+		settleUpload(job, files[i], err, job == jobs[0], batch)
+	}
+}
+
+// Record how a delivery went. own is false for jobs batched with another one,
+// they are taken out of the queue when their turn comes. batch is the batch it
+// went out in, empty if sent alone.
+func settleUpload(job uploadJob, data []byte, err error, own bool, batch string) {
+	recordSinkResult(job.sink, err)
+	if err != nil {
+		// Rather retry than lose a file that couldn't be copied
+		if classifyUploadError(err) != FAILURE_PERMANENT || !rejectUpload(job, data, err) {
+			failUpload(job, err, own, batch)
+			return
+		}
+	} else {
+		deliverPending(job.file, job.sink)
+	}
+	if own {
+		unqueueUpload(job)
+	}
+	finishUpload(job.file)
+}
+
+func failUpload(job uploadJob, err error, reschedule bool, batch string) {
+	status := failPending(job.file, job.sink, err, batch)
+	delay := time.Until(status.NextRetry)
+	if status.AuthError {
+		out.Logger.Println("Upload of", job.file, "to", job.sink, "refused the credentials, attempt", status.Attempts, "retrying in", delay.Round(time.Second), "Error:", err)
+	} else {
+		out.Logger.Println("Upload of", job.file, "to", job.sink, "failed, attempt", status.Attempts, "retrying in", delay.Round(time.Second), "Error:", err)
+	}
+	if status.Attempts == 1 {
+		// Notify GUI of a new unsent measurement
+		out.Broadcast("UPLOAD-FAILED")
+	}
+	if reschedule {
+		time.AfterFunc(delay, func() { uploadQueue <- job })
+	}
+}
+
+// Raw captures to the sinks that store them, measurements to the others
+func deliver(sink Sink, file string, data []byte) error {
+	captureSink, ok := sink.(CaptureSink)
+	if !ok {
+		return sink.Send(data)
+	}
+	capture, ok, err := loadRawCapture(file)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// Captured before any sink wanted raw bytes
+		out.Logger.Println("No raw capture kept for", file+", nothing to store")
+		return nil
+	}
+	return captureSink.SendCapture(capture)
+}
+
+// Archive a file once every required sink is done with it, true if it was
+// archived. A file every sink rejected is only kept in the rejected folder.
+func finishUpload(file string) bool {
+	entry, ok := takeDeliveredPending(file, requiredSinks())
+	if !ok {
+		return false
+	}
+	delivered, rejected := false, false
+	for _, status := range entry.Sinks {
+		delivered = delivered || status.Delivered
+		rejected = rejected || status.Rejected
+	}
+	if rejected && !delivered {
+		bin, meta := capturePaths(unsentDataDir(), file)
+		for _, f := range []string{path.Join(unsentDataDir(), file), bin, meta} {
+			if err := os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+				out.Logger.Println("Error:", err)
+			}
+		}
+		return true
+	}
+	// Don't delete, keep around for debugging
+	if err := os.Rename(path.Join(unsentDataDir(), file), path.Join(archivedDataDir(), file)); err != nil {
+		out.Logger.Println("Error:", err)
+	}
+	archiveRawCapture(file)
+	out.Broadcast("UPLOAD-SUCCESS")
+	return true
+}
+
+// Exponential backoff with jitter, so sensors that failed together don't retry together
+func uploadBackoff(attempts int) time.Duration {
+	delay := UPLOAD_BACKOFF_MAX
+	if attempts < 20 {
+		delay = min(UPLOAD_BACKOFF_MIN<<(attempts-1), UPLOAD_BACKOFF_MAX)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
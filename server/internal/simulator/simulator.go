@@ -0,0 +1,472 @@
+package simulator
+
+/*
+ * Emulates a fleet of MachMoS boards against an in-process gateway.
+ * Each virtual sensor announces its capabilities, reads its settings,
+ * samples synthetic waveforms and uploads them in MTU sized chunks,
+ * optionally losing chunks or dropping out mid-transfer.
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jukuly/ss_machmos/server/internal/model"
+	"github.com/jukuly/ss_machmos/server/internal/out"
+	"github.com/jukuly/ss_machmos/server/internal/server"
+	"tinygo.org/x/bluetooth"
+)
+
+type Config struct {
+	Sensors        int      // Number of virtual sensors
+	Models         []string // Board models, assigned round robin
+	Loss           float64  // Probability of losing any single chunk
+	Drop           float64  // Probability of a transfer stopping midway
+	Duplicate      float64  // Probability of writing any single chunk twice
+	MTU            int      // Bytes per write
+	WakeUpInterval int      // If > 0, configured on every virtual sensor (seconds)
+	Cycles         int      // Wake up cycles per sensor, 0 runs forever
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Sensors: 1,
+		Models:  []string{"machmo", "machmomini"},
+		MTU:     244,
+	}
+}
+
+// Capabilities announced by each board model
+var boardTypes = map[string][]string{
+	"machmo":     {"vibration", "audio", "temperature", "flux"},
+	"machmomini": {"vibration", "temperature"},
+}
+
+// Collection capacity announced by each board model, in bytes
+var boardCapacity = map[string]uint32{
+	"machmo":     4_000_000,
+	"machmomini": 1_000_000,
+}
+
+// Battery voltage of each board model when fully charged, in mV
+var boardFullBattery = map[string]int{
+	"machmo":     4200,
+	"machmomini": 3000,
+}
+
+// Battery drain per wake up, in mV
+const BATTERY_DRAIN = 2
+
+// Bits of the capability byte, see pairReceiveCapabilities
+var typeBits = map[string]byte{
+	"audio":       1 << 0,
+	"temperature": 1 << 1,
+	"vibration":   1 << 2,
+	"flux":        1 << 3,
+}
+
+var typeChrcs = map[string]bluetooth.UUID{
+	"vibration":   server.ACCEL_DATA_CHRC_UUID,
+	"audio":       server.MIC_DATA_CHRC_UUID,
+	"temperature": server.RTD_DATA_CHRC_UUID,
+	"flux":        server.FLUX_DATA_CHRC_UUID,
+}
+
+type typeSettings struct {
+	active            bool
+	samplingFrequency uint32
+	samplingDuration  uint16
+}
+
+// Decoded settings blob, see model.Sensor.SettingsBytes
+type sensorSettings struct {
+	deviceActive   bool
+	sleepDuration  time.Duration
+	types          map[string]typeSettings
+	vibrationRange int // Accelerometer full scale in g
+}
+
+type virtualSensor struct {
+	mac        [6]byte
+	model      string
+	phase      float64
+	battery    int // Millivolts
+	wake       chan bool
+	sent       int
+	lost       int
+	duplicated int
+	dropped    int
+	resent     int
+	transport  *server.FakeTransport
+	config     Config
+
+	// Guards everything below, retransmission requests arrive on their own goroutine
+	lock sync.Mutex
+	// Chunks of the last upload of each data type, kept to answer retransmission requests
+	chunks map[string][][]byte
+	// Last time anything was written, the sensor lingers after uploading
+	lastWrite time.Time
+}
+
+func Run(t *server.FakeTransport, config Config) error {
+	if config.Sensors <= 0 {
+		return errors.New("number of sensors must be greater than 0")
+	}
+	if config.MTU <= server.SEQUENCE_LENGTH {
+		return errors.New("MTU must be greater than " + strconv.Itoa(server.SEQUENCE_LENGTH))
+	}
+	if len(config.Models) == 0 {
+		config.Models = DefaultConfig().Models
+	}
+	for _, m := range config.Models {
+		if _, ok := boardTypes[m]; !ok {
+			return errors.New("unknown board model " + m)
+		}
+	}
+
+	sensors := []*virtualSensor{}
+	for i := 0; i < config.Sensors; i++ {
+		s := &virtualSensor{
+			// Locally administered addresses, won't collide with real boards
+			mac:       [6]byte{0x5A, 0x4D, 0x00, 0x00, byte(i >> 8), byte(i)},
+			model:     config.Models[i%len(config.Models)],
+			phase:     rand.Float64() * 2 * math.Pi,
+			battery:   boardFullBattery[config.Models[i%len(config.Models)]],
+			wake:      make(chan bool, 1),
+			chunks:    map[string][][]byte{},
+			transport: t,
+			config:    config,
+		}
+		t.Subscribe(s.mac, s.notified)
+		sensors = append(sensors, s)
+	}
+
+	// Pair one after the other, pairing state is not safe to touch concurrently
+	server.EnablePairing()
+	for _, s := range sensors {
+		if err := s.pair(); err != nil {
+			return err
+		}
+	}
+	server.DisablePairing()
+
+	var wg sync.WaitGroup
+	for _, s := range sensors {
+		wg.Add(1)
+		go func(s *virtualSensor) {
+			defer wg.Done()
+			s.run()
+		}(s)
+	}
+	wg.Wait()
+
+	for _, s := range sensors {
+		out.Logger.Printf("SIM %s (%s): %d transfers sent, %d chunks lost, %d chunks resent, %d chunks duplicated, %d transfers dropped",
+			model.MacToString(s.mac), s.model, s.sent, s.lost, s.resent, s.duplicated, s.dropped)
+	}
+	return nil
+}
+
+// Announce capabilities and get accepted by the gateway
+func (s *virtualSensor) pair() error {
+	s.transport.Connect(s.mac)
+	defer s.transport.Disconnect(s.mac)
+
+	capabilities := []byte{0x00}
+	for _, t := range boardTypes[s.model] {
+		capabilities[0] |= typeBits[t]
+	}
+	capabilities = binary.LittleEndian.AppendUint32(capabilities, boardCapacity[s.model])
+	for b, name := range model.SENSOR_MODELS {
+		if name == s.model {
+			capabilities = append(capabilities, b)
+		}
+	}
+	err := s.transport.Write(s.mac, server.CONFIG_IDENTIFY_CHRC_UUID, capabilities)
+	if err != nil {
+		return err
+	}
+
+	mac := model.MacToString(s.mac)
+	if s.known() == nil {
+		server.Pair(s.mac)
+		if s.known() == nil {
+			return errors.New("gateway did not pair with " + mac)
+		}
+		out.Logger.Println("SIM", mac, "paired as", s.model)
+	}
+
+	// A sensor that never samples is not much of a simulation
+	err = model.UpdateSensorSetting(s.mac, "device_active", "true")
+	if err != nil {
+		return err
+	}
+	if s.config.WakeUpInterval > 0 {
+		err = model.UpdateSensorSetting(s.mac, "wake_up_interval", strconv.Itoa(s.config.WakeUpInterval))
+	}
+	return err
+}
+
+func (s *virtualSensor) known() *model.Sensor {
+	for i, sensor := range model.Sensors {
+		if sensor.Mac == s.mac {
+			return &model.Sensors[i]
+		}
+	}
+	return nil
+}
+
+// Wake up, fetch settings, sample and upload, then sleep. Repeat.
+func (s *virtualSensor) run() {
+	mac := model.MacToString(s.mac)
+	for cycle := 0; s.config.Cycles == 0 || cycle < s.config.Cycles; cycle++ {
+		s.transport.Connect(s.mac)
+		settings, err := s.readSettings()
+		if err != nil {
+			out.Logger.Println("SIM", mac, "Error:", err)
+			s.transport.Disconnect(s.mac)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		s.reportBattery()
+
+		if !settings.deviceActive {
+			// Stay connected on standby until asked to sample
+			out.Logger.Println("SIM", mac, "standing by for", settings.sleepDuration)
+			if !s.sleep(settings.sleepDuration) {
+				s.transport.Disconnect(s.mac)
+				continue
+			}
+		}
+
+		for _, dataType := range boardTypes[s.model] {
+			ts, ok := settings.types[dataType]
+			if !ok || !ts.active {
+				continue
+			}
+			s.upload(dataType, ts.samplingFrequency, s.sample(dataType, ts, settings.vibrationRange))
+		}
+		s.linger()
+		s.transport.Disconnect(s.mac)
+
+		out.Logger.Println("SIM", mac, "sleeping for", settings.sleepDuration)
+		s.sleep(settings.sleepDuration)
+	}
+}
+
+// Voltage only, the gateway works out the percentage
+func (s *virtualSensor) reportBattery() {
+	report := binary.LittleEndian.AppendUint16([]byte{}, uint16(max(s.battery, 0)))
+	report = append(report, server.BATTERY_LEVEL_UNKNOWN)
+	err := s.transport.Write(s.mac, server.BATTERY_DATA_CHRC_UUID, report)
+	if err != nil {
+		out.Logger.Println("SIM", model.MacToString(s.mac), "Error:", err)
+	}
+	s.battery -= BATTERY_DRAIN
+}
+
+// Returns true if woken up early by the gateway
+func (s *virtualSensor) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return false
+	case <-s.wake:
+		return true
+	}
+}
+
+// Stay connected while the gateway may still ask for lost chunks
+func (s *virtualSensor) linger() {
+	if s.config.Loss == 0 {
+		return
+	}
+	window := time.Duration(server.RETRANSMIT_DELAY+2) * time.Second
+	for {
+		s.lock.Lock()
+		remaining := window - time.Since(s.lastWrite)
+		s.lock.Unlock()
+		if remaining <= 0 {
+			return
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// Gateway notifications, addressed to a sensor by its reversed MAC address
+func (s *virtualSensor) notified(uuid bluetooth.UUID, value []byte) {
+	if len(value) < 6 {
+		return
+	}
+	for i := range s.mac {
+		if value[i] != s.mac[len(s.mac)-i-1] {
+			return
+		}
+	}
+	switch uuid {
+	case server.CONFIG_START_SAMPLING_CHRC_UUID:
+		select {
+		case s.wake <- true:
+		default:
+		}
+	case server.CONFIG_RETRANSMIT_CHRC_UUID:
+		s.retransmit(value[6:])
+	}
+}
+
+// data type | number of ranges | repeat {first chunk index | chunk count}
+func (s *virtualSensor) retransmit(request []byte) {
+	mac := model.MacToString(s.mac)
+	if len(request) < 2 {
+		return
+	}
+	dataType := server.DATA_TYPES[request[0]]
+	ranges := int(request[1])
+	if len(request) < 2+ranges*6 {
+		out.Logger.Println("SIM", mac, "received a truncated retransmission request")
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	chunks := s.chunks[dataType]
+	for r := 0; r < ranges; r++ {
+		first := int(binary.LittleEndian.Uint32(request[2+r*6:]))
+		count := int(binary.LittleEndian.Uint16(request[6+r*6:]))
+		for i := first; i < first+count && i < len(chunks); i++ {
+			s.lastWrite = time.Now()
+			if rand.Float64() < s.config.Loss {
+				s.lost++
+				continue
+			}
+			err := s.transport.Write(s.mac, typeChrcs[dataType], chunks[i])
+			if err != nil {
+				out.Logger.Println("SIM", mac, "Error:", err)
+				return
+			}
+			s.resent++
+		}
+	}
+}
+
+func (s *virtualSensor) readSettings() (sensorSettings, error) {
+	value, err := s.transport.Read(s.mac, server.CONFIG_IDENTIFY_CHRC_UUID)
+	if err != nil {
+		return sensorSettings{}, err
+	}
+	// active | mac address | sleep duration | repeat {type | active | frequency | duration}
+	if len(value) < 11 {
+		return sensorSettings{}, errors.New("settings rejected by gateway")
+	}
+	settings := sensorSettings{
+		deviceActive:  value[0] == 0x01,
+		sleepDuration: time.Duration(binary.LittleEndian.Uint32(value[7:11])) * time.Second,
+		types:         map[string]typeSettings{},
+
+		vibrationRange: model.DEFAULT_VIBRATION_RANGE,
+	}
+	for i := 11; i+8 <= len(value); i += 8 {
+		if value[i] == model.SETTING_VIBRATION_RANGE {
+			settings.vibrationRange = int(value[i+1])
+			continue
+		}
+		dataType, ok := server.DATA_TYPES[value[i]]
+		if !ok {
+			continue
+		}
+		settings.types[dataType] = typeSettings{
+			active:            value[i+1] == 0x01,
+			samplingFrequency: binary.LittleEndian.Uint32(value[i+2 : i+6]),
+			samplingDuration:  binary.LittleEndian.Uint16(value[i+6 : i+8]),
+		}
+	}
+	return settings, nil
+}
+
+func (s *virtualSensor) sample(dataType string, settings typeSettings, vibrationRange int) []byte {
+	switch dataType {
+	case "vibration":
+		return vibrationSamples(settings.samplingFrequency, settings.samplingDuration, s.phase, model.VIBRATION_SCALE[vibrationRange])
+	case "audio":
+		return audioSamples(settings.samplingFrequency, settings.samplingDuration, s.phase)
+	case "flux":
+		return fluxSamples(settings.samplingFrequency, settings.samplingDuration, s.phase)
+	case "temperature":
+		return temperatureSample(s.model)
+	}
+	return []byte{}
+}
+
+// Header followed by the data in MTU sized writes, each prefixed with its
+// chunk index
+func (s *virtualSensor) upload(dataType string, samplingFrequency uint32, data []byte) {
+	mac := model.MacToString(s.mac)
+	chrc := typeChrcs[dataType]
+	chunkSize := s.config.MTU - server.SEQUENCE_LENGTH
+
+	// magic | version | total length | sampling frequency | checksum | chunk size
+	header := append([]byte{}, server.HEADER_MAGIC...)
+	header = append(header, server.HEADER_VERSION)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(data)))
+	header = binary.LittleEndian.AppendUint32(header, samplingFrequency)
+	header = binary.LittleEndian.AppendUint32(header, crc32.ChecksumIEEE(data))
+	header = binary.LittleEndian.AppendUint16(header, uint16(chunkSize))
+
+	chunks := [][]byte{}
+	for offset := 0; offset < len(data); offset += chunkSize {
+		end := min(offset+chunkSize, len(data))
+		chunk := binary.LittleEndian.AppendUint32([]byte{}, uint32(len(chunks)))
+		chunks = append(chunks, append(chunk, data[offset:end]...))
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.chunks[dataType] = chunks
+	s.lastWrite = time.Now()
+
+	err := s.transport.Write(s.mac, chrc, header)
+	if err != nil {
+		out.Logger.Println("SIM", mac, "Error:", err)
+		return
+	}
+
+	// Where the board would brown out or lose the link, if it does
+	stopAt := len(chunks)
+	if rand.Float64() < s.config.Drop {
+		stopAt = rand.Intn(len(chunks) + 1)
+	}
+
+	for i, chunk := range chunks {
+		if i >= stopAt {
+			out.Logger.Println("SIM", mac, "dropped", dataType, "transfer at chunk", i, "/", len(chunks))
+			s.dropped++
+			// Lost along with the rest of the board's memory
+			delete(s.chunks, dataType)
+			return
+		}
+		if rand.Float64() < s.config.Loss {
+			s.lost++
+			continue
+		}
+		writes := 1
+		if rand.Float64() < s.config.Duplicate {
+			s.duplicated++
+			writes = 2
+		}
+		for w := 0; w < writes; w++ {
+			err := s.transport.Write(s.mac, chrc, chunk)
+			if err != nil {
+				out.Logger.Println("SIM", mac, "Error:", err)
+				return
+			}
+		}
+	}
+	s.lastWrite = time.Now()
+	s.sent++
+}
@@ -0,0 +1,81 @@
+package simulator
+
+/*
+ * Synthetic measurements, encoded the way each board sends them
+ */
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+)
+
+// A machine humming along: a few harmonics of the shaft speed plus some noise.
+// accelLSB is the accelerometer resolution in g at the configured range
+func vibrationSamples(frequency uint32, duration uint16, phase float64, accelLSB float64) []byte {
+	n := int(frequency) * int(duration)
+	data := make([]byte, 0, n*6)
+	for i := 0; i < n; i++ {
+		t := float64(i) / float64(frequency)
+		x := 0.5*math.Sin(2*math.Pi*30*t+phase) + 0.05*rand.NormFloat64()
+		y := 0.2*math.Sin(2*math.Pi*60*t+phase) + 0.05*rand.NormFloat64()
+		z := 1 + 0.1*math.Sin(2*math.Pi*120*t+phase) + 0.05*rand.NormFloat64()
+		for _, g := range []float64{x, y, z} {
+			data = binary.LittleEndian.AppendUint16(data, uint16(clampInt16(g/accelLSB)))
+		}
+	}
+	return data
+}
+
+// 1 kHz tone at a quarter of full scale, 24 bit big endian like the microphone
+func audioSamples(frequency uint32, duration uint16, phase float64) []byte {
+	n := int(frequency) * int(duration)
+	data := make([]byte, 0, n*3)
+	fullScale := float64(1<<23 - 1)
+	for i := 0; i < n; i++ {
+		t := float64(i) / float64(frequency)
+		v := int32(fullScale * (0.25*math.Sin(2*math.Pi*1000*t+phase) + 0.01*rand.NormFloat64()))
+		data = append(data, byte(v>>16), byte(v>>8), byte(v))
+	}
+	return data
+}
+
+// Mains frequency leakage seen by the flux sensor
+func fluxSamples(frequency uint32, duration uint16, phase float64) []byte {
+	n := int(frequency) * int(duration)
+	data := make([]byte, 0, n*2)
+	for i := 0; i < n; i++ {
+		t := float64(i) / float64(frequency)
+		v := 8000*math.Sin(2*math.Pi*60*t+phase) + 100*rand.NormFloat64()
+		data = binary.LittleEndian.AppendUint16(data, uint16(clampInt16(v)))
+	}
+	return data
+}
+
+// Room temperature give or take a degree, as the raw register of each board
+func temperatureSample(sensorModel string) []byte {
+	celsius := 25 + rand.NormFloat64()
+	var digital int16
+	switch sensorModel {
+	case "machmo":
+		// PT1000 behind a 1500 ohm reference, read by a 16 bit ADC
+		const A = 3.9083e-3
+		const B = -5.775e-7
+		resistance := 1000 * (1 + A*celsius + B*celsius*celsius)
+		digital = clampInt16(resistance / 1500 * (math.Pow(2, 15) - 1))
+	default:
+		// Digital sensor with 0.0625 C per LSB
+		digital = clampInt16(celsius / 0.0625)
+	}
+	return binary.LittleEndian.AppendUint16([]byte{}, uint16(digital))
+}
+
+func clampInt16(v float64) int16 {
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}